@@ -2,211 +2,344 @@ package app
 
 import (
 	"encoding/json"
-	"io"
-	"log"
+	"fmt"
 	"net/http"
 	"strconv"
 
 	"github.com/codegangsta/negroni"
 	"github.com/gorilla/mux"
+	"github.com/nerdyworm/sess/config"
 	"github.com/nerdyworm/sess/conversions"
+	"github.com/nerdyworm/sess/errs"
+	"github.com/nerdyworm/sess/health"
+	"github.com/nerdyworm/sess/metrics"
+	"github.com/nerdyworm/sess/models"
 	"github.com/nerdyworm/sess/repos"
 	"github.com/nerdyworm/sess/storage"
 	"github.com/nerdyworm/sess/workers"
 	"github.com/streadway/amqp"
 )
 
-func Setup() {
+func Setup(cfg config.Config) {
+	setupSessions(cfg.Sessions)
+	adminToken = cfg.Admin.Token
+	trustedProxies, _ = cfg.HTTP.Proxies()
+	maxUploadBytes = int64(cfg.HTTP.MaxUploadMB) << 20
+
 	workers.Register("InstanceToJPG", InstanceToJPGFunc)
 	workers.Register("InstanceToMovie", InstanceToMovieFunc)
+	workers.Register("InstanceFrameToJPG", InstanceFrameToJPGFunc)
+	workers.Register("InstanceToMetadata", InstanceToMetadataFunc)
+	workers.Register("InstanceToDeidentified", InstanceToDeidentifiedFunc)
 }
 
-func Run() {
+func Run(cfg config.HTTP) {
 	n := negroni.New(
 		negroni.NewRecovery(),
 		negroni.NewLogger(),
+		negroni.HandlerFunc(requestID),
 	)
 
+	cdn := mux.NewRouter().PathPrefix("/cdn/v1").Subrouter()
+	cdn.HandleFunc("/studies/{study_id}/instances/{instance_id}.jpg", imageHandler)
+	cdn.HandleFunc("/studies/{study_id}/instances/{instance_id}.mp4", movieHandler)
+	cdn.HandleFunc("/studies/{study_id}/instances/{instance_id}/frames/{frame}.jpg", frameHandler)
+	cdn.HandleFunc("/studies/{study_id}/instances/{instance_id}.dcm", deidentifiedHandler)
+	conversionRoutes(cdn)
+
+	dicomweb := mux.NewRouter().PathPrefix(DICOMWEB_ROOT).Subrouter()
+	dicomwebRoutes(dicomweb)
+	qidoRoutes(dicomweb)
+	stowRoutes(dicomweb)
+
+	admin := mux.NewRouter().PathPrefix("/admin/v1").Subrouter()
+	adminRoutes(admin)
+
 	r := mux.NewRouter()
-	r.HandleFunc("/cdn/v1/studies/{study_id}/instances/{instance_id}.jpg", imageHandler)
-	r.HandleFunc("/cdn/v1/studies/{study_id}/instances/{instance_id}.mp4", movieHandler)
+	r.HandleFunc("/healthz", health.Liveness)
+	r.HandleFunc("/readyz", health.Readiness)
+	// scrapers send the admin token, the workers serve theirs on the side port
+	r.Handle("/metrics", negroni.New(
+		negroni.HandlerFunc(requireAdmin),
+		negroni.Wrap(metrics.Handler()),
+	))
+	r.PathPrefix("/cdn/v1").Handler(protect(cdn))
+	r.PathPrefix(DICOMWEB_ROOT).Handler(protect(dicomweb))
+	r.PathPrefix("/admin/v1").Handler(negroni.New(
+		negroni.HandlerFunc(requireAdmin),
+		negroni.Wrap(admin),
+	))
+
+	n.Use(instrument(cdn, dicomweb, admin, r))
 	n.UseHandler(r)
-	n.Run(":4000")
+	n.Run(cfg.Addr)
+}
+
+// protect runs the authentication and account authorization middleware in
+// front of every route of router.
+func protect(router *mux.Router) http.Handler {
+	return negroni.New(
+		negroni.HandlerFunc(authenticate),
+		newAuthorizer(router),
+		negroni.Wrap(router),
+	)
 }
 
 func imageHandler(w http.ResponseWriter, r *http.Request) {
-	// TODO: grab user id from session cookies
-	//userID := "5463a558236f44d54100000a"
-
-	//user, err := repos.Users.FindByID(userID)
-	//if err != nil {
-	//log.Println("[ERROR] %v", err)
-	//return
-	//}
-
-	vars := mux.Vars(r)
-	//studyID := vars["study_id"]
-	instanceID := vars["instance_id"]
-
-	//study, err := repos.Studies.FindByID(studyID)
-	//if err != nil {
-	//log.Printf("[ERROR] %v\n", err)
-	//return
-	//}
-
-	instance, err := repos.Instances.FindByID(instanceID)
+	instance := currentInstance(r)
+
+	options, err := imageOptions(w, r, instance)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	converter := conversions.InstanceToJPG{
+		InstanceID: instance.ID,
+		Options:    options,
+	}
+
+	serveConverted(w, r, "InstanceToJPG", converter)
+}
+
+func frameHandler(w http.ResponseWriter, r *http.Request) {
+	instance := currentInstance(r)
+
+	frame, err := strconv.Atoi(mux.Vars(r)["frame"])
+	if err != nil || frame < 1 {
+		writeError(w, r, errs.Errorf(errs.Invalid, "frameHandler", "invalid frame `%s`", mux.Vars(r)["frame"]))
+		return
+	}
+
+	options, err := imageOptions(w, r, instance)
 	if err != nil {
-		log.Printf("[Instance:%s][ERROR] %v\n", instanceID, err)
+		writeError(w, r, err)
 		return
 	}
 
-	//log.Println(models.IsUserInAccount(user, instance.AccountID))
+	converter := conversions.InstanceFrameToJPG{
+		InstanceID: instance.ID,
+		Frame:      frame,
+		Options:    options,
+	}
+
+	serveConverted(w, r, "InstanceFrameToJPG", converter)
+}
 
+// imageOptions reads the ?size=, ?brand=, ?annotate=, ?quality=, format,
+// geometry and window params of the jpg routes.
+func imageOptions(w http.ResponseWriter, r *http.Request, instance *models.Instance) (conversions.Options, error) {
 	sizeString := r.URL.Query().Get("size")
 	size, _ := strconv.Atoi(sizeString)
 
 	brandString := r.URL.Query().Get("brand")
 	brand := brandString == "true"
 
-	converter := conversions.InstanceToJPG{
-		InstanceID: instance.ID,
-		Options: conversions.Options{
-			Size:  size,
-			Brand: brand,
-		},
+	quality, err := parseQuality("imageOptions", r.URL.Query().Get("quality"))
+	if err != nil {
+		return conversions.Options{}, err
 	}
 
-	key := converter.Key()
+	options := conversions.Options{
+		Size:     size,
+		Brand:    brand,
+		Annotate: r.URL.Query().Get("annotate") == "true",
+		Quality:  quality,
+	}
 
-	exists, err := storage.Cache.Exists(key)
+	err = applyFormat(w, r, &options)
 	if err != nil {
-		log.Printf("[Instance:%s][ERROR] %v\n", instanceID, err)
-		return
+		return options, err
 	}
 
-	if !exists {
-		b, _ := json.Marshal(converter)
+	err = applyGeometry(r.URL.Query(), &options)
+	if err != nil {
+		return options, err
+	}
 
-		job := workers.Job{
-			Name:    "InstanceToJPG",
-			Payload: b,
-		}
+	err = applyWindow(&options, windowFromQuery(r), instance)
+	if err != nil {
+		return options, err
+	}
 
-		err = job.PublishAndWait()
-		if err != nil {
-			log.Printf("[Instance:%s][ERROR] %v\n", instanceID, err)
-			return
-		}
+	err = applyAccountSettings(&options, instance)
+	return options, err
+}
+
+// applyAccountSettings resolves the account's annotation templates and
+// logo into the options when they ask for annotations or branding, so that
+// the key changes with them and never names two different images.
+func applyAccountSettings(options *conversions.Options, instance *models.Instance) error {
+	if !options.Annotate && !options.Brand {
+		return nil
 	}
 
-	reader, err := storage.Cache.Get(key)
+	account, err := repos.Accounts.FindByID(instance.AccountID)
 	if err != nil {
-		log.Printf("[Instance:%s][ERROR] %v\n", instance.ID, err)
-		return
+		return err
 	}
 
-	w.Header().Set("Content-Type", converter.ContentType())
-	io.Copy(w, reader)
+	options.SetAnnotations(account)
+	return options.SetBranding(account)
 }
 
 func movieHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	instanceID := vars["instance_id"]
+	instance := currentInstance(r)
+
+	options := conversions.Options{
+		Format: "mp4",
+	}
 
-	instance, err := repos.Instances.FindByID(instanceID)
+	err := applyGeometry(r.URL.Query(), &options)
 	if err != nil {
-		log.Printf("[Instance:%s][ERROR] %v\n", instanceID, err)
+		writeError(w, r, err)
+		return
+	}
+
+	err = applyWindow(&options, windowFromQuery(r), instance)
+	if err != nil {
+		writeError(w, r, err)
 		return
 	}
 
 	converter := conversions.InstanceToMovie{
 		InstanceID: instance.ID,
-		Options: conversions.Options{
-			Format: "mp4",
-		},
+		Options:    options,
 	}
 
-	key := converter.Key()
+	serveConverted(w, r, "InstanceToMovie", converter)
+}
 
-	exists, err := storage.Cache.Exists(key)
-	if err != nil {
-		log.Printf("[Instance:%s][ERROR] %v\n", instanceID, err)
+// deidentifiedHandler serves the original with the confidentiality profile
+// named by ?deidentify= applied, ?retain_dates=true keeps its dates. The
+// original itself is never served from here, and nothing is while no salt
+// is configured.
+func deidentifiedHandler(w http.ResponseWriter, r *http.Request) {
+	instance := currentInstance(r)
+	query := r.URL.Query()
+
+	if !conversions.CanDeidentify() {
+		writeError(w, r, errs.Errorf(errs.Unavailable, "deidentifiedHandler", "de-identification is not configured"))
 		return
 	}
 
-	if !exists {
-		b, _ := json.Marshal(converter)
+	profile := query.Get("deidentify")
+	if profile != "basic" {
+		writeError(w, r, errs.Errorf(errs.Invalid, "deidentifiedHandler", "deidentify has to be `basic`, got `%s`", profile))
+		return
+	}
 
-		job := workers.Job{
-			Name:    "InstanceToMovie",
-			Payload: b,
+	converter := conversions.InstanceToDeidentified{
+		InstanceID:  instance.ID,
+		Profile:     profile,
+		RetainDates: query.Get("retain_dates") == "true",
+	}
+
+	serveConverted(w, r, "InstanceToDeidentified", converter, func(header http.Header) {
+		header.Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.dcm"`, instance.ID))
+	})
+}
+
+var (
+	waiting workers.Group
+)
+
+// ensureConverted makes sure the converter's output is in the cache,
+// publishing a job named jobName and waiting for it when it is not.
+// Concurrent requests for the same key share a single job.
+func ensureConverted(jobName string, converter conversions.Converter) error {
+	key := converter.Key()
+
+	return waiting.Do(key, func() error {
+		exists, err := storage.Cache.Exists(key)
+		if err != nil {
+			return err
+		}
+
+		if exists {
+			return nil
 		}
 
-		err = job.PublishAndWait()
+		b, err := json.Marshal(converter)
 		if err != nil {
-			log.Printf("[Instance:%s][ERROR] %v\n", instanceID, err)
-			return
+			return err
 		}
-	}
 
-	reader, err := storage.Cache.Get(key)
-	if err != nil {
-		log.Printf("[Instance:%s][ERROR] %v\n", instance.ID, err)
-		return
-	}
+		job := workers.Job{
+			Name:    jobName,
+			Payload: b,
+		}
 
-	w.Header().Set("Content-Type", converter.ContentType())
-	io.Copy(w, reader)
+		return job.PublishAndWait()
+	})
 }
 
-func InstanceToJPGFunc(job *workers.Job, message amqp.Delivery) {
-	converter := conversions.InstanceToJPG{}
+// serveConverted answers with the converter's output, converting it first
+// when it is not cached. Conditional requests are answered after that, the
+// etag is the content's. A key another process purged after this one saw
+// it is forgotten and converted again.
+func serveConverted(w http.ResponseWriter, r *http.Request, jobName string, converter conversions.Converter, hooks ...headerHook) {
+	key := converter.Key()
 
-	err := json.Unmarshal(job.Payload, &converter)
-	if err != nil {
-		job.AddError(err)
-		return
-	}
+	err := ensureConverted(jobName, converter)
+	if err == nil {
+		err = serveDerivative(w, r, key, converter.ContentType(), hooks...)
+		if errs.Is(err, errs.NotFound) {
+			storage.Forget(storage.Cache, key)
 
-	reader, err := converter.Convert()
-	if err != nil {
-		job.AddError(err)
-		return
+			err = ensureConverted(jobName, converter)
+			if err == nil {
+				err = serveDerivative(w, r, key, converter.ContentType(), hooks...)
+			}
+		}
 	}
 
-	err = storage.Cache.Put(converter.Key(), reader)
 	if err != nil {
-		job.AddError(err)
+		writeError(w, r, err)
 		return
 	}
 
-	err = job.Ack()
-	if err != nil {
-		job.AddError(err)
-		return
-	}
+	auditAccess(w, r, jobName)
+}
 
-	job.SendReply()
+func InstanceToJPGFunc(job *workers.Job, message amqp.Delivery) {
+	runConversion(job, &conversions.InstanceToJPG{})
 }
 
 func InstanceToMovieFunc(job *workers.Job, message amqp.Delivery) {
-	converter := conversions.InstanceToMovie{}
+	runConversion(job, &conversions.InstanceToMovie{})
+}
+
+func InstanceFrameToJPGFunc(job *workers.Job, message amqp.Delivery) {
+	runConversion(job, &conversions.InstanceFrameToJPG{})
+}
 
-	err := json.Unmarshal(job.Payload, &converter)
+func InstanceToMetadataFunc(job *workers.Job, message amqp.Delivery) {
+	runConversion(job, &conversions.InstanceToMetadata{})
+}
+
+func InstanceToDeidentifiedFunc(job *workers.Job, message amqp.Delivery) {
+	runConversion(job, &conversions.InstanceToDeidentified{})
+}
+
+// runConversion decodes the job's payload into converter and makes sure
+// the result is in the cache before replying. Jobs for a key that is
+// already cached do no conversion work, those for a key being produced
+// elsewhere are deferred and answered by its producer.
+func runConversion(job *workers.Job, converter conversions.Converter) {
+	err := json.Unmarshal(job.Payload, converter)
 	if err != nil {
 		job.AddError(err)
 		return
 	}
 
-	reader, err := converter.Convert()
+	deferred, err := produce(job, converter)
 	if err != nil {
 		job.AddError(err)
 		return
 	}
 
-	err = storage.Cache.Put(converter.Key(), reader)
-	if err != nil {
-		job.AddError(err)
+	if deferred {
 		return
 	}
 
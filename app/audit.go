@@ -0,0 +1,145 @@
+package app
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/codegangsta/negroni"
+	"github.com/nerdyworm/sess/audit"
+	"github.com/nerdyworm/sess/models"
+	"github.com/nerdyworm/sess/signing"
+)
+
+// trustedProxies are the load balancers whose X-Forwarded-For hops
+// clientIP believes.
+var trustedProxies []*net.IPNet
+
+// auditAccess records that the current instance was disclosed as
+// derivative. Only responses that carried, or confirmed the client already
+// had, patient data are recorded; errors disclose nothing.
+func auditAccess(w http.ResponseWriter, r *http.Request, derivative string) {
+	instance := currentInstance(r)
+	if instance == nil {
+		return
+	}
+
+	auditDisclosures(w, r, derivative, []disclosure{{
+		AccountID:        instance.AccountID,
+		InstanceID:       instance.ID,
+		StudyInstanceUID: instance.StudyInstanceUID,
+		PatientID:        instance.PatientID,
+	}})
+}
+
+// disclosure is what one audit event says was shown. Searches disclose a
+// study without any one instance of it.
+type disclosure struct {
+	AccountID        string
+	InstanceID       string
+	StudyInstanceUID string
+	PatientID        string
+}
+
+// auditSearch records one event for each study a search returned any of,
+// however many series or instances of it matched.
+func auditSearch(w http.ResponseWriter, r *http.Request, derivative string, matched []disclosure) {
+	seen := map[disclosure]bool{}
+	studies := []disclosure{}
+
+	for _, study := range matched {
+		key := disclosure{AccountID: study.AccountID, StudyInstanceUID: study.StudyInstanceUID}
+		if seen[key] {
+			continue
+		}
+
+		seen[key] = true
+		studies = append(studies, study)
+	}
+
+	auditDisclosures(w, r, derivative, studies)
+}
+
+func auditDisclosures(w http.ResponseWriter, r *http.Request, derivative string, disclosures []disclosure) {
+	status := http.StatusOK
+	if rw, ok := w.(negroni.ResponseWriter); ok && rw.Status() != 0 {
+		status = rw.Status()
+	}
+
+	outcome := models.AuditServed
+	switch {
+	case status == http.StatusNotModified:
+		outcome = models.AuditNotModified
+	case status >= 300:
+		return
+	}
+
+	for _, disclosed := range disclosures {
+		event := &models.AuditEvent{
+			Time:             time.Now().UTC(),
+			RequestID:        currentRequestID(r),
+			AccountID:        disclosed.AccountID,
+			InstanceID:       disclosed.InstanceID,
+			StudyInstanceUID: disclosed.StudyInstanceUID,
+			PatientID:        disclosed.PatientID,
+			Derivative:       derivative,
+			ClientIP:         clientIP(r),
+			Method:           r.Method,
+			Path:             r.URL.Path,
+			Status:           status,
+			Outcome:          outcome,
+		}
+
+		if user := currentUser(r); user != nil {
+			event.UserID = user.ID
+		}
+
+		if isSigned(r) {
+			event.SigningKey = signing.KeyID(r.URL)
+		}
+
+		audit.Record(event)
+	}
+}
+
+// clientIP is the right-most address that is not one of our trusted
+// proxies: the peer, unless it is a trusted proxy, then the X-Forwarded-For
+// hop it added, and so on. Hops left of the first untrusted one could have
+// been written by the client.
+func clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	hops := []string{}
+	for _, header := range r.Header["X-Forwarded-For"] {
+		for _, hop := range strings.Split(header, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+
+	for i := len(hops) - 1; i >= 0 && isTrustedProxy(ip); i-- {
+		ip = hops[i]
+	}
+
+	return ip
+}
+
+func isTrustedProxy(address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,197 @@
+package app
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/securecookie"
+	"github.com/nerdyworm/sess/config"
+	"github.com/nerdyworm/sess/errs"
+	"github.com/nerdyworm/sess/models"
+	"github.com/nerdyworm/sess/repos"
+	"github.com/nerdyworm/sess/signing"
+)
+
+var (
+	SessionCookieName = "_sess_session"
+	sessionCodec      *securecookie.SecureCookie
+)
+
+type contextKey int
+
+const (
+	userKey contextKey = iota
+	instanceKey
+	signedKey
+	requestIDKey
+)
+
+func setupSessions(cfg config.Sessions) {
+	SessionCookieName = cfg.CookieName
+
+	if cfg.HashKey == "" {
+		log.Println("[WARN] sessions.hash_key is not set, every request will be unauthorized")
+	}
+
+	var blockKey []byte
+	if cfg.BlockKey != "" {
+		blockKey = []byte(cfg.BlockKey)
+	}
+
+	sessionCodec = securecookie.New([]byte(cfg.HashKey), blockKey)
+}
+
+// sessionUserID decodes the session cookie and returns the signed in user's
+// id, or an empty string when there is no valid session.
+func sessionUserID(r *http.Request) string {
+	cookie, err := r.Cookie(SessionCookieName)
+	if err != nil {
+		return ""
+	}
+
+	session := make(map[string]interface{})
+	err = sessionCodec.Decode(SessionCookieName, cookie.Value, &session)
+	if err != nil {
+		log.Printf("[Session][ERROR] %v\n", err)
+		return ""
+	}
+
+	userID, _ := session["user_id"].(string)
+	return userID
+}
+
+// authenticate accepts either a valid signed url or a session cookie. It
+// loads the user from the session and rejects the request with a 401 when
+// nobody is signed in.
+func authenticate(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	if signing.IsSigned(r.URL) {
+		err := signing.Default.Verify(r.URL, time.Now())
+		if err != nil {
+			writeError(w, r, errs.E(errs.Forbidden, "authenticate", err))
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), signedKey, true)
+		next(w, r.WithContext(ctx))
+		return
+	}
+
+	userID := sessionUserID(r)
+	if userID == "" {
+		writeError(w, r, errs.Errorf(errs.Unauthorized, "authenticate", "no session"))
+		return
+	}
+
+	user, err := repos.Users.FindByID(userID)
+	if errs.Is(err, errs.NotFound) {
+		writeError(w, r, errs.Errorf(errs.Unauthorized, "authenticate", "user `%s` not found", userID))
+		return
+	} else if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	ctx := context.WithValue(r.Context(), userKey, user)
+	next(w, r.WithContext(ctx))
+}
+
+// authorizer rejects requests for instances that belong to an account the
+// signed in user is not a member of. It matches the request against the
+// router itself so that every route with an {instance_id}, or the
+// {study_uid}/{series_uid}/{instance_uid} of the DICOMweb routes, is covered.
+// Signed urls were already checked by authenticate and skip the account
+// check.
+type authorizer struct {
+	router *mux.Router
+}
+
+func newAuthorizer(router *mux.Router) authorizer {
+	return authorizer{router}
+}
+
+func (a authorizer) ServeHTTP(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	var match mux.RouteMatch
+	if !a.router.Match(r, &match) {
+		next(w, r)
+		return
+	}
+
+	instance, err := resolveInstance(r, match.Vars)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	if instance == nil {
+		next(w, r)
+		return
+	}
+
+	if !isSigned(r) {
+		err = authorizeAccount(r, instance.AccountID)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+	}
+
+	ctx := context.WithValue(r.Context(), instanceKey, instance)
+	next(w, r.WithContext(ctx))
+}
+
+// authorizeAccount checks that the signed in user is a member of
+// accountID.
+func authorizeAccount(r *http.Request, accountID string) error {
+	user := currentUser(r)
+	if user == nil {
+		return errs.Errorf(errs.Unauthorized, "authorize", "no session")
+	}
+
+	if !models.IsUserInAccount(user, accountID) {
+		return errs.Errorf(errs.Forbidden, "authorize", "account `%s` is not one of the user's accounts", accountID)
+	}
+
+	return nil
+}
+
+// resolveInstance looks up the instance named by the route vars, it
+// returns nil when the route does not name one. UIDs are only unique
+// within an account, so they are looked up in the user's accounts; a
+// signed url has no user and has to name a UID held by one account.
+func resolveInstance(r *http.Request, vars map[string]string) (*models.Instance, error) {
+	if id, ok := vars["instance_id"]; ok {
+		return repos.Instances.FindByID(id)
+	}
+
+	if uid, ok := vars["instance_uid"]; ok {
+		var accountIDs []string
+		if user := currentUser(r); user != nil && !isSigned(r) {
+			accountIDs = user.AccountIds
+			if accountIDs == nil {
+				accountIDs = []string{}
+			}
+		}
+
+		return repos.Instances.FindByUID(accountIDs, vars["study_uid"], vars["series_uid"], uid)
+	}
+
+	return nil, nil
+}
+
+func currentUser(r *http.Request) *models.User {
+	user, _ := r.Context().Value(userKey).(*models.User)
+	return user
+}
+
+func currentInstance(r *http.Request) *models.Instance {
+	instance, _ := r.Context().Value(instanceKey).(*models.Instance)
+	return instance
+}
+
+func isSigned(r *http.Request) bool {
+	signed, _ := r.Context().Value(signedKey).(bool)
+	return signed
+}
@@ -0,0 +1,177 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/nerdyworm/sess/config"
+	"github.com/nerdyworm/sess/errs"
+	"github.com/nerdyworm/sess/models"
+	"github.com/nerdyworm/sess/repos"
+	"github.com/nerdyworm/sess/signing"
+)
+
+type fakeUsers map[string]*models.User
+
+func (f fakeUsers) FindByID(id string) (*models.User, error) {
+	user, ok := f[id]
+	if !ok {
+		return nil, errs.Errorf(errs.NotFound, "fakeUsers.FindByID", "`%s`", id)
+	}
+
+	return user, nil
+}
+
+// fakeInstances only answers the lookups the authorizer makes.
+type fakeInstances struct {
+	repos.InstancesRepo
+	instances map[string]*models.Instance
+}
+
+func (f fakeInstances) FindByID(id string) (*models.Instance, error) {
+	instance, ok := f.instances[id]
+	if !ok {
+		return nil, errs.Errorf(errs.NotFound, "fakeInstances.FindByID", "`%s`", id)
+	}
+
+	return instance, nil
+}
+
+func TestAuthorizeAccount(t *testing.T) {
+	tests := []struct {
+		name      string
+		user      *models.User
+		accountID string
+		err       errs.Kind
+	}{
+		{
+			name:      "member",
+			user:      &models.User{ID: "u", AccountIds: []string{"a", "b"}},
+			accountID: "b",
+		},
+		{
+			name:      "other account",
+			user:      &models.User{ID: "u", AccountIds: []string{"a"}},
+			accountID: "b",
+			err:       errs.Forbidden,
+		},
+		{
+			name:      "no accounts",
+			user:      &models.User{ID: "u"},
+			accountID: "a",
+			err:       errs.Forbidden,
+		},
+		{
+			name:      "no session",
+			accountID: "a",
+			err:       errs.Unauthorized,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			if test.user != nil {
+				r = r.WithContext(context.WithValue(r.Context(), userKey, test.user))
+			}
+
+			err := authorizeAccount(r, test.accountID)
+			if test.err == 0 {
+				if err != nil {
+					t.Errorf("unexpected error %v", err)
+				}
+				return
+			}
+
+			if !errs.Is(err, test.err) {
+				t.Errorf("err = %v, want kind %v", err, test.err)
+			}
+		})
+	}
+}
+
+// TestProtect runs requests through authenticate and the authorizer, signed
+// urls skip the account check and nothing else does.
+func TestProtect(t *testing.T) {
+	defer func(users repos.UsersRepo, instances repos.InstancesRepo, signer signing.Signer) {
+		repos.Users, repos.Instances, signing.Default = users, instances, signer
+	}(repos.Users, repos.Instances, signing.Default)
+
+	setupSessions(config.Sessions{CookieName: "_test_session", HashKey: "0123456789abcdef0123456789abcdef"})
+	signing.Default = signing.New(signing.Key{ID: "k", Secret: []byte("secret")})
+
+	repos.Users = fakeUsers{
+		"member":   {ID: "member", AccountIds: []string{"a"}},
+		"outsider": {ID: "outsider", AccountIds: []string{"b"}},
+	}
+	repos.Instances = fakeInstances{instances: map[string]*models.Instance{
+		"i": {ID: "i", AccountID: "a"},
+	}}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/studies/{study_id}/instances/{instance_id}.jpg", func(w http.ResponseWriter, r *http.Request) {
+		if currentInstance(r) == nil {
+			t.Error("no instance in the context")
+		}
+	})
+	handler := protect(router)
+
+	path := "/studies/s/instances/i.jpg"
+	signed := func(expires time.Time) string {
+		u, err := signing.Default.Sign(path+"?size=256", expires)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return u
+	}
+
+	tests := []struct {
+		name   string
+		url    string
+		user   string
+		status int
+	}{
+		{name: "member", url: path, user: "member", status: http.StatusOK},
+		{name: "other account", url: path, user: "outsider", status: http.StatusForbidden},
+		{name: "unknown user", url: path, user: "nobody", status: http.StatusUnauthorized},
+		{name: "no session", url: path, status: http.StatusUnauthorized},
+		{name: "signed", url: signed(time.Now().Add(time.Minute)), status: http.StatusOK},
+		{name: "signed for another account", url: signed(time.Now().Add(time.Minute)), user: "outsider", status: http.StatusOK},
+		{name: "signed and expired", url: signed(time.Now().Add(-time.Minute)), status: http.StatusForbidden},
+		{name: "signed and tampered", url: tamper(signed(time.Now().Add(time.Minute)), "size", "2048"), status: http.StatusForbidden},
+		{name: "missing instance", url: "/studies/s/instances/x.jpg", user: "member", status: http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", test.url, nil)
+			if test.user != "" {
+				value, err := sessionCodec.Encode(SessionCookieName, map[string]interface{}{"user_id": test.user})
+				if err != nil {
+					t.Fatal(err)
+				}
+				r.AddCookie(&http.Cookie{Name: SessionCookieName, Value: value})
+			}
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != test.status {
+				t.Errorf("status = %d, want %d: %s", w.Code, test.status, w.Body)
+			}
+		})
+	}
+}
+
+func tamper(rawurl, name, value string) string {
+	u, _ := url.Parse(rawurl)
+	query := u.Query()
+	query.Set(name, value)
+	u.RawQuery = query.Encode()
+	return u.String()
+}
@@ -0,0 +1,156 @@
+package app
+
+import (
+	"log"
+	"time"
+
+	"github.com/nerdyworm/sess/conversions"
+	"github.com/nerdyworm/sess/models"
+	"github.com/nerdyworm/sess/repos"
+	"github.com/nerdyworm/sess/storage"
+	"github.com/nerdyworm/sess/util"
+	"github.com/nerdyworm/sess/workers"
+)
+
+// produceLockTTL is the lease a producer holds on a key, it is renewed
+// every produceRenewInterval while the conversion runs so that long ones,
+// movies, are not taken over half way.
+const (
+	produceLockTTL       = 2 * time.Minute
+	produceRenewInterval = produceLockTTL / 4
+)
+
+// produce makes sure the converter's output is in the cache. Only one
+// worker in the cluster converts a given key at a time. A job for a key
+// that is being produced elsewhere is queued on the key's lock and
+// deferred, it is acked right away and the holder replies to it when the
+// conversion is done, so no worker sits waiting on another's conversion.
+// When the holder dies its lease runs out, the next job for the key takes
+// the lock over along with its waiters, or the workers' reaper fails them.
+func produce(job *workers.Job, converter conversions.Converter) (deferred bool, err error) {
+	key := converter.Key()
+	lock := "produce:" + key
+
+	// jobs are only published for keys the web node found missing, what
+	// this process remembers about the key may be from before a purge
+	storage.Forget(storage.Cache, key)
+
+	for {
+		exists, err := storage.Cache.Exists(key)
+		if err != nil {
+			return false, err
+		}
+
+		if exists {
+			return false, nil
+		}
+
+		owner := util.RandomString(32)
+		acquired, err := repos.Locks.Acquire(lock, owner, produceLockTTL)
+		if err != nil {
+			return false, err
+		}
+
+		if acquired {
+			return false, holdAndConvert(lock, owner, converter)
+		}
+
+		queued, err := repos.Locks.Enqueue(lock, job.Waiter())
+		if err != nil {
+			return false, err
+		}
+
+		if queued {
+			return true, job.Defer()
+		}
+
+		// the holder released the lock between our acquire and enqueue,
+		// its output is in the cache or the lock is free, look again
+	}
+}
+
+// holdAndConvert converts while holding lock, renewing its lease until the
+// conversion is done, then releases it and answers the jobs queued on it.
+func holdAndConvert(lock, owner string, converter conversions.Converter) (err error) {
+	done := make(chan struct{})
+	go renewLock(lock, owner, done)
+
+	defer func() {
+		close(done)
+
+		waiters, releaseErr := repos.Locks.Release(lock, owner)
+		if releaseErr != nil {
+			log.Printf("[Produce:%s][ERROR] %v\n", lock, releaseErr)
+		}
+
+		workers.Answer(waiters, err)
+	}()
+
+	return convertAndStore(converter)
+}
+
+func renewLock(lock, owner string, done chan struct{}) {
+	ticker := time.NewTicker(produceRenewInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+
+		case <-ticker.C:
+			held, err := repos.Locks.Renew(lock, owner, produceLockTTL)
+			if err != nil {
+				log.Printf("[Produce:%s][ERROR] %v\n", lock, err)
+			} else if !held {
+				log.Printf("[Produce:%s][ERROR] lease lost\n", lock)
+				return
+			}
+		}
+	}
+}
+
+func convertAndStore(converter conversions.Converter) error {
+	key := converter.Key()
+
+	// another worker may have finished between our check and the lock
+	exists, err := storage.Cache.Exists(key)
+	if err != nil {
+		return err
+	}
+
+	if exists {
+		return nil
+	}
+
+	reader, err := converter.Convert()
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	// index before the put so that nothing lands in the cache that a purge
+	// can not find, an entry for a failed put only costs a miss on purge
+	err = recordDerivative(converter)
+	if err != nil {
+		return err
+	}
+
+	return storage.Cache.PutWithOptions(key, reader, storage.PutOptions{
+		ContentType: converter.ContentType(),
+	})
+}
+
+func recordDerivative(converter conversions.Converter) error {
+	instance, err := repos.Instances.FindByID(converter.Source())
+	if err != nil {
+		return err
+	}
+
+	return repos.Derivatives.Record(&models.Derivative{
+		Key:              converter.Key(),
+		AccountID:        instance.AccountID,
+		StudyInstanceUID: instance.StudyInstanceUID,
+		InstanceID:       instance.ID,
+	})
+}
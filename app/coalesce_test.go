@@ -0,0 +1,341 @@
+package app
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nerdyworm/sess/errs"
+	"github.com/nerdyworm/sess/models"
+	"github.com/nerdyworm/sess/repos"
+	"github.com/nerdyworm/sess/storage"
+	"github.com/nerdyworm/sess/workers"
+	"github.com/streadway/amqp"
+)
+
+type fakeLock struct {
+	owner   string
+	expires time.Time
+	waiters []models.Waiter
+}
+
+// fakeLocks keeps locks the way the mongo repo does. enqueueRace makes the
+// next Enqueue find the lock released by its holder.
+type fakeLocks struct {
+	mu          sync.Mutex
+	locks       map[string]*fakeLock
+	enqueueRace bool
+}
+
+func (f *fakeLocks) Acquire(name, owner string, ttl time.Duration) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	lock, ok := f.locks[name]
+	if !ok {
+		f.locks[name] = &fakeLock{owner: owner, expires: time.Now().Add(ttl)}
+		return true, nil
+	}
+
+	if lock.expires.After(time.Now()) {
+		return false, nil
+	}
+
+	lock.owner, lock.expires = owner, time.Now().Add(ttl)
+	return true, nil
+}
+
+func (f *fakeLocks) Renew(name, owner string, ttl time.Duration) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	lock, ok := f.locks[name]
+	if !ok || lock.owner != owner {
+		return false, nil
+	}
+
+	lock.expires = time.Now().Add(ttl)
+	return true, nil
+}
+
+func (f *fakeLocks) Release(name, owner string) ([]models.Waiter, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	lock, ok := f.locks[name]
+	if !ok || lock.owner != owner {
+		return nil, nil
+	}
+
+	delete(f.locks, name)
+	return lock.waiters, nil
+}
+
+func (f *fakeLocks) Enqueue(name string, waiter models.Waiter) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.enqueueRace {
+		f.enqueueRace = false
+		delete(f.locks, name)
+	}
+
+	lock, ok := f.locks[name]
+	if !ok || !lock.expires.After(time.Now()) {
+		return false, nil
+	}
+
+	lock.waiters = append(lock.waiters, waiter)
+	return true, nil
+}
+
+func (f *fakeLocks) Held(name string) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	lock, ok := f.locks[name]
+	return ok && lock.expires.After(time.Now()), nil
+}
+
+func (f *fakeLocks) Reap(before time.Time) ([]models.Waiter, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	waiters := []models.Waiter{}
+	for name, lock := range f.locks {
+		if lock.expires.Before(before) {
+			waiters = append(waiters, lock.waiters...)
+			delete(f.locks, name)
+		}
+	}
+
+	return waiters, nil
+}
+
+type fakeConversions struct {
+	repos.ConversionsRepo
+	mu       sync.Mutex
+	statuses map[string]string
+}
+
+func (f *fakeConversions) SetStatus(id, status, message string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.statuses[id] = status
+	return nil
+}
+
+func (f *fakeConversions) status(id string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.statuses[id]
+}
+
+type fakeDerivatives struct {
+	repos.DerivativesRepo
+	recorded []string
+}
+
+func (f *fakeDerivatives) Record(derivative *models.Derivative) error {
+	f.recorded = append(f.recorded, derivative.Key)
+	return nil
+}
+
+// testConverter counts its conversions, during runs while it converts.
+type testConverter struct {
+	err    error
+	calls  *int
+	during func()
+}
+
+func (c testConverter) Key() string         { return "convertions/test.jpg" }
+func (c testConverter) Source() string      { return "i" }
+func (c testConverter) ContentType() string { return "image/jpeg" }
+
+func (c testConverter) Convert() (io.ReadCloser, error) {
+	*c.calls++
+	if c.during != nil {
+		c.during()
+	}
+
+	if c.err != nil {
+		return nil, c.err
+	}
+
+	return ioutil.NopCloser(strings.NewReader("jpeg")), nil
+}
+
+type acknowledger struct{ acks *int }
+
+func (a acknowledger) Ack(tag uint64, multiple bool) error {
+	*a.acks++
+	return nil
+}
+
+func (a acknowledger) Nack(tag uint64, multiple, requeue bool) error { return nil }
+func (a acknowledger) Reject(tag uint64, requeue bool) error         { return nil }
+
+func testJob(id string, acks *int) *workers.Job {
+	return &workers.Job{ID: id, Delivery: amqp.Delivery{Acknowledger: acknowledger{acks}}}
+}
+
+func setupProduce(t *testing.T) (*fakeLocks, *fakeConversions, *fakeDerivatives) {
+	locks, conversions, derivatives, instances, cache := repos.Locks, repos.Conversions, repos.Derivatives, repos.Instances, storage.Cache
+	t.Cleanup(func() {
+		repos.Locks, repos.Conversions, repos.Derivatives, repos.Instances, storage.Cache = locks, conversions, derivatives, instances, cache
+	})
+
+	fakes := &fakeLocks{locks: map[string]*fakeLock{}}
+	statuses := &fakeConversions{statuses: map[string]string{}}
+	recorded := &fakeDerivatives{}
+
+	repos.Locks, repos.Conversions, repos.Derivatives = fakes, statuses, recorded
+	repos.Instances = fakeInstances{instances: map[string]*models.Instance{"i": {ID: "i", AccountID: "a"}}}
+	storage.Cache = storage.NewMemoryStore(1<<20, 1<<20, 0)
+
+	return fakes, statuses, recorded
+}
+
+const testLock = "produce:convertions/test.jpg"
+
+func TestProduce(t *testing.T) {
+	queued := models.Waiter{JobID: "queued"}
+
+	tests := []struct {
+		name     string
+		cached   bool
+		lock     *fakeLock
+		race     bool
+		err      error
+		deferred bool
+		converts int
+		statuses map[string]string
+	}{
+		{name: "free", converts: 1},
+		{name: "cached", cached: true},
+		{name: "held", lock: &fakeLock{owner: "other", expires: time.Now().Add(time.Minute)}, deferred: true},
+		{name: "released before enqueue", lock: &fakeLock{owner: "other", expires: time.Now().Add(time.Minute)}, race: true, converts: 1},
+		{
+			name:     "expired holder's waiters taken over",
+			lock:     &fakeLock{owner: "dead", expires: time.Now().Add(-time.Second), waiters: []models.Waiter{queued}},
+			converts: 1,
+			statuses: map[string]string{"queued": models.ConversionDone},
+		},
+		{
+			name:     "failure answered",
+			lock:     &fakeLock{owner: "dead", expires: time.Now().Add(-time.Second), waiters: []models.Waiter{queued}},
+			err:      errs.Errorf(errs.ConversionFailed, "test", "bad pixels"),
+			converts: 1,
+			statuses: map[string]string{"queued": models.ConversionFailed},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			locks, conversions, derivatives := setupProduce(t)
+
+			if test.cached {
+				storage.Cache.Put("convertions/test.jpg", strings.NewReader("jpeg"))
+			}
+
+			if test.lock != nil {
+				lock := *test.lock
+				locks.locks[testLock] = &lock
+			}
+			locks.enqueueRace = test.race
+
+			calls, acks := 0, 0
+			deferred, err := produce(testJob("job", &acks), testConverter{err: test.err, calls: &calls})
+
+			if !errors.Is(err, test.err) {
+				t.Errorf("err = %v, want %v", err, test.err)
+			}
+
+			if deferred != test.deferred {
+				t.Errorf("deferred = %v, want %v", deferred, test.deferred)
+			}
+
+			if calls != test.converts {
+				t.Errorf("converted %d times, want %d", calls, test.converts)
+			}
+
+			if test.deferred {
+				if acks != 1 {
+					t.Errorf("deferred job acked %d times, want 1", acks)
+				}
+
+				waiters := locks.locks[testLock].waiters
+				if len(waiters) != 1 || waiters[0].JobID != "job" {
+					t.Errorf("waiters %+v, want the job", waiters)
+				}
+				return
+			}
+
+			if _, held := locks.locks[testLock]; held {
+				t.Error("lock not released")
+			}
+
+			if test.converts > 0 && test.err == nil {
+				if exists, _ := storage.Cache.Exists("convertions/test.jpg"); !exists {
+					t.Error("output not cached")
+				}
+
+				if len(derivatives.recorded) != 1 {
+					t.Errorf("recorded %v, want the key", derivatives.recorded)
+				}
+			}
+
+			for id, status := range test.statuses {
+				if got := conversions.status(id); got != status {
+					t.Errorf("status of %s = %q, want %q", id, got, status)
+				}
+			}
+		})
+	}
+}
+
+// TestProduceAnswersWaiters queues a second job while the first converts,
+// the first answers it when it releases the lock.
+func TestProduceAnswersWaiters(t *testing.T) {
+	locks, conversions, _ := setupProduce(t)
+
+	var waitDeferred bool
+	var waitErr error
+	acks := 0
+
+	calls := 0
+	converter := testConverter{calls: &calls}
+	converter.during = func() {
+		waitDeferred, waitErr = produce(testJob("second", &acks), testConverter{calls: &calls})
+		if got := conversions.status("second"); got != "" {
+			t.Errorf("second answered with %q while the first converts", got)
+		}
+	}
+
+	deferred, err := produce(testJob("first", &acks), converter)
+	if err != nil || deferred {
+		t.Fatalf("first: deferred %v, err %v", deferred, err)
+	}
+
+	if waitErr != nil || !waitDeferred {
+		t.Fatalf("second: deferred %v, err %v", waitDeferred, waitErr)
+	}
+
+	if calls != 1 {
+		t.Errorf("converted %d times, want 1", calls)
+	}
+
+	if got := conversions.status("second"); got != models.ConversionDone {
+		t.Errorf("status of second = %q, want %q", got, models.ConversionDone)
+	}
+
+	if len(locks.locks) != 0 {
+		t.Errorf("locks left %v", locks.locks)
+	}
+}
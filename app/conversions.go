@@ -0,0 +1,332 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/nerdyworm/sess/conversions"
+	"github.com/nerdyworm/sess/errs"
+	"github.com/nerdyworm/sess/models"
+	"github.com/nerdyworm/sess/repos"
+	"github.com/nerdyworm/sess/storage"
+	"github.com/nerdyworm/sess/workers"
+)
+
+type conversionRequest struct {
+	Type       string         `json:"type"`
+	StudyID    string         `json:"study_id"`
+	InstanceID string         `json:"instance_id"`
+	Frame      int            `json:"frame"`
+	Size       int            `json:"size"`
+	Brand      bool           `json:"brand"`
+	Annotate   bool           `json:"annotate"`
+	Width      int            `json:"width"`
+	Height     int            `json:"height"`
+	Fit        string         `json:"fit"`
+	Crop       *regionRequest `json:"crop"`
+	Format     string         `json:"format"`
+	Quality    int            `json:"quality"`
+	WC         string         `json:"wc"`
+	WW         string         `json:"ww"`
+	Preset     string         `json:"preset"`
+}
+
+type regionRequest struct {
+	X      int `json:"x"`
+	Y      int `json:"y"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+type conversionResponse struct {
+	ID        string    `json:"id"`
+	Status    string    `json:"status"`
+	URL       string    `json:"url"`
+	StatusURL string    `json:"status_url"`
+	Error     string    `json:"error,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func conversionRoutes(r *mux.Router) {
+	r.HandleFunc("/conversions", createConversionHandler).Methods("POST")
+	r.HandleFunc("/conversions/{conversion_id}", conversionHandler).Methods("GET")
+}
+
+// createConversionHandler queues a conversion and returns right away with
+// the url the result will be served from, so that long running movies do
+// not hold a connection open.
+func createConversionHandler(w http.ResponseWriter, r *http.Request) {
+	op := "createConversionHandler"
+
+	request := conversionRequest{}
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		writeError(w, r, errs.E(errs.Invalid, op, err))
+		return
+	}
+
+	instance, err := repos.Instances.FindByID(request.InstanceID)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	err = authorizeAccount(r, instance.AccountID)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	jobName, converter, path, err := request.converter(instance)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	conversion := &models.Conversion{
+		AccountID:  instance.AccountID,
+		InstanceID: instance.ID,
+		JobName:    jobName,
+		Key:        converter.Key(),
+		URL:        path,
+		Status:     models.ConversionQueued,
+	}
+
+	exists, err := storage.Cache.Exists(converter.Key())
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	if exists {
+		conversion.Status = models.ConversionDone
+	}
+
+	err = repos.Conversions.Create(conversion)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	if !exists {
+		payload, err := json.Marshal(converter)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		job := workers.Job{
+			ID:      conversion.ID,
+			Name:    jobName,
+			Payload: payload,
+		}
+
+		err = job.Publish()
+		if err != nil {
+			repos.Conversions.SetStatus(conversion.ID, models.ConversionFailed, err.Error())
+			writeError(w, r, err)
+			return
+		}
+	}
+
+	w.Header().Set("Location", statusURL(conversion))
+	writeConversion(w, http.StatusAccepted, conversion)
+}
+
+func conversionHandler(w http.ResponseWriter, r *http.Request) {
+	conversion, err := repos.Conversions.FindByID(mux.Vars(r)["conversion_id"])
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	err = authorizeAccount(r, conversion.AccountID)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeConversion(w, http.StatusOK, conversion)
+}
+
+// converter maps a request onto the same converters, and cache keys, the
+// synchronous routes use.
+func (c conversionRequest) converter(instance *models.Instance) (string, conversions.Converter, string, error) {
+	op := "conversionRequest.converter"
+
+	study, err := instanceStudy(instance)
+	if err != nil {
+		return "", nil, "", err
+	}
+
+	// the result url names the study the instance is in, whatever the
+	// request says
+	if c.StudyID != "" && c.StudyID != study.ID {
+		return "", nil, "", errs.Errorf(errs.Invalid, op, "instance `%s` is not in study `%s`", instance.ID, c.StudyID)
+	}
+
+	if c.Quality < 0 || c.Quality > 100 {
+		return "", nil, "", errs.Errorf(errs.Invalid, op, "invalid quality `%d`", c.Quality)
+	}
+
+	options := conversions.Options{
+		Size:     c.Size,
+		Brand:    c.Brand,
+		Annotate: c.Annotate,
+		Quality:  c.Quality,
+	}
+
+	err = options.SetFormat(c.Format)
+	if err != nil {
+		return "", nil, "", err
+	}
+
+	if c.Width > 0 || c.Height > 0 {
+		err = options.SetGeometry(c.Width, c.Height, c.Fit)
+		if err != nil {
+			return "", nil, "", err
+		}
+	}
+
+	if c.Crop != nil {
+		err = options.SetCrop(conversions.Region{X: c.Crop.X, Y: c.Crop.Y, Width: c.Crop.Width, Height: c.Crop.Height})
+		if err != nil {
+			return "", nil, "", err
+		}
+	}
+
+	window := windowRequest{Center: c.WC, Width: c.WW, Preset: c.Preset}
+	err = applyWindow(&options, window, instance)
+	if err != nil {
+		return "", nil, "", err
+	}
+
+	err = applyAccountSettings(&options, instance)
+	if err != nil {
+		return "", nil, "", err
+	}
+
+	query := url.Values{}
+	if c.Size > 0 {
+		query.Set("size", strconv.Itoa(c.Size))
+	}
+
+	if c.Brand {
+		query.Set("brand", "true")
+	}
+
+	if c.Annotate {
+		query.Set("annotate", "true")
+	}
+
+	if quality := options.EncodeQuality(); quality > 0 {
+		query.Set("quality", strconv.Itoa(quality))
+	}
+
+	query.Set("format", options.ImageFormat())
+	geometryQuery(query, options)
+
+	// the url carries the resolved window so it maps onto the same key even
+	// if the account's default preset changes later
+	if options.HasWindow() {
+		query.Set("wc", options.WindowCenter)
+		query.Set("ww", options.WindowWidth)
+	}
+
+	base := fmt.Sprintf("/cdn/v1/studies/%s/instances/%s", study.ID, instance.ID)
+
+	switch c.Type {
+	case "jpg":
+		return "InstanceToJPG", conversions.InstanceToJPG{
+			InstanceID: c.InstanceID,
+			Options:    options,
+		}, withQuery(base+".jpg", query), nil
+
+	case "frame":
+		if c.Frame < 1 {
+			return "", nil, "", errs.Errorf(errs.Invalid, op, "invalid frame `%d`", c.Frame)
+		}
+
+		return "InstanceFrameToJPG", conversions.InstanceFrameToJPG{
+			InstanceID: c.InstanceID,
+			Frame:      c.Frame,
+			Options:    options,
+		}, withQuery(fmt.Sprintf("%s/frames/%d.jpg", base, c.Frame), query), nil
+
+	case "mp4":
+		movie := conversions.Options{
+			Format:       "mp4",
+			Width:        options.Width,
+			Height:       options.Height,
+			Fit:          options.Fit,
+			Crop:         options.Crop,
+			WindowCenter: options.WindowCenter,
+			WindowWidth:  options.WindowWidth,
+		}
+
+		movieQuery := url.Values{}
+		geometryQuery(movieQuery, movie)
+		if movie.HasWindow() {
+			movieQuery.Set("wc", movie.WindowCenter)
+			movieQuery.Set("ww", movie.WindowWidth)
+		}
+
+		return "InstanceToMovie", conversions.InstanceToMovie{
+			InstanceID: c.InstanceID,
+			Options:    movie,
+		}, withQuery(base+".mp4", movieQuery), nil
+	}
+
+	return "", nil, "", errs.Errorf(errs.Invalid, op, "unknown type `%s`", c.Type)
+}
+
+// instanceStudy finds the study an instance was stored in, by its UID in
+// the instance's account.
+func instanceStudy(instance *models.Instance) (*models.Study, error) {
+	studies, err := repos.Studies.Search(repos.StudyQuery{
+		AccountIDs:       []string{instance.AccountID},
+		StudyInstanceUID: instance.StudyInstanceUID,
+		Page:             repos.Page{Limit: 1},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(studies) == 0 {
+		return nil, errs.Errorf(errs.NotFound, "instanceStudy", "no study `%s` for instance `%s`", instance.StudyInstanceUID, instance.ID)
+	}
+
+	return studies[0], nil
+}
+
+func withQuery(path string, query url.Values) string {
+	if len(query) == 0 {
+		return path
+	}
+
+	return path + "?" + query.Encode()
+}
+
+func statusURL(conversion *models.Conversion) string {
+	return "/cdn/v1/conversions/" + conversion.ID
+}
+
+func writeConversion(w http.ResponseWriter, status int, conversion *models.Conversion) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(conversionResponse{
+		ID:        conversion.ID,
+		Status:    conversion.Status,
+		URL:       conversion.URL,
+		StatusURL: statusURL(conversion),
+		Error:     conversion.Error,
+		CreatedAt: conversion.CreatedAt,
+		UpdatedAt: conversion.UpdatedAt,
+	})
+}
@@ -0,0 +1,124 @@
+package app
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/nerdyworm/sess/errs"
+	"github.com/nerdyworm/sess/models"
+	"github.com/nerdyworm/sess/repos"
+)
+
+type fakeAccounts map[string]*models.Account
+
+func (f fakeAccounts) FindByID(id string) (*models.Account, error) {
+	account, ok := f[id]
+	if !ok {
+		return nil, errs.Errorf(errs.NotFound, "fakeAccounts.FindByID", "`%s`", id)
+	}
+
+	return account, nil
+}
+
+func setupConversionRequest(t *testing.T) {
+	accounts, studies := repos.Accounts, repos.Studies
+	t.Cleanup(func() { repos.Accounts, repos.Studies = accounts, studies })
+
+	repos.Accounts = fakeAccounts{"a": {ID: "a"}, "b": {ID: "b"}}
+	repos.Studies = fakeStudies{
+		studies: []*models.Study{
+			{ID: "s", AccountID: "a", StudyInstanceUID: "1.1"},
+			{ID: "other", AccountID: "a", StudyInstanceUID: "1.2"},
+			{ID: "b1.1", AccountID: "b", StudyInstanceUID: "1.1"},
+		},
+		queries: &[]repos.StudyQuery{},
+	}
+}
+
+func TestConversionRequestStudy(t *testing.T) {
+	setupConversionRequest(t)
+
+	tests := []struct {
+		name     string
+		instance *models.Instance
+		studyID  string
+		url      string
+		err      errs.Kind
+	}{
+		{name: "its study", instance: &models.Instance{ID: "i", AccountID: "a", StudyInstanceUID: "1.1"}, studyID: "s", url: "/cdn/v1/studies/s/instances/i.jpg"},
+		{name: "no study given", instance: &models.Instance{ID: "i", AccountID: "a", StudyInstanceUID: "1.1"}, url: "/cdn/v1/studies/s/instances/i.jpg"},
+		{name: "same uid in another account", instance: &models.Instance{ID: "j", AccountID: "b", StudyInstanceUID: "1.1"}, url: "/cdn/v1/studies/b1.1/instances/j.jpg"},
+		{name: "another study", instance: &models.Instance{ID: "i", AccountID: "a", StudyInstanceUID: "1.1"}, studyID: "other", err: errs.Invalid},
+		{name: "another account's study", instance: &models.Instance{ID: "i", AccountID: "a", StudyInstanceUID: "1.1"}, studyID: "b1.1", err: errs.Invalid},
+		{name: "study missing", instance: &models.Instance{ID: "i", AccountID: "a", StudyInstanceUID: "9.9"}, err: errs.NotFound},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := conversionRequest{Type: "jpg", StudyID: test.studyID, InstanceID: test.instance.ID}
+			_, _, resultURL, err := request.converter(test.instance)
+
+			if test.err != 0 {
+				if !errs.Is(err, test.err) {
+					t.Errorf("err = %v, want kind %v", err, test.err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			u, _ := url.Parse(resultURL)
+			if u.Path != test.url {
+				t.Errorf("url %s, want %s", u.Path, test.url)
+			}
+		})
+	}
+}
+
+func TestConversionRequestQuality(t *testing.T) {
+	setupConversionRequest(t)
+
+	instance := &models.Instance{ID: "i", AccountID: "a", StudyInstanceUID: "1.1"}
+
+	tests := []struct {
+		name    string
+		format  string
+		quality string
+		same    bool
+	}{
+		{name: "jpeg", format: "jpeg", quality: "80"},
+		{name: "webp", format: "webp", quality: "80"},
+		{name: "png", format: "png", same: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := conversionRequest{Type: "jpg", StudyID: "s", InstanceID: "i", Format: test.format, Quality: 80}
+			_, converter, resultURL, err := request.converter(instance)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			u, err := url.Parse(resultURL)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := u.Query().Get("quality"); got != test.quality {
+				t.Errorf("quality in %s = %q, want %q", resultURL, got, test.quality)
+			}
+
+			request.Quality = 0
+			_, plain, _, err := request.converter(instance)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if same := converter.Key() == plain.Key(); same != test.same {
+				t.Errorf("key with quality %s, without %s", converter.Key(), plain.Key())
+			}
+		})
+	}
+}
@@ -0,0 +1,207 @@
+package app
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/nerdyworm/sess/conversions"
+	"github.com/nerdyworm/sess/errs"
+	"github.com/nerdyworm/sess/models"
+)
+
+const (
+	DICOMWEB_ROOT = "/dicomweb"
+
+	defaultThumbnailSize = 128
+)
+
+func dicomwebRoutes(r *mux.Router) {
+	instance := "/studies/{study_uid}/series/{series_uid}/instances/{instance_uid}"
+
+	r.HandleFunc(instance+"/rendered", renderedHandler).Methods("GET", "HEAD")
+	r.HandleFunc(instance+"/frames/{frame}/rendered", frameRenderedHandler).Methods("GET", "HEAD")
+	r.HandleFunc(instance+"/thumbnail", thumbnailHandler).Methods("GET", "HEAD")
+	r.HandleFunc(instance+"/metadata", metadataHandler).Methods("GET", "HEAD")
+}
+
+func renderedHandler(w http.ResponseWriter, r *http.Request) {
+	instance := currentInstance(r)
+
+	options, err := renderedOptions(r, instance)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	contentType, ok := negotiate(r.Header.Get("Accept"), "image/jpeg", "image/png", "image/webp", "video/mp4")
+	if !ok {
+		writeError(w, r, errs.Errorf(errs.NotAcceptable, "renderedHandler", "accept `%s`", r.Header.Get("Accept")))
+		return
+	}
+
+	w.Header().Add("Vary", "Accept")
+
+	if contentType == "video/mp4" {
+		options.Format = "mp4"
+		serveConverted(w, r, "InstanceToMovie", conversions.InstanceToMovie{
+			InstanceID: instance.ID,
+			Options:    options,
+		})
+		return
+	}
+
+	options.SetFormat(conversions.FormatForContentType(contentType))
+	serveConverted(w, r, "InstanceToJPG", conversions.InstanceToJPG{
+		InstanceID: instance.ID,
+		Options:    options,
+	})
+}
+
+func frameRenderedHandler(w http.ResponseWriter, r *http.Request) {
+	instance := currentInstance(r)
+
+	frame, err := strconv.Atoi(mux.Vars(r)["frame"])
+	if err != nil || frame < 1 {
+		writeError(w, r, errs.Errorf(errs.Invalid, "frameRenderedHandler", "invalid frame `%s`", mux.Vars(r)["frame"]))
+		return
+	}
+
+	options, err := renderedOptions(r, instance)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	contentType, ok := negotiate(r.Header.Get("Accept"), imageContentTypes...)
+	if !ok {
+		writeError(w, r, errs.Errorf(errs.NotAcceptable, "frameRenderedHandler", "accept `%s`", r.Header.Get("Accept")))
+		return
+	}
+
+	w.Header().Add("Vary", "Accept")
+	options.SetFormat(conversions.FormatForContentType(contentType))
+
+	serveConverted(w, r, "InstanceFrameToJPG", conversions.InstanceFrameToJPG{
+		InstanceID: instance.ID,
+		Frame:      frame,
+		Options:    options,
+	})
+}
+
+func thumbnailHandler(w http.ResponseWriter, r *http.Request) {
+	instance := currentInstance(r)
+
+	options, err := renderedOptions(r, instance)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	if options.Size == 0 {
+		options.Size = defaultThumbnailSize
+	}
+
+	contentType, ok := negotiate(r.Header.Get("Accept"), imageContentTypes...)
+	if !ok {
+		writeError(w, r, errs.Errorf(errs.NotAcceptable, "thumbnailHandler", "accept `%s`", r.Header.Get("Accept")))
+		return
+	}
+
+	w.Header().Add("Vary", "Accept")
+	options.SetFormat(conversions.FormatForContentType(contentType))
+
+	serveConverted(w, r, "InstanceToJPG", conversions.InstanceToJPG{
+		InstanceID: instance.ID,
+		Options:    options,
+	})
+}
+
+func metadataHandler(w http.ResponseWriter, r *http.Request) {
+	instance := currentInstance(r)
+
+	if _, ok := negotiate(r.Header.Get("Accept"), "application/dicom+json", "application/json"); !ok {
+		writeError(w, r, errs.Errorf(errs.NotAcceptable, "metadataHandler", "accept `%s`", r.Header.Get("Accept")))
+		return
+	}
+
+	serveConverted(w, r, "InstanceToMetadata", conversions.InstanceToMetadata{
+		InstanceID: instance.ID,
+	})
+}
+
+// renderedOptions parses the WADO-RS rendering params:
+// viewport=vw,vh[,sx,sy,sw,sh], which fits the optional source region into
+// the viewport, window=center,width[,linear], annotation and
+// quality=1..100. The cdn's geometry, wc, ww and preset params are
+// accepted too.
+func renderedOptions(r *http.Request, instance *models.Instance) (conversions.Options, error) {
+	op := "renderedOptions"
+	options := conversions.Options{}
+	query := r.URL.Query()
+
+	if viewport := query.Get("viewport"); viewport != "" {
+		parts := strings.Split(viewport, ",")
+		if len(parts) != 2 && len(parts) != 6 {
+			return options, errs.Errorf(errs.Invalid, op, "invalid viewport `%s`", viewport)
+		}
+
+		width, err1 := strconv.Atoi(parts[0])
+		height, err2 := strconv.Atoi(parts[1])
+		if err1 != nil || err2 != nil || width < 1 || height < 1 {
+			return options, errs.Errorf(errs.Invalid, op, "invalid viewport `%s`", viewport)
+		}
+
+		err := options.SetGeometry(width, height, "contain")
+		if err != nil {
+			return options, err
+		}
+
+		if len(parts) == 6 {
+			region, err := parseRegion(strings.Join(parts[2:], ","))
+			if err != nil {
+				return options, errs.Errorf(errs.Invalid, op, "invalid viewport `%s`", viewport)
+			}
+
+			err = options.SetCrop(region)
+			if err != nil {
+				return options, err
+			}
+		}
+	} else {
+		err := applyGeometry(query, &options)
+		if err != nil {
+			return options, err
+		}
+	}
+
+	if window := query.Get("window"); window != "" {
+		parts := strings.Split(window, ",")
+		if len(parts) < 2 || (len(parts) == 3 && strings.ToLower(parts[2]) != "linear") || len(parts) > 3 {
+			return options, errs.Errorf(errs.Invalid, op, "invalid window `%s`", window)
+		}
+
+		err := options.SetWindow(parts[0], parts[1])
+		if err != nil {
+			return options, errs.Errorf(errs.Invalid, op, "invalid window `%s`", window)
+		}
+	}
+
+	// any annotation, patient or technique, draws the account's overlay
+	options.Annotate = query.Get("annotation") != ""
+
+	quality, err := parseQuality(op, query.Get("quality"))
+	if err != nil {
+		return options, err
+	}
+	options.Quality = quality
+
+	err = applyWindow(&options, windowFromQuery(r), instance)
+	if err != nil {
+		return options, err
+	}
+
+	err = applyAccountSettings(&options, instance)
+	return options, err
+}
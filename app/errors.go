@@ -0,0 +1,97 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/nerdyworm/sess/errs"
+	"github.com/nerdyworm/sess/util"
+)
+
+var (
+	statusByKind = map[errs.Kind]int{
+		errs.NotFound:             http.StatusNotFound,
+		errs.InvalidID:            http.StatusBadRequest,
+		errs.Unavailable:          http.StatusBadGateway,
+		errs.ConversionFailed:     http.StatusBadGateway,
+		errs.Timeout:              http.StatusGatewayTimeout,
+		errs.Unauthorized:         http.StatusUnauthorized,
+		errs.Forbidden:            http.StatusForbidden,
+		errs.Invalid:              http.StatusBadRequest,
+		errs.NotAcceptable:        http.StatusNotAcceptable,
+		errs.UnsupportedMediaType: http.StatusUnsupportedMediaType,
+		errs.TooLarge:             http.StatusRequestEntityTooLarge,
+	}
+
+	messageByKind = map[errs.Kind]string{
+		errs.NotFound:             "not found",
+		errs.InvalidID:            "invalid id",
+		errs.Unavailable:          "upstream unavailable",
+		errs.ConversionFailed:     "conversion failed",
+		errs.Timeout:              "timed out waiting for conversion",
+		errs.Unauthorized:         "not signed in",
+		errs.Forbidden:            "forbidden",
+		errs.Invalid:              "invalid request",
+		errs.NotAcceptable:        "none of the accepted media types can be produced",
+		errs.UnsupportedMediaType: "unsupported media type",
+		errs.TooLarge:             "request too large",
+	}
+)
+
+type errorResponse struct {
+	Error errorBody `json:"error"`
+}
+
+type errorBody struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id"`
+}
+
+// writeError logs err and responds with the status and json body for its
+// kind. Unclassified errors are reported as a 500 without any detail.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	kind := errs.KindOf(err)
+	requestID := currentRequestID(r)
+
+	status, ok := statusByKind[kind]
+	if !ok {
+		status = http.StatusInternalServerError
+	}
+
+	message, ok := messageByKind[kind]
+	if !ok {
+		message = "internal error"
+	}
+
+	log.Printf("[Request:%s][ERROR] %d %v\n", requestID, status, err)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(errorResponse{errorBody{
+		Code:      kind.String(),
+		Message:   message,
+		RequestID: requestID,
+	}})
+}
+
+// requestID tags every request with an id, reusing the one set by a proxy
+// when present, so that error bodies can be matched up with the logs.
+func requestID(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	id := r.Header.Get("X-Request-Id")
+	if id == "" {
+		id = util.RandomString(20)
+	}
+
+	w.Header().Set("X-Request-Id", id)
+
+	ctx := context.WithValue(r.Context(), requestIDKey, id)
+	next(w, r.WithContext(ctx))
+}
+
+func currentRequestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey).(string)
+	return id
+}
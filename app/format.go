@@ -0,0 +1,43 @@
+package app
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/nerdyworm/sess/conversions"
+	"github.com/nerdyworm/sess/errs"
+)
+
+var imageContentTypes = []string{"image/jpeg", "image/png", "image/webp"}
+
+// applyFormat sets the image format from ?format=, or from the Accept
+// header when there is none. The cdn routes are named .jpg, so a request
+// that accepts none of the formats still gets a jpeg.
+func applyFormat(w http.ResponseWriter, r *http.Request, options *conversions.Options) error {
+	if format := r.URL.Query().Get("format"); format != "" {
+		return options.SetFormat(format)
+	}
+
+	w.Header().Add("Vary", "Accept")
+
+	contentType, ok := negotiate(r.Header.Get("Accept"), imageContentTypes...)
+	if !ok {
+		contentType = imageContentTypes[0]
+	}
+
+	return options.SetFormat(conversions.FormatForContentType(contentType))
+}
+
+// parseQuality reads an encoder quality of 1 to 100, 0 when it is not set.
+func parseQuality(op, quality string) (int, error) {
+	if quality == "" {
+		return 0, nil
+	}
+
+	q, err := strconv.Atoi(quality)
+	if err != nil || q < 1 || q > 100 {
+		return 0, errs.Errorf(errs.Invalid, op, "invalid quality `%s`", quality)
+	}
+
+	return q, nil
+}
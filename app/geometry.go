@@ -0,0 +1,97 @@
+package app
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/nerdyworm/sess/conversions"
+	"github.com/nerdyworm/sess/errs"
+)
+
+// applyGeometry reads ?width=, ?height=, ?fit= and ?crop=x,y,w,h. The
+// legacy ?size= square is left alone when none of them are given.
+func applyGeometry(query url.Values, options *conversions.Options) error {
+	op := "applyGeometry"
+
+	width, err := parseDimension(op, "width", query.Get("width"))
+	if err != nil {
+		return err
+	}
+
+	height, err := parseDimension(op, "height", query.Get("height"))
+	if err != nil {
+		return err
+	}
+
+	if width > 0 || height > 0 {
+		err = options.SetGeometry(width, height, query.Get("fit"))
+		if err != nil {
+			return err
+		}
+	}
+
+	if crop := query.Get("crop"); crop != "" {
+		region, err := parseRegion(crop)
+		if err != nil {
+			return errs.Errorf(errs.Invalid, op, "invalid crop `%s`", crop)
+		}
+
+		return options.SetCrop(region)
+	}
+
+	return nil
+}
+
+func parseDimension(op, name, value string) (int, error) {
+	if value == "" {
+		return 0, nil
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 {
+		return 0, errs.Errorf(errs.Invalid, op, "invalid %s `%s`", name, value)
+	}
+
+	return n, nil
+}
+
+// parseRegion reads x,y,width,height.
+func parseRegion(value string) (conversions.Region, error) {
+	parts := strings.Split(value, ",")
+	if len(parts) != 4 {
+		return conversions.Region{}, fmt.Errorf("expected x,y,width,height")
+	}
+
+	n := make([]int, 4)
+	for i, part := range parts {
+		v, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			return conversions.Region{}, err
+		}
+		n[i] = v
+	}
+
+	return conversions.Region{X: n[0], Y: n[1], Width: n[2], Height: n[3]}, nil
+}
+
+// geometryQuery is the inverse of applyGeometry, for urls handed back to
+// clients.
+func geometryQuery(query url.Values, options conversions.Options) {
+	if options.Width > 0 {
+		query.Set("width", strconv.Itoa(options.Width))
+	}
+
+	if options.Height > 0 {
+		query.Set("height", strconv.Itoa(options.Height))
+	}
+
+	if options.HasGeometry() {
+		query.Set("fit", options.Fit)
+	}
+
+	if c := options.Crop; !c.IsZero() {
+		query.Set("crop", fmt.Sprintf("%d,%d,%d,%d", c.X, c.Y, c.Width, c.Height))
+	}
+}
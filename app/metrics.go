@@ -0,0 +1,46 @@
+package app
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/codegangsta/negroni"
+	"github.com/gorilla/mux"
+	"github.com/nerdyworm/sess/metrics"
+)
+
+// instrument records the count and duration of every request, labeled by
+// the path template of the first of routers that matches it. Requests no
+// route matches share one label so ids in urls can not blow up the number
+// of series.
+func instrument(routers ...*mux.Router) negroni.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+		start := time.Now()
+		route := routeTemplate(r, routers)
+
+		next(w, r)
+
+		status := http.StatusOK
+		if rw, ok := w.(negroni.ResponseWriter); ok && rw.Status() != 0 {
+			status = rw.Status()
+		}
+
+		metrics.ObserveRequest(route, r.Method, status, time.Since(start))
+	}
+}
+
+func routeTemplate(r *http.Request, routers []*mux.Router) string {
+	for _, router := range routers {
+		var match mux.RouteMatch
+		if !router.Match(r, &match) || match.Route == nil {
+			continue
+		}
+
+		template, err := match.Route.GetPathTemplate()
+		if err == nil {
+			return template
+		}
+	}
+
+	return "unmatched"
+}
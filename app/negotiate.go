@@ -0,0 +1,80 @@
+package app
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type mediaRange struct {
+	mediaType string
+	q         float64
+}
+
+// negotiate picks the first of offers, in the client's order of
+// preference, that the Accept header allows. A missing header accepts the
+// first offer.
+func negotiate(accept string, offers ...string) (string, bool) {
+	if strings.TrimSpace(accept) == "" {
+		return offers[0], true
+	}
+
+	ranges := parseAccept(accept)
+	for _, mr := range ranges {
+		if mr.q <= 0 {
+			continue
+		}
+
+		for _, offer := range offers {
+			if mediaTypeMatches(mr.mediaType, offer) {
+				return offer, true
+			}
+		}
+	}
+
+	return "", false
+}
+
+func parseAccept(accept string) []mediaRange {
+	ranges := []mediaRange{}
+
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+
+		mr := mediaRange{
+			mediaType: strings.ToLower(strings.TrimSpace(params[0])),
+			q:         1,
+		}
+
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					mr.q = q
+				}
+			}
+		}
+
+		if mr.mediaType != "" {
+			ranges = append(ranges, mr)
+		}
+	}
+
+	sort.SliceStable(ranges, func(i, j int) bool {
+		return ranges[i].q > ranges[j].q
+	})
+
+	return ranges
+}
+
+func mediaTypeMatches(pattern, mediaType string) bool {
+	if pattern == "*/*" || pattern == mediaType {
+		return true
+	}
+
+	if strings.HasSuffix(pattern, "/*") {
+		return strings.HasPrefix(mediaType, strings.TrimSuffix(pattern, "*"))
+	}
+
+	return false
+}
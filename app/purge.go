@@ -0,0 +1,142 @@
+package app
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/nerdyworm/sess/errs"
+	"github.com/nerdyworm/sess/repos"
+	"github.com/nerdyworm/sess/storage"
+)
+
+var adminToken string
+
+// PurgeRequest names what to purge by the ids the cdn routes use. Any
+// combination may be given, a derivative has to match all of them.
+type PurgeRequest struct {
+	InstanceID string `json:"instance_id"`
+	StudyID    string `json:"study_id"`
+	AccountID  string `json:"account_id"`
+}
+
+type PurgeResult struct {
+	Deleted int `json:"deleted"`
+	Missing int `json:"missing"`
+}
+
+// Purge deletes every cached derivative indexed for the request and drops
+// them from the index. Keys that fail to delete stay indexed so that the
+// purge can be run again.
+func Purge(request PurgeRequest) (PurgeResult, error) {
+	op := "Purge"
+	result := PurgeResult{}
+
+	query := repos.DerivativeQuery{
+		InstanceID: request.InstanceID,
+		AccountID:  request.AccountID,
+	}
+
+	if request.StudyID != "" {
+		study, err := repos.Studies.FindByID(request.StudyID)
+		if err != nil {
+			return result, err
+		}
+
+		if query.AccountID != "" && query.AccountID != study.AccountID {
+			return result, errs.Errorf(errs.Invalid, op, "study `%s` is not in account `%s`", study.ID, query.AccountID)
+		}
+
+		query.AccountID = study.AccountID
+		query.StudyInstanceUID = study.StudyInstanceUID
+	}
+
+	if query.IsEmpty() {
+		return result, errs.Errorf(errs.Invalid, op, "an instance, study or account is required")
+	}
+
+	derivatives, err := repos.Derivatives.Find(query)
+	if err != nil {
+		return result, err
+	}
+
+	var purged []string
+	var firstErr error
+
+	for _, derivative := range derivatives {
+		err := storage.Cache.Delete(derivative.Key)
+		switch {
+		case err == nil:
+			result.Deleted++
+		case errs.Is(err, errs.NotFound):
+			result.Missing++
+		default:
+			log.Printf("[Purge][ERROR] %s %v\n", derivative.Key, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+
+		purged = append(purged, derivative.Key)
+	}
+
+	err = repos.Derivatives.Remove(purged)
+	if err != nil {
+		return result, err
+	}
+
+	return result, firstErr
+}
+
+func adminRoutes(r *mux.Router) {
+	r.HandleFunc("/cache/purge", purgeHandler).Methods("POST")
+	r.HandleFunc("/cache/stats", cacheStatsHandler).Methods("GET")
+}
+
+// cacheStatsHandler describes the disk cache, there is nothing to report
+// for an S3 cache.
+func cacheStatsHandler(w http.ResponseWriter, r *http.Request) {
+	stats, ok := storage.CacheStats()
+	if !ok {
+		writeError(w, r, errs.Errorf(errs.NotFound, "cacheStatsHandler", "the cache is not on disk"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// requireAdmin checks the bearer token of the admin api. The admin api is
+// closed while no token is configured.
+func requireAdmin(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+	if adminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+		writeError(w, r, errs.Errorf(errs.Unauthorized, "requireAdmin", "missing or invalid admin token"))
+		return
+	}
+
+	next(w, r)
+}
+
+func purgeHandler(w http.ResponseWriter, r *http.Request) {
+	request := PurgeRequest{}
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		writeError(w, r, errs.E(errs.Invalid, "purgeHandler", err))
+		return
+	}
+
+	result, err := Purge(request)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,232 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/nerdyworm/sess/dicom"
+	"github.com/nerdyworm/sess/errs"
+	"github.com/nerdyworm/sess/models"
+	"github.com/nerdyworm/sess/repos"
+)
+
+func qidoRoutes(r *mux.Router) {
+	r.HandleFunc("/studies", searchStudiesHandler).Methods("GET")
+	r.HandleFunc("/studies/{study_uid}/series", searchSeriesHandler).Methods("GET")
+	r.HandleFunc("/studies/{study_uid}/instances", searchInstancesHandler).Methods("GET")
+	r.HandleFunc("/studies/{study_uid}/series/{series_uid}/instances", searchInstancesHandler).Methods("GET")
+}
+
+func searchStudiesHandler(w http.ResponseWriter, r *http.Request) {
+	user, page, err := searchContext(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	query := repos.StudyQuery{
+		AccountIDs:       user.AccountIds,
+		StudyInstanceUID: qidoParam(r, "StudyInstanceUID", "0020000D"),
+		PatientID:        qidoParam(r, "PatientID", "00100020"),
+		PatientName:      qidoParam(r, "PatientName", "00100010"),
+		StudyDate:        qidoParam(r, "StudyDate", "00080020"),
+		Modality:         qidoParam(r, "ModalitiesInStudy", "00080061"),
+		AccessionNumber:  qidoParam(r, "AccessionNumber", "00080050"),
+		Page:             page,
+	}
+
+	studies, err := repos.Studies.Search(query)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	results := []map[string]dicom.JSONAttribute{}
+	matched := []disclosure{}
+	for _, study := range studies {
+		results = append(results, studyJSON(study))
+		matched = append(matched, disclosure{AccountID: study.AccountID, StudyInstanceUID: study.StudyInstanceUID, PatientID: study.PatientID})
+	}
+
+	writeDICOMJSON(w, results)
+	auditSearch(w, r, "SearchStudies", matched)
+}
+
+func searchSeriesHandler(w http.ResponseWriter, r *http.Request) {
+	user, page, err := searchContext(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	query := repos.SeriesQuery{
+		AccountIDs:        user.AccountIds,
+		StudyInstanceUID:  mux.Vars(r)["study_uid"],
+		SeriesInstanceUID: qidoParam(r, "SeriesInstanceUID", "0020000E"),
+		Modality:          qidoParam(r, "Modality", "00080060"),
+		Page:              page,
+	}
+
+	series, err := repos.Instances.SearchSeries(query)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	results := []map[string]dicom.JSONAttribute{}
+	matched := []disclosure{}
+	for _, s := range series {
+		results = append(results, seriesJSON(s))
+		matched = append(matched, disclosure{AccountID: s.AccountID, StudyInstanceUID: s.StudyInstanceUID})
+	}
+
+	writeDICOMJSON(w, results)
+	auditSearch(w, r, "SearchSeries", matched)
+}
+
+func searchInstancesHandler(w http.ResponseWriter, r *http.Request) {
+	user, page, err := searchContext(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	seriesUID := mux.Vars(r)["series_uid"]
+	if seriesUID == "" {
+		seriesUID = qidoParam(r, "SeriesInstanceUID", "0020000E")
+	}
+
+	query := repos.InstanceQuery{
+		AccountIDs:        user.AccountIds,
+		StudyInstanceUID:  mux.Vars(r)["study_uid"],
+		SeriesInstanceUID: seriesUID,
+		SOPInstanceUID:    qidoParam(r, "SOPInstanceUID", "00080018"),
+		Modality:          qidoParam(r, "Modality", "00080060"),
+		Page:              page,
+	}
+
+	instances, err := repos.Instances.Search(query)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	results := []map[string]dicom.JSONAttribute{}
+	matched := []disclosure{}
+	for _, instance := range instances {
+		results = append(results, instanceJSON(instance))
+		matched = append(matched, disclosure{AccountID: instance.AccountID, StudyInstanceUID: instance.StudyInstanceUID, PatientID: instance.PatientID})
+	}
+
+	writeDICOMJSON(w, results)
+	auditSearch(w, r, "SearchInstances", matched)
+}
+
+// searchContext returns the signed in user and the requested page. Searches
+// are scoped to the user's accounts so a signed url is not enough.
+func searchContext(r *http.Request) (*models.User, repos.Page, error) {
+	op := "searchContext"
+	page := repos.Page{}
+
+	user := currentUser(r)
+	if user == nil {
+		return nil, page, errs.Errorf(errs.Unauthorized, op, "search requires a session")
+	}
+
+	if _, ok := negotiate(r.Header.Get("Accept"), "application/dicom+json", "application/json"); !ok {
+		return nil, page, errs.Errorf(errs.NotAcceptable, op, "accept `%s`", r.Header.Get("Accept"))
+	}
+
+	var err error
+	if limit := r.URL.Query().Get("limit"); limit != "" {
+		page.Limit, err = strconv.Atoi(limit)
+		if err != nil || page.Limit < 0 {
+			return nil, page, errs.Errorf(errs.Invalid, op, "invalid limit `%s`", limit)
+		}
+	}
+
+	if offset := r.URL.Query().Get("offset"); offset != "" {
+		page.Offset, err = strconv.Atoi(offset)
+		if err != nil || page.Offset < 0 {
+			return nil, page, errs.Errorf(errs.Invalid, op, "invalid offset `%s`", offset)
+		}
+	}
+
+	return user, page, nil
+}
+
+// qidoParam reads a matching key given either by keyword or by tag.
+func qidoParam(r *http.Request, keyword, tag string) string {
+	query := r.URL.Query()
+	if value := query.Get(keyword); value != "" {
+		return value
+	}
+
+	return query.Get(tag)
+}
+
+func writeDICOMJSON(w http.ResponseWriter, results []map[string]dicom.JSONAttribute) {
+	w.Header().Set("Content-Type", "application/dicom+json")
+	json.NewEncoder(w).Encode(results)
+}
+
+func studyJSON(study *models.Study) map[string]dicom.JSONAttribute {
+	modalities := []interface{}{}
+	for _, modality := range study.ModalitiesInStudy {
+		modalities = append(modalities, modality)
+	}
+
+	return map[string]dicom.JSONAttribute{
+		"00080020": stringAttribute("DA", study.StudyDate),
+		"00080050": stringAttribute("SH", study.AccessionNumber),
+		"00080061": {VR: "CS", Value: modalities},
+		"00081030": stringAttribute("LO", study.StudyDescription),
+		"00081190": stringAttribute("UR", DICOMWEB_ROOT+"/studies/"+study.StudyInstanceUID),
+		"00100010": nameAttribute(study.PatientName),
+		"00100020": stringAttribute("LO", study.PatientID),
+		"0020000D": stringAttribute("UI", study.StudyInstanceUID),
+	}
+}
+
+func seriesJSON(series *models.Series) map[string]dicom.JSONAttribute {
+	return map[string]dicom.JSONAttribute{
+		"00080060": stringAttribute("CS", series.Modality),
+		"0008103E": stringAttribute("LO", series.SeriesDescription),
+		"00081190": stringAttribute("UR", DICOMWEB_ROOT+"/studies/"+series.StudyInstanceUID+"/series/"+series.SeriesInstanceUID),
+		"0020000D": stringAttribute("UI", series.StudyInstanceUID),
+		"0020000E": stringAttribute("UI", series.SeriesInstanceUID),
+		"00200011": {VR: "IS", Value: []interface{}{series.SeriesNumber}},
+		"00201209": {VR: "IS", Value: []interface{}{series.NumberOfInstances}},
+	}
+}
+
+func instanceJSON(instance *models.Instance) map[string]dicom.JSONAttribute {
+	return map[string]dicom.JSONAttribute{
+		"00080016": stringAttribute("UI", instance.SOPClassUID),
+		"00080018": stringAttribute("UI", instance.SOPInstanceUID),
+		"00080060": stringAttribute("CS", instance.Modality),
+		"00081190": stringAttribute("UR", DICOMWEB_ROOT+"/studies/"+instance.StudyInstanceUID+"/series/"+instance.SeriesInstanceUID+"/instances/"+instance.SOPInstanceUID),
+		"0020000D": stringAttribute("UI", instance.StudyInstanceUID),
+		"0020000E": stringAttribute("UI", instance.SeriesInstanceUID),
+		"00200011": {VR: "IS", Value: []interface{}{instance.SeriesNumber}},
+		"00200013": {VR: "IS", Value: []interface{}{instance.InstanceNumber}},
+	}
+}
+
+func stringAttribute(vr, value string) dicom.JSONAttribute {
+	if value == "" {
+		return dicom.JSONAttribute{VR: vr}
+	}
+
+	return dicom.JSONAttribute{VR: vr, Value: []interface{}{value}}
+}
+
+func nameAttribute(name string) dicom.JSONAttribute {
+	if name == "" {
+		return dicom.JSONAttribute{VR: "PN"}
+	}
+
+	return dicom.JSONAttribute{VR: "PN", Value: []interface{}{dicom.PersonName{Alphabetic: name}}}
+}
@@ -0,0 +1,321 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/nerdyworm/sess/audit"
+	"github.com/nerdyworm/sess/config"
+	"github.com/nerdyworm/sess/models"
+	"github.com/nerdyworm/sess/repos"
+	"github.com/nerdyworm/sess/signing"
+)
+
+// fakeStudies scopes searches to the query's accounts the way the mongo
+// repo does, an empty list matches nothing.
+type fakeStudies struct {
+	repos.StudiesRepo
+	studies []*models.Study
+	queries *[]repos.StudyQuery
+}
+
+func (f fakeStudies) Search(query repos.StudyQuery) ([]*models.Study, error) {
+	*f.queries = append(*f.queries, query)
+
+	found := []*models.Study{}
+	for _, study := range f.studies {
+		for _, id := range query.AccountIDs {
+			if study.AccountID == id && (query.PatientID == "" || study.PatientID == query.PatientID) &&
+				(query.StudyInstanceUID == "" || study.StudyInstanceUID == query.StudyInstanceUID) {
+				found = append(found, study)
+			}
+		}
+	}
+
+	return found, nil
+}
+
+// searchInstances records the scope of series and instance searches and
+// answers them from found.
+type searchInstances struct {
+	fakeInstances
+	found     []*models.Instance
+	series    *[]repos.SeriesQuery
+	instances *[]repos.InstanceQuery
+}
+
+func (f searchInstances) SearchSeries(query repos.SeriesQuery) ([]*models.Series, error) {
+	*f.series = append(*f.series, query)
+
+	series := []*models.Series{}
+	for _, instance := range f.match(query.AccountIDs, query.StudyInstanceUID) {
+		series = append(series, &models.Series{AccountID: instance.AccountID, StudyInstanceUID: instance.StudyInstanceUID, SeriesInstanceUID: instance.SeriesInstanceUID})
+	}
+
+	return series, nil
+}
+
+func (f searchInstances) Search(query repos.InstanceQuery) ([]*models.Instance, error) {
+	*f.instances = append(*f.instances, query)
+	return f.match(query.AccountIDs, query.StudyInstanceUID), nil
+}
+
+func (f searchInstances) match(accountIDs []string, studyUID string) []*models.Instance {
+	found := []*models.Instance{}
+	for _, instance := range f.found {
+		for _, id := range accountIDs {
+			if instance.AccountID == id && instance.StudyInstanceUID == studyUID {
+				found = append(found, instance)
+			}
+		}
+	}
+
+	return found
+}
+
+// setupDICOMweb points the repos at fakes holding account a's study and
+// account b's study, and returns the protected DICOMweb router.
+func setupDICOMweb(t *testing.T) (http.Handler, *[]repos.StudyQuery, *[]repos.SeriesQuery, *[]repos.InstanceQuery) {
+	users, studies, instances, signer := repos.Users, repos.Studies, repos.Instances, signing.Default
+	t.Cleanup(func() {
+		repos.Users, repos.Studies, repos.Instances, signing.Default = users, studies, instances, signer
+	})
+
+	setupSessions(config.Sessions{CookieName: "_test_session", HashKey: "0123456789abcdef0123456789abcdef"})
+	signing.Default = signing.New(signing.Key{ID: "k", Secret: []byte("secret")})
+
+	repos.Users = fakeUsers{
+		"a":    {ID: "a", AccountIds: []string{"a"}},
+		"both": {ID: "both", AccountIds: []string{"a", "b"}},
+		"none": {ID: "none", AccountIds: []string{}},
+	}
+
+	studyQueries := &[]repos.StudyQuery{}
+	repos.Studies = fakeStudies{
+		studies: []*models.Study{
+			{AccountID: "a", StudyInstanceUID: "1.1", PatientID: "P1"},
+			{AccountID: "b", StudyInstanceUID: "2.1", PatientID: "P1"},
+		},
+		queries: studyQueries,
+	}
+
+	seriesQueries := &[]repos.SeriesQuery{}
+	instanceQueries := &[]repos.InstanceQuery{}
+	repos.Instances = searchInstances{
+		found: []*models.Instance{
+			{ID: "i1", AccountID: "a", StudyInstanceUID: "1.1", SeriesInstanceUID: "1.1.1", PatientID: "P1"},
+			{ID: "i2", AccountID: "a", StudyInstanceUID: "1.1", SeriesInstanceUID: "1.1.2", PatientID: "P1"},
+		},
+		series:    seriesQueries,
+		instances: instanceQueries,
+	}
+
+	router := mux.NewRouter().PathPrefix(DICOMWEB_ROOT).Subrouter()
+	qidoRoutes(router)
+	stowRoutes(router)
+
+	return protect(router), studyQueries, seriesQueries, instanceQueries
+}
+
+func withSession(t *testing.T, r *http.Request, userID string) *http.Request {
+	if userID == "" {
+		return r
+	}
+
+	value, err := sessionCodec.Encode(SessionCookieName, map[string]interface{}{"user_id": userID})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r.AddCookie(&http.Cookie{Name: SessionCookieName, Value: value})
+	return r
+}
+
+func TestSearchStudiesScope(t *testing.T) {
+	handler, queries, _, _ := setupDICOMweb(t)
+
+	signed, err := signing.Default.Sign(DICOMWEB_ROOT+"/studies?PatientID=P1", time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		url      string
+		user     string
+		status   int
+		accounts []string
+		studies  []string
+	}{
+		{name: "own account", url: DICOMWEB_ROOT + "/studies?PatientID=P1", user: "a", status: http.StatusOK, accounts: []string{"a"}, studies: []string{"1.1"}},
+		{name: "every account of the user", url: DICOMWEB_ROOT + "/studies?00100020=P1", user: "both", status: http.StatusOK, accounts: []string{"a", "b"}, studies: []string{"1.1", "2.1"}},
+		{name: "no accounts", url: DICOMWEB_ROOT + "/studies", user: "none", status: http.StatusOK, accounts: []string{}, studies: []string{}},
+		{name: "account_id is not a scope", url: DICOMWEB_ROOT + "/studies?account_id=b", user: "a", status: http.StatusOK, accounts: []string{"a"}, studies: []string{"1.1"}},
+		{name: "no session", url: DICOMWEB_ROOT + "/studies", status: http.StatusUnauthorized},
+		{name: "signed url", url: signed, status: http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			*queries = nil
+
+			r := withSession(t, httptest.NewRequest("GET", test.url, nil), test.user)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != test.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, test.status, w.Body)
+			}
+
+			if test.status != http.StatusOK {
+				if len(*queries) != 0 {
+					t.Errorf("searched %+v without a session", *queries)
+				}
+				return
+			}
+
+			if len(*queries) != 1 {
+				t.Fatalf("%d searches, want 1", len(*queries))
+			}
+
+			if got := strings.Join((*queries)[0].AccountIDs, ","); got != strings.Join(test.accounts, ",") {
+				t.Errorf("searched accounts %q, want %q", got, strings.Join(test.accounts, ","))
+			}
+
+			results := []map[string]struct{ Value []interface{} }{}
+			if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil {
+				t.Fatal(err)
+			}
+
+			uids := []string{}
+			for _, result := range results {
+				for _, uid := range result["0020000D"].Value {
+					uids = append(uids, uid.(string))
+				}
+			}
+
+			if strings.Join(uids, ",") != strings.Join(test.studies, ",") {
+				t.Errorf("studies %v, want %v", uids, test.studies)
+			}
+		})
+	}
+}
+
+func TestSearchSeriesAndInstancesScope(t *testing.T) {
+	handler, _, series, instances := setupDICOMweb(t)
+
+	tests := []struct {
+		name      string
+		url       string
+		user      string
+		status    int
+		accounts  string
+		seriesUID string
+	}{
+		{name: "series", url: DICOMWEB_ROOT + "/studies/1.1/series", user: "a", status: http.StatusOK, accounts: "a"},
+		{name: "instances of a study", url: DICOMWEB_ROOT + "/studies/1.1/instances?SeriesInstanceUID=1.1.1", user: "both", status: http.StatusOK, accounts: "a,b", seriesUID: "1.1.1"},
+		{name: "instances of a series", url: DICOMWEB_ROOT + "/studies/1.1/series/1.1.2/instances", user: "a", status: http.StatusOK, accounts: "a", seriesUID: "1.1.2"},
+		{name: "series without a session", url: DICOMWEB_ROOT + "/studies/1.1/series", status: http.StatusUnauthorized},
+		{name: "instances without a session", url: DICOMWEB_ROOT + "/studies/1.1/instances", status: http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			*series, *instances = nil, nil
+
+			r := withSession(t, httptest.NewRequest("GET", test.url, nil), test.user)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != test.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, test.status, w.Body)
+			}
+
+			scopes := []string{}
+			for _, query := range *series {
+				scopes = append(scopes, strings.Join(query.AccountIDs, ","))
+				if query.StudyInstanceUID != "1.1" {
+					t.Errorf("series searched in study %q", query.StudyInstanceUID)
+				}
+			}
+
+			for _, query := range *instances {
+				scopes = append(scopes, strings.Join(query.AccountIDs, ","))
+				if query.StudyInstanceUID != "1.1" || query.SeriesInstanceUID != test.seriesUID {
+					t.Errorf("instances searched in %q/%q", query.StudyInstanceUID, query.SeriesInstanceUID)
+				}
+			}
+
+			if test.status != http.StatusOK {
+				if len(scopes) != 0 {
+					t.Errorf("searched %v without a session", scopes)
+				}
+				return
+			}
+
+			if len(scopes) != 1 || scopes[0] != test.accounts {
+				t.Errorf("searched accounts %v, want [%s]", scopes, test.accounts)
+			}
+		})
+	}
+}
+
+type recordingSink struct {
+	events *[]*models.AuditEvent
+}
+
+func (s recordingSink) Write(event *models.AuditEvent) error {
+	*s.events = append(*s.events, event)
+	return nil
+}
+
+func (s recordingSink) Close() error { return nil }
+
+func TestSearchAudit(t *testing.T) {
+	handler, _, _, _ := setupDICOMweb(t)
+
+	defer func(sink audit.Sink) { audit.Default = sink }(audit.Default)
+	events := &[]*models.AuditEvent{}
+	audit.Default = recordingSink{events}
+
+	tests := []struct {
+		name       string
+		url        string
+		user       string
+		derivative string
+		studies    []string
+	}{
+		{name: "studies", url: DICOMWEB_ROOT + "/studies?PatientID=P1", user: "both", derivative: "SearchStudies", studies: []string{"a/1.1/P1", "b/2.1/P1"}},
+		{name: "series", url: DICOMWEB_ROOT + "/studies/1.1/series", user: "a", derivative: "SearchSeries", studies: []string{"a/1.1/"}},
+		{name: "instances once per study", url: DICOMWEB_ROOT + "/studies/1.1/instances", user: "a", derivative: "SearchInstances", studies: []string{"a/1.1/P1"}},
+		{name: "nothing matched", url: DICOMWEB_ROOT + "/studies/2.1/instances", user: "a"},
+		{name: "no session", url: DICOMWEB_ROOT + "/studies"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			*events = nil
+
+			r := withSession(t, httptest.NewRequest("GET", test.url, nil), test.user)
+			handler.ServeHTTP(httptest.NewRecorder(), r)
+
+			studies := []string{}
+			for _, event := range *events {
+				studies = append(studies, event.AccountID+"/"+event.StudyInstanceUID+"/"+event.PatientID)
+
+				if event.Derivative != test.derivative || event.UserID != test.user || event.InstanceID != "" || event.Outcome != models.AuditServed {
+					t.Errorf("event %+v", event)
+				}
+			}
+
+			if strings.Join(studies, ",") != strings.Join(test.studies, ",") {
+				t.Errorf("audited %v, want %v", studies, test.studies)
+			}
+		})
+	}
+}
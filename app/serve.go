@@ -0,0 +1,105 @@
+package app
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/nerdyworm/sess/storage"
+)
+
+// A key names one rendering for good: the account's logo, annotation
+// templates and window and the de-identification profile are all part of
+// it, so derivatives can be cached forever. They are still patient data, so
+// shared caches must not keep them.
+const derivativeCacheControl = "private, max-age=31536000, immutable"
+
+// headerHook adds headers to a response that serves a derivative, such as
+// how to save it. Error responses get none of them.
+type headerHook func(http.Header)
+
+// etagFor is the checksum of the content, or its size and modtime for
+// objects whose store does not know their checksum.
+func etagFor(info storage.Info) string {
+	if info.Checksum != "" {
+		return `"` + info.Checksum + `"`
+	}
+
+	return fmt.Sprintf(`"%x-%x"`, info.Size, info.ModTime.UnixNano())
+}
+
+// notModified answers a conditional GET whose If-None-Match has etag.
+func notModified(w http.ResponseWriter, r *http.Request, etag string) bool {
+	match := r.Header.Get("If-None-Match")
+	if match == "" {
+		return false
+	}
+
+	for _, candidate := range strings.Split(match, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+
+	return false
+}
+
+// serveDerivative writes a cached derivative with validators and caching
+// headers. A conditional request is checked against the key's Stat, which
+// the cache usually answers without asking the store; everything else is
+// described by the same request that reads it. Seekable readers go
+// through http.ServeContent so that range requests are handled for us,
+// the others are streamed with the length and modtime from the store.
+// Errors are returned before anything is written, hooks are run only once
+// the derivative is being served.
+func serveDerivative(w http.ResponseWriter, r *http.Request, key, contentType string, hooks ...headerHook) error {
+	if r.Header.Get("If-None-Match") != "" {
+		info, err := storage.Cache.Stat(key)
+		if err != nil {
+			return err
+		}
+
+		setValidators(w, info)
+		if notModified(w, r, etagFor(info)) {
+			return nil
+		}
+	}
+
+	reader, info, err := storage.Open(storage.Cache, key)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	setValidators(w, info)
+	w.Header().Set("Content-Type", contentType)
+	for _, hook := range hooks {
+		hook(w.Header())
+	}
+
+	if seeker, ok := reader.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, path.Base(key), info.ModTime, seeker)
+		return nil
+	}
+
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+	if !info.ModTime.IsZero() {
+		w.Header().Set("Last-Modified", info.ModTime.UTC().Format(http.TimeFormat))
+	}
+
+	if r.Method != "HEAD" {
+		io.Copy(w, reader)
+	}
+
+	return nil
+}
+
+func setValidators(w http.ResponseWriter, info storage.Info) {
+	w.Header().Set("ETag", etagFor(info))
+	w.Header().Set("Cache-Control", derivativeCacheControl)
+}
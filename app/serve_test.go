@@ -0,0 +1,110 @@
+package app
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/nerdyworm/sess/storage"
+)
+
+func TestServeDerivative(t *testing.T) {
+	defer func(cache storage.Storage) { storage.Cache = cache }(storage.Cache)
+
+	store := storage.NewMemoryStore(1<<20, 1<<20, 0)
+	storage.Cache = store
+	store.Put("convertions/a.jpg", strings.NewReader("jpeg bytes"))
+
+	info, _ := store.Stat("convertions/a.jpg")
+	etag := etagFor(info)
+
+	tests := []struct {
+		name        string
+		key         string
+		method      string
+		ifNoneMatch string
+		rangeHeader string
+		status      int
+		body        string
+	}{
+		{name: "get", key: "convertions/a.jpg", method: "GET", status: http.StatusOK, body: "jpeg bytes"},
+		{name: "head", key: "convertions/a.jpg", method: "HEAD", status: http.StatusOK},
+		{name: "not modified", key: "convertions/a.jpg", method: "GET", ifNoneMatch: etag, status: http.StatusNotModified},
+		{name: "weak match", key: "convertions/a.jpg", method: "GET", ifNoneMatch: `"other", W/` + etag, status: http.StatusNotModified},
+		{name: "changed", key: "convertions/a.jpg", method: "GET", ifNoneMatch: `"other"`, status: http.StatusOK, body: "jpeg bytes"},
+		{name: "range", key: "convertions/a.jpg", method: "GET", rangeHeader: "bytes=0-3", status: http.StatusPartialContent, body: "jpeg"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(test.method, "/", nil)
+			if test.ifNoneMatch != "" {
+				r.Header.Set("If-None-Match", test.ifNoneMatch)
+			}
+			if test.rangeHeader != "" {
+				r.Header.Set("Range", test.rangeHeader)
+			}
+
+			w := httptest.NewRecorder()
+			err := serveDerivative(w, r, test.key, "image/jpeg", attachment)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if w.Code != test.status {
+				t.Errorf("status = %d, want %d", w.Code, test.status)
+			}
+
+			if got := w.Header().Get("ETag"); got != etag {
+				t.Errorf("ETag = %s, want %s", got, etag)
+			}
+
+			if got := w.Header().Get("Cache-Control"); got != "private, max-age=31536000, immutable" {
+				t.Errorf("Cache-Control = %s", got)
+			}
+
+			if got := w.Body.String(); got != test.body {
+				t.Errorf("body = %q, want %q", got, test.body)
+			}
+
+			disposition := ""
+			if test.status != http.StatusNotModified {
+				disposition = "attachment"
+			}
+
+			if got := w.Header().Get("Content-Disposition"); got != disposition {
+				t.Errorf("Content-Disposition = %q, want %q", got, disposition)
+			}
+		})
+	}
+}
+
+func TestServeDerivativeMissing(t *testing.T) {
+	defer func(cache storage.Storage) { storage.Cache = cache }(storage.Cache)
+	storage.Cache = storage.NewMemoryStore(1<<20, 1<<20, 0)
+
+	for _, ifNoneMatch := range []string{"", `"abc"`} {
+		r := httptest.NewRequest("GET", "/", nil)
+		if ifNoneMatch != "" {
+			r.Header.Set("If-None-Match", ifNoneMatch)
+		}
+
+		w := httptest.NewRecorder()
+		if err := serveDerivative(w, r, "convertions/missing.jpg", "image/jpeg", attachment); err == nil {
+			t.Errorf("no error for a missing key with If-None-Match %q", ifNoneMatch)
+		}
+
+		if w.Code != http.StatusOK || w.Body.Len() != 0 {
+			t.Errorf("wrote %d %q before the error", w.Code, w.Body)
+		}
+
+		if got := w.Header().Get("Content-Disposition"); got != "" {
+			t.Errorf("Content-Disposition %q set for a missing key", got)
+		}
+	}
+}
+
+func attachment(header http.Header) {
+	header.Set("Content-Disposition", "attachment")
+}
@@ -0,0 +1,363 @@
+package app
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/nerdyworm/sess/dicom"
+	"github.com/nerdyworm/sess/errs"
+	"github.com/nerdyworm/sess/models"
+	"github.com/nerdyworm/sess/repos"
+	"github.com/nerdyworm/sess/storage"
+	"github.com/nerdyworm/sess/util"
+)
+
+// Failure reasons from PS3.4 Annex GG.
+const (
+	failureProcessing        = 0x0110
+	failureNotAuthorized     = 0x0124
+	failureOutOfResources    = 0xA700
+	failureStudyMismatch     = 0xA900
+	failureCannotUnderstand  = 0xC000
+	failureUnsupportedSyntax = 0xC122
+)
+
+type stowResult struct {
+	SOPClassUID    string
+	SOPInstanceUID string
+	RetrieveURL    string
+	FailureReason  int
+}
+
+func stowRoutes(r *mux.Router) {
+	r.HandleFunc("/studies", storeInstancesHandler).Methods("POST")
+	r.HandleFunc("/studies/{study_uid}", storeInstancesHandler).Methods("POST")
+}
+
+// storeInstancesHandler implements STOW-RS. Every application/dicom part
+// of the multipart/related body is stored in primary storage and recorded
+// in the study and instance collections of the target account.
+func storeInstancesHandler(w http.ResponseWriter, r *http.Request) {
+	op := "storeInstancesHandler"
+
+	accountID, err := stowAccount(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/related" || params["boundary"] == "" {
+		writeError(w, r, errs.Errorf(errs.UnsupportedMediaType, op, "content type `%s`", r.Header.Get("Content-Type")))
+		return
+	}
+
+	if t := params["type"]; t != "" && t != "application/dicom" {
+		writeError(w, r, errs.Errorf(errs.UnsupportedMediaType, op, "part type `%s`", t))
+		return
+	}
+
+	if r.ContentLength > maxUploadBytes {
+		writeError(w, r, errs.Errorf(errs.TooLarge, op, "body of %d bytes is over %d", r.ContentLength, maxUploadBytes))
+		return
+	}
+
+	body := &uploadBody{ReadCloser: http.MaxBytesReader(w, r.Body, maxUploadBytes), limit: maxUploadBytes}
+	r.Body = body
+
+	studyUID := mux.Vars(r)["study_uid"]
+	results := []stowResult{}
+
+	reader := multipart.NewReader(body, params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF || (err != nil && body.exceeded()) {
+			break
+		}
+
+		if err != nil {
+			writeError(w, r, errs.E(errs.Invalid, op, err))
+			return
+		}
+
+		results = append(results, storePart(accountID, studyUID, part))
+		part.Close()
+
+		// the part cut off by the limit failed, those before it stand
+		if body.exceeded() {
+			break
+		}
+	}
+
+	if len(results) == 0 && body.exceeded() {
+		writeError(w, r, errs.Errorf(errs.TooLarge, op, "body is over %d bytes", maxUploadBytes))
+		return
+	}
+
+	if len(results) == 0 {
+		writeError(w, r, errs.Errorf(errs.Invalid, op, "no instances in request"))
+		return
+	}
+
+	writeStowResponse(w, studyUID, results)
+}
+
+// maxUploadBytes bounds a STOW-RS request body, every part of it is
+// spooled to scratch.
+var maxUploadBytes int64 = 1024 << 20
+
+// uploadBody counts what is read through http.MaxBytesReader, whose error
+// can not be told apart from the connection's, to know when the limit cut
+// the body off.
+type uploadBody struct {
+	io.ReadCloser
+	limit int64
+	read  int64
+	err   error
+}
+
+func (b *uploadBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	if err != nil && err != io.EOF {
+		b.err = err
+	}
+
+	return n, err
+}
+
+func (b *uploadBody) exceeded() bool {
+	return b.err != nil && b.read >= b.limit
+}
+
+// stowAccount picks the account uploads are stored in. Users with more
+// than one account have to name it with ?account_id=.
+func stowAccount(r *http.Request) (string, error) {
+	op := "stowAccount"
+
+	user := currentUser(r)
+	if user == nil {
+		return "", errs.Errorf(errs.Unauthorized, op, "store requires a session")
+	}
+
+	accountID := r.URL.Query().Get("account_id")
+	if accountID == "" {
+		if len(user.AccountIds) != 1 {
+			return "", errs.Errorf(errs.Invalid, op, "account_id is required")
+		}
+
+		return user.AccountIds[0], nil
+	}
+
+	if !models.IsUserInAccount(user, accountID) {
+		return "", errs.Errorf(errs.Forbidden, op, "account `%s` is not one of the user's accounts", accountID)
+	}
+
+	return accountID, nil
+}
+
+func storePart(accountID, studyUID string, part *multipart.Part) stowResult {
+	result := stowResult{}
+
+	if t := part.Header.Get("Content-Type"); t != "" && t != "application/dicom" {
+		result.FailureReason = failureUnsupportedSyntax
+		return result
+	}
+
+	key := "stow/" + util.RandomString(32)
+
+	err := storage.Scratch.Put(key, part)
+	if err != nil {
+		log.Printf("[STOW][ERROR] %v\n", err)
+		result.FailureReason = failureOutOfResources
+		return result
+	}
+	defer storage.Scratch.Delete(key)
+
+	dcm, err := dicom.New(storage.Scratch.GetPath(key))
+	if err != nil {
+		log.Printf("[STOW][ERROR] parsing part %v\n", err)
+		result.FailureReason = failureCannotUnderstand
+		return result
+	}
+	defer dcm.Clean()
+
+	// the UIDs key the original and the paths workers extract it to
+	for _, uid := range []string{dcm.StudyInstanceUID, dcm.SeriesInstanceUID, dcm.SOPInstanceUID} {
+		if !dicom.ValidUID(uid) {
+			log.Printf("[STOW][ERROR] invalid uid `%s`\n", uid)
+			result.FailureReason = failureCannotUnderstand
+			return result
+		}
+	}
+
+	result.SOPClassUID = dcm.Get("SOPClassUID").Value
+	result.SOPInstanceUID = dcm.SOPInstanceUID
+
+	if studyUID != "" && dcm.StudyInstanceUID != studyUID {
+		result.FailureReason = failureStudyMismatch
+		return result
+	}
+
+	instance := instanceFromDicom(accountID, dcm)
+
+	// originals are keyed by SOPInstanceUID alone, a UID another account
+	// holds must not overwrite its original
+	owners, err := repos.Instances.OwnersOf(instance.SOPInstanceUID)
+	if err != nil {
+		log.Printf("[STOW:%s][ERROR] %v\n", instance.SOPInstanceUID, err)
+		result.FailureReason = failureProcessing
+		return result
+	}
+
+	existed := false
+	for _, owner := range owners {
+		if owner != accountID {
+			log.Printf("[STOW:%s][ERROR] held by account `%s`\n", instance.SOPInstanceUID, owner)
+			result.FailureReason = failureNotAuthorized
+			return result
+		}
+
+		existed = true
+	}
+
+	file, err := storage.Scratch.Get(key)
+	if err != nil {
+		log.Printf("[STOW:%s][ERROR] %v\n", instance.SOPInstanceUID, err)
+		result.FailureReason = failureProcessing
+		return result
+	}
+	defer file.Close()
+
+	err = storage.Primary.PutWithOptions(instance.Key(), file, storage.PutOptions{
+		ContentType: "application/dicom",
+	})
+	if err != nil {
+		log.Printf("[STOW:%s][ERROR] %v\n", instance.SOPInstanceUID, err)
+		result.FailureReason = failureOutOfResources
+		return result
+	}
+
+	err = repos.Studies.Upsert(studyFromDicom(accountID, dcm))
+	if err == nil {
+		err = repos.Instances.Upsert(instance)
+	}
+
+	if err != nil {
+		log.Printf("[STOW:%s][ERROR] %v\n", instance.SOPInstanceUID, err)
+
+		// a new original nothing refers to would be orphaned, one that was
+		// replaced is still referred to by its instance
+		if !existed {
+			storage.Primary.Delete(instance.Key())
+		}
+
+		result.FailureReason = failureProcessing
+		return result
+	}
+
+	// a replaced original must not be served from derivatives of the old
+	// one, their keys name one rendering for good
+	if existed {
+		_, err = Purge(PurgeRequest{InstanceID: instance.ID})
+		if err != nil {
+			log.Printf("[STOW:%s][ERROR] purging derivatives %v\n", instance.SOPInstanceUID, err)
+		}
+	}
+
+	result.RetrieveURL = DICOMWEB_ROOT + "/studies/" + instance.StudyInstanceUID +
+		"/series/" + instance.SeriesInstanceUID +
+		"/instances/" + instance.SOPInstanceUID
+
+	return result
+}
+
+func studyFromDicom(accountID string, dcm dicom.Dicom) *models.Study {
+	study := &models.Study{
+		AccountID:        accountID,
+		StudyInstanceUID: dcm.StudyInstanceUID,
+		PatientID:        dcm.PatientID,
+		PatientName:      dcm.PatientName,
+		StudyDate:        dcm.Get("StudyDate").Value,
+		AccessionNumber:  dcm.Get("AccessionNumber").Value,
+		StudyDescription: dcm.Get("StudyDescription").Value,
+	}
+
+	if dcm.Modality != "" {
+		study.ModalitiesInStudy = []string{dcm.Modality}
+	}
+
+	return study
+}
+
+func instanceFromDicom(accountID string, dcm dicom.Dicom) *models.Instance {
+	seriesNumber, _ := strconv.Atoi(dcm.Get("SeriesNumber").Value)
+	instanceNumber, _ := strconv.Atoi(dcm.Get("InstanceNumber").Value)
+
+	return &models.Instance{
+		AccountID:         accountID,
+		StudyInstanceUID:  dcm.StudyInstanceUID,
+		SeriesInstanceUID: dcm.SeriesInstanceUID,
+		SOPInstanceUID:    dcm.SOPInstanceUID,
+		SOPClassUID:       dcm.Get("SOPClassUID").Value,
+		Modality:          dcm.Modality,
+		SeriesNumber:      seriesNumber,
+		SeriesDescription: dcm.Get("SeriesDescription").Value,
+		InstanceNumber:    instanceNumber,
+		PatientID:         dcm.PatientID,
+	}
+}
+
+// writeStowResponse writes the PS3.18 store instances response. The status
+// is 200 when everything was stored, 202 when some instances failed and
+// 409 when all of them did.
+func writeStowResponse(w http.ResponseWriter, studyUID string, results []stowResult) {
+	referenced := []interface{}{}
+	failed := []interface{}{}
+
+	for _, result := range results {
+		item := map[string]dicom.JSONAttribute{
+			"00081150": stringAttribute("UI", result.SOPClassUID),
+			"00081155": stringAttribute("UI", result.SOPInstanceUID),
+		}
+
+		if result.FailureReason != 0 {
+			item["00081197"] = dicom.JSONAttribute{VR: "US", Value: []interface{}{result.FailureReason}}
+			failed = append(failed, item)
+		} else {
+			item["00081190"] = stringAttribute("UR", result.RetrieveURL)
+			referenced = append(referenced, item)
+		}
+	}
+
+	response := map[string]dicom.JSONAttribute{}
+
+	if studyUID != "" {
+		response["00081190"] = stringAttribute("UR", DICOMWEB_ROOT+"/studies/"+studyUID)
+	}
+
+	if len(failed) > 0 {
+		response["00081198"] = dicom.JSONAttribute{VR: "SQ", Value: failed}
+	}
+
+	if len(referenced) > 0 {
+		response["00081199"] = dicom.JSONAttribute{VR: "SQ", Value: referenced}
+	}
+
+	status := http.StatusOK
+	if len(failed) == len(results) {
+		status = http.StatusConflict
+	} else if len(failed) > 0 {
+		status = http.StatusAccepted
+	}
+
+	w.Header().Set("Content-Type", "application/dicom+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,117 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/nerdyworm/sess/storage"
+)
+
+// stowBody is a multipart/related body of one application/dicom part.
+func stowBody(part string) (string, string) {
+	boundary := "stowboundary"
+	body := "--" + boundary + "\r\n" +
+		"Content-Type: application/dicom\r\n\r\n" +
+		part + "\r\n" +
+		"--" + boundary + "--\r\n"
+
+	return body, `multipart/related; type="application/dicom"; boundary=` + boundary
+}
+
+func TestStoreInstancesScope(t *testing.T) {
+	handler, _, _, _ := setupDICOMweb(t)
+
+	body, contentType := stowBody("not dicom")
+
+	tests := []struct {
+		name   string
+		url    string
+		user   string
+		status int
+	}{
+		{name: "no session", url: DICOMWEB_ROOT + "/studies", status: http.StatusUnauthorized},
+		{name: "other account", url: DICOMWEB_ROOT + "/studies?account_id=b", user: "a", status: http.StatusForbidden},
+		{name: "no accounts", url: DICOMWEB_ROOT + "/studies?account_id=a", user: "none", status: http.StatusForbidden},
+		{name: "account required", url: DICOMWEB_ROOT + "/studies", user: "both", status: http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := withSession(t, httptest.NewRequest("POST", test.url, strings.NewReader(body)), test.user)
+			r.Header.Set("Content-Type", contentType)
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != test.status {
+				t.Errorf("status = %d, want %d: %s", w.Code, test.status, w.Body)
+			}
+		})
+	}
+}
+
+func TestStoreInstancesLimit(t *testing.T) {
+	handler, _, _, _ := setupDICOMweb(t)
+
+	defer func(scratch storage.FileStore, limit int64) {
+		storage.Scratch, maxUploadBytes = scratch, limit
+	}(storage.Scratch, maxUploadBytes)
+	storage.Scratch = storage.NewFileStore(t.TempDir())
+
+	body, contentType := stowBody(strings.Repeat("x", 1000))
+
+	tests := []struct {
+		name    string
+		limit   int64
+		chunked bool
+		status  int
+		failure float64
+	}{
+		{name: "content length over the limit", limit: 200, status: http.StatusRequestEntityTooLarge},
+		{name: "cut off in the headers", limit: 10, chunked: true, status: http.StatusRequestEntityTooLarge},
+		{name: "cut off in a part", limit: 200, chunked: true, status: http.StatusConflict, failure: failureOutOfResources},
+		{name: "under the limit", limit: 4096, chunked: true, status: http.StatusConflict, failure: failureCannotUnderstand},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			maxUploadBytes = test.limit
+
+			r := withSession(t, httptest.NewRequest("POST", DICOMWEB_ROOT+"/studies", strings.NewReader(body)), "a")
+			r.Header.Set("Content-Type", contentType)
+			if test.chunked {
+				r.ContentLength = -1
+			}
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != test.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, test.status, w.Body)
+			}
+
+			if test.failure == 0 {
+				return
+			}
+
+			response := map[string]struct {
+				Value []map[string]struct{ Value []interface{} }
+			}{}
+			if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+
+			failed := response["00081198"].Value
+			if len(failed) != 1 || len(failed[0]["00081197"].Value) != 1 || failed[0]["00081197"].Value[0] != test.failure {
+				t.Errorf("failed sequence %+v, want reason %v", failed, test.failure)
+			}
+
+			if listing, _ := storage.Scratch.List("stow/", "", 0); len(listing.Objects) != 0 {
+				t.Errorf("left %+v in scratch", listing.Objects)
+			}
+		})
+	}
+}
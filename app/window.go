@@ -0,0 +1,63 @@
+package app
+
+import (
+	"net/http"
+
+	"github.com/nerdyworm/sess/conversions"
+	"github.com/nerdyworm/sess/errs"
+	"github.com/nerdyworm/sess/models"
+	"github.com/nerdyworm/sess/repos"
+)
+
+// windowRequest is the window a client asked for, an explicit center and
+// width win over a preset.
+type windowRequest struct {
+	Center string
+	Width  string
+	Preset string
+}
+
+func windowFromQuery(r *http.Request) windowRequest {
+	query := r.URL.Query()
+
+	return windowRequest{
+		Center: query.Get("wc"),
+		Width:  query.Get("ww"),
+		Preset: query.Get("preset"),
+	}
+}
+
+// applyWindow sets the requested window on options. Options that already
+// carry a window, from the DICOMweb window param, keep it. When nothing was
+// asked for the account's default preset for the instance's modality is
+// used, so that it is part of the cache key like any other window.
+func applyWindow(options *conversions.Options, window windowRequest, instance *models.Instance) error {
+	op := "applyWindow"
+
+	if options.HasWindow() {
+		return nil
+	}
+
+	if window.Center != "" || window.Width != "" {
+		if window.Center == "" || window.Width == "" {
+			return errs.Errorf(errs.Invalid, op, "wc and ww have to be given together")
+		}
+
+		return options.SetWindow(window.Center, window.Width)
+	}
+
+	if window.Preset != "" {
+		return options.SetPreset(window.Preset)
+	}
+
+	account, err := repos.Accounts.FindByID(instance.AccountID)
+	if err != nil {
+		return err
+	}
+
+	if preset, ok := account.Settings.WindowPresets[instance.Modality]; ok {
+		return options.SetPreset(preset)
+	}
+
+	return nil
+}
@@ -0,0 +1,205 @@
+package audit
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/nerdyworm/sess/errs"
+	"github.com/nerdyworm/sess/models"
+	"github.com/nerdyworm/sess/queue"
+	"github.com/streadway/amqp"
+)
+
+// amqpConfirmTimeout bounds how long a write waits for the broker to
+// confirm an event.
+const amqpConfirmTimeout = 5 * time.Second
+
+// amqpSink publishes events to a durable fanout exchange on its own
+// channel, so a slow audit consumer can not hold up the job queue. A
+// durable queue named after the exchange is bound to it, so events are
+// kept while nothing consumes them. Publishes are mandatory and confirmed,
+// a write only succeeds once the broker has routed and stored the event.
+// The channel is reopened on the next write after it closes.
+type amqpSink struct {
+	exchange string
+	state    *amqpChannel
+}
+
+// amqpChannel is the sink's current channel and what it listens on, all
+// of it is replaced together when the channel is reopened.
+type amqpChannel struct {
+	mu       sync.Mutex
+	channel  *amqp.Channel
+	confirms chan amqp.Confirmation
+	returns  chan amqp.Return
+	closed   chan *amqp.Error
+}
+
+func newAMQPSink(exchange string) (amqpSink, error) {
+	s := amqpSink{exchange: exchange, state: &amqpChannel{}}
+
+	err := s.open()
+	if err != nil {
+		return amqpSink{}, err
+	}
+
+	return s, nil
+}
+
+// open declares the exchange and its queue on a new channel in confirm
+// mode. It is called with the state locked or before the sink is shared.
+func (s amqpSink) open() error {
+	op := "audit.amqpSink.open"
+
+	if queue.Connection == nil {
+		return errs.Errorf(errs.Unavailable, op, "the queue is not connected")
+	}
+
+	channel, err := queue.Connection.Channel()
+	if err != nil {
+		return errs.E(errs.Unavailable, op, err)
+	}
+
+	err = declareAudit(channel, s.exchange)
+	if err == nil {
+		err = channel.Confirm(false)
+	}
+
+	if err != nil {
+		channel.Close()
+		return errs.E(errs.Unavailable, op, err)
+	}
+
+	s.state.channel = channel
+	s.state.confirms = channel.NotifyPublish(make(chan amqp.Confirmation, 1))
+	s.state.returns = channel.NotifyReturn(make(chan amqp.Return, 1))
+	s.state.closed = channel.NotifyClose(make(chan *amqp.Error, 1))
+
+	return nil
+}
+
+func declareAudit(channel *amqp.Channel, exchange string) error {
+	err := channel.ExchangeDeclare(
+		exchange, // name
+		"fanout", // type
+		true,     // durable
+		false,    // auto-deleted
+		false,    // internal
+		false,    // no-wait
+		nil,      // arguments
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = channel.QueueDeclare(
+		exchange, // name
+		true,     // durable
+		false,    // delete when unused
+		false,    // exclusive
+		false,    // no-wait
+		nil,      // arguments
+	)
+	if err != nil {
+		return err
+	}
+
+	return channel.QueueBind(
+		exchange, // name
+		"",       // key
+		exchange, // exchange
+		false,    // no-wait
+		nil,      // args
+	)
+}
+
+// drop forgets a channel that closed or whose confirms can no longer be
+// matched to publishes, the next write opens a new one.
+func (s amqpSink) drop() {
+	if s.state.channel != nil {
+		s.state.channel.Close()
+	}
+
+	s.state.channel = nil
+}
+
+func (s amqpSink) Write(event *models.AuditEvent) error {
+	op := "audit.amqpSink.Write"
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	s.state.mu.Lock()
+	defer s.state.mu.Unlock()
+
+	select {
+	case <-s.state.closed:
+		s.drop()
+	default:
+	}
+
+	if s.state.channel == nil {
+		err = s.open()
+		if err != nil {
+			return err
+		}
+	}
+
+	err = s.state.channel.Publish(
+		s.exchange,
+		"",
+		true,  // mandatory
+		false, // immediate
+		amqp.Publishing{
+			Body:         body,
+			ContentType:  "application/json",
+			DeliveryMode: amqp.Persistent,
+			Timestamp:    event.Time,
+		},
+	)
+	if err != nil {
+		s.drop()
+		return errs.E(errs.Unavailable, op, err)
+	}
+
+	// an unroutable event is returned before it is acked
+	select {
+	case confirm, ok := <-s.state.confirms:
+		if !ok {
+			s.drop()
+			return errs.Errorf(errs.Unavailable, op, "channel closed before the event was confirmed")
+		}
+
+		select {
+		case <-s.state.returns:
+			return errs.Errorf(errs.Unavailable, op, "no queue is bound to `%s`", s.exchange)
+		default:
+		}
+
+		if !confirm.Ack {
+			return errs.Errorf(errs.Unavailable, op, "the broker did not accept the event")
+		}
+
+		return nil
+
+	case <-time.After(amqpConfirmTimeout):
+		s.drop()
+		return errs.Errorf(errs.Timeout, op, "no confirm after %v", amqpConfirmTimeout)
+	}
+}
+
+func (s amqpSink) Close() error {
+	s.state.mu.Lock()
+	defer s.state.mu.Unlock()
+
+	if s.state.channel == nil {
+		return nil
+	}
+
+	err := s.state.channel.Close()
+	s.state.channel = nil
+	return err
+}
@@ -0,0 +1,82 @@
+package audit
+
+import (
+	"sync"
+
+	"github.com/nerdyworm/sess/errs"
+	"github.com/nerdyworm/sess/models"
+	"github.com/nerdyworm/sess/repos"
+)
+
+// asyncSink writes events to its sink from a single goroutine so serving
+// never waits on the audit log. Write only queues the event, it fails
+// when the queue is full and Record logs the event instead.
+type asyncSink struct {
+	sink   Sink
+	events chan *models.AuditEvent
+	done   chan struct{}
+	once   *sync.Once
+}
+
+func newAsyncSink(sink Sink, buffer int) asyncSink {
+	s := asyncSink{
+		sink:   sink,
+		events: make(chan *models.AuditEvent, buffer),
+		done:   make(chan struct{}),
+		once:   &sync.Once{},
+	}
+
+	go s.run()
+	return s
+}
+
+func (s asyncSink) Write(event *models.AuditEvent) error {
+	select {
+	case s.events <- event:
+		return nil
+	default:
+		return errs.Errorf(errs.Unavailable, "audit.asyncSink.Write", "%d events are waiting to be written", cap(s.events))
+	}
+}
+
+// Close writes the events still queued before closing the sink.
+func (s asyncSink) Close() error {
+	s.once.Do(func() { close(s.events) })
+	<-s.done
+
+	return s.sink.Close()
+}
+
+func (s asyncSink) run() {
+	defer close(s.done)
+
+	for event := range s.events {
+		if event.PatientID == "" {
+			event.PatientID = patientID(event)
+		}
+
+		err := s.sink.Write(event)
+		if err != nil {
+			logEvent(err, event)
+		}
+	}
+}
+
+// patientID looks the patient up from the study for instances recorded
+// before they carried it.
+func patientID(event *models.AuditEvent) string {
+	if event.AccountID == "" || event.StudyInstanceUID == "" {
+		return ""
+	}
+
+	studies, err := repos.Studies.Search(repos.StudyQuery{
+		AccountIDs:       []string{event.AccountID},
+		StudyInstanceUID: event.StudyInstanceUID,
+		Page:             repos.Page{Limit: 1},
+	})
+	if err != nil || len(studies) == 0 {
+		return ""
+	}
+
+	return studies[0].PatientID
+}
@@ -0,0 +1,111 @@
+// Package audit records who was shown which patient's data. Events go to
+// the sink picked in config.Audit; the mongo and file sinks can be queried
+// back, the amqp sink keeps them in a queue bound to its exchange for
+// whatever consumes it.
+package audit
+
+import (
+	"encoding/json"
+	"log"
+
+	"github.com/nerdyworm/sess/config"
+	"github.com/nerdyworm/sess/errs"
+	"github.com/nerdyworm/sess/models"
+	"github.com/nerdyworm/sess/repos"
+)
+
+var (
+	Default Sink = noneSink{}
+)
+
+type Sink interface {
+	Write(*models.AuditEvent) error
+	Close() error
+}
+
+// Searcher is implemented by the sinks that can read their events back.
+type Searcher interface {
+	Search(repos.AuditQuery) ([]*models.AuditEvent, error)
+}
+
+func Setup(cfg config.Audit) {
+	sink, err := open(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if _, ok := sink.(noneSink); !ok {
+		sink = newAsyncSink(sink, cfg.Buffer)
+	}
+
+	Default = sink
+}
+
+func Shutdown() {
+	err := Default.Close()
+	if err != nil {
+		log.Printf("[Audit][ERROR] closing sink %v\n", err)
+	}
+}
+
+// Record hands event to the default sink, which writes it in the
+// background. Serving never fails because of the audit log, so errors are
+// logged along with the whole event to keep it recoverable from the logs.
+func Record(event *models.AuditEvent) {
+	err := Default.Write(event)
+	if err != nil {
+		logEvent(err, event)
+	}
+}
+
+func logEvent(err error, event *models.AuditEvent) {
+	b, _ := json.Marshal(event)
+	log.Printf("[Audit][ERROR] %v %s\n", err, b)
+}
+
+// OpenSearcher opens the sink cfg names for reading, without the
+// connections that only writing needs.
+func OpenSearcher(cfg config.Audit) (Searcher, error) {
+	switch cfg.Sink {
+	case "mongo":
+		return mongoSink{}, nil
+	case "file":
+		return fileSink{path: cfg.File}, nil
+	}
+
+	return nil, errs.Errorf(errs.Invalid, "audit.OpenSearcher", "the %s sink can not be queried", cfg.Sink)
+}
+
+func open(cfg config.Audit) (Sink, error) {
+	switch cfg.Sink {
+	case "mongo":
+		return mongoSink{}, nil
+	case "file":
+		return newFileSink(cfg.File)
+	case "amqp":
+		return newAMQPSink(cfg.Exchange)
+	case "none":
+		return noneSink{}, nil
+	}
+
+	return nil, errs.Errorf(errs.Invalid, "audit.Setup", "unknown sink `%s`", cfg.Sink)
+}
+
+type noneSink struct{}
+
+func (noneSink) Write(*models.AuditEvent) error { return nil }
+func (noneSink) Close() error                   { return nil }
+
+type mongoSink struct{}
+
+func (mongoSink) Write(event *models.AuditEvent) error {
+	return repos.AuditEvents.Create(event)
+}
+
+func (mongoSink) Search(query repos.AuditQuery) ([]*models.AuditEvent, error) {
+	return repos.AuditEvents.Search(query)
+}
+
+func (mongoSink) Close() error {
+	return nil
+}
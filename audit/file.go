@@ -0,0 +1,106 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/nerdyworm/sess/errs"
+	"github.com/nerdyworm/sess/models"
+	"github.com/nerdyworm/sess/repos"
+)
+
+// fileSink appends one json object per line. Every write is a single
+// append so lines from concurrent requests never interleave.
+type fileSink struct {
+	path string
+	file *os.File
+	mu   *sync.Mutex
+}
+
+func newFileSink(path string) (fileSink, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fileSink{}, errs.E(errs.Unavailable, "audit.newFileSink", err)
+	}
+
+	return fileSink{path: path, file: file, mu: &sync.Mutex{}}, nil
+}
+
+func (s fileSink) Write(event *models.AuditEvent) error {
+	b, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err = s.file.Write(append(b, '\n'))
+	if err != nil {
+		return errs.E(errs.Unavailable, "audit.fileSink.Write", err)
+	}
+
+	return nil
+}
+
+// Search scans the whole file, it is meant for small deployments and for
+// pulling a report, not for serving an api.
+func (s fileSink) Search(query repos.AuditQuery) ([]*models.AuditEvent, error) {
+	op := "audit.fileSink.Search"
+
+	file, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return []*models.AuditEvent{}, nil
+	} else if err != nil {
+		return nil, errs.E(errs.Unavailable, op, err)
+	}
+	defer file.Close()
+
+	limit := query.Limit
+	if limit <= 0 {
+		limit = repos.DefaultLimit
+	}
+
+	events := []*models.AuditEvent{}
+	skipped := 0
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() && len(events) < limit {
+		event := &models.AuditEvent{}
+		err := json.Unmarshal(scanner.Bytes(), event)
+		if err != nil {
+			// a crash mid write leaves a partial last line
+			log.Printf("[Audit][ERROR] %s: skipping malformed line %v\n", s.path, err)
+			continue
+		}
+
+		if !query.Matches(event) {
+			continue
+		}
+
+		if skipped < query.Offset {
+			skipped++
+			continue
+		}
+
+		events = append(events, event)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, errs.E(errs.Unavailable, op, err)
+	}
+
+	return events, nil
+}
+
+func (s fileSink) Close() error {
+	if s.file == nil {
+		return nil
+	}
+
+	return s.file.Close()
+}
@@ -0,0 +1,261 @@
+package conversions
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"text/template"
+	"unicode"
+
+	"github.com/nerdyworm/sess/dicom"
+	"github.com/nerdyworm/sess/errs"
+	"github.com/nerdyworm/sess/metrics"
+	"github.com/nerdyworm/sess/models"
+)
+
+const maxAnnotationLine = 64
+
+var annotationCorners = []string{"top_left", "top_right", "bottom_left", "bottom_right"}
+
+// defaultAnnotations are drawn for accounts that have not set their own.
+var defaultAnnotations = map[string]string{
+	"top_left":     "{{.PatientName}}\n{{.PatientID}}",
+	"top_right":    "{{.StudyDate}}\n{{.Modality}}",
+	"bottom_left":  "Se: {{.SeriesNumber}} Im: {{.InstanceNumber}}",
+	"bottom_right": "{{if .WindowWidth}}W: {{.WindowWidth}} L: {{.WindowCenter}}{{end}}",
+}
+
+// annotationFields are what annotation templates can refer to, any other
+// element is available as {{element "Name"}}.
+type annotationFields struct {
+	PatientName    string
+	PatientID      string
+	StudyDate      string
+	Modality       string
+	SeriesNumber   string
+	InstanceNumber string
+	WindowCenter   string
+	WindowWidth    string
+}
+
+func newAnnotationFields(d dicom.Dicom) annotationFields {
+	center, width := d.Window()
+
+	return annotationFields{
+		PatientName:    displayName(d.Get("PatientName").Value),
+		PatientID:      d.Get("PatientID").Value,
+		StudyDate:      displayDate(d.Get("StudyDate").Value),
+		Modality:       d.Modality,
+		SeriesNumber:   d.Get("SeriesNumber").Value,
+		InstanceNumber: d.Get("InstanceNumber").Value,
+		WindowCenter:   center,
+		WindowWidth:    width,
+	}
+}
+
+// SetAnnotations resolves the corner templates the account draws, its own
+// or the default, when the options ask for annotations.
+func (o *Options) SetAnnotations(account *models.Account) {
+	if !o.Annotate {
+		return
+	}
+
+	o.Annotations = accountAnnotations(account)
+}
+
+// annotations are the templates to draw. Jobs published without resolved
+// templates draw the account's current ones.
+func (o Options) annotations(account *models.Account) map[string]string {
+	if len(o.Annotations) > 0 {
+		return o.Annotations
+	}
+
+	return accountAnnotations(account)
+}
+
+// writeAnnotationsKey adds the templates to hash corner by corner, so that
+// an account changing its overlay gets new keys instead of stale images.
+func (o Options) writeAnnotationsKey(hash io.Writer) {
+	for _, corner := range annotationCorners {
+		if text, ok := o.Annotations[corner]; ok {
+			io.WriteString(hash, fmt.Sprintf("%s=%q", corner, text))
+		}
+	}
+}
+
+func accountAnnotations(account *models.Account) map[string]string {
+	if len(account.Settings.Annotations) == 0 {
+		return defaultAnnotations
+	}
+
+	return account.Settings.Annotations
+}
+
+// annotateImage burns the corner templates onto the image at path. Each
+// corner is handed to ImageMagick in a file, which keeps names starting
+// with @, containing % or non-ASCII text intact.
+func annotateImage(path string, d dicom.Dicom, corners map[string]string, format string) error {
+	op := "annotateImage"
+
+	width, height, err := imageSize(path, d.Modality)
+	if err != nil {
+		return err
+	}
+
+	pointsize := height / 40
+	if width < height {
+		pointsize = width / 40
+	}
+	if pointsize < 10 {
+		pointsize = 10
+	}
+	margin := pointsize / 2
+
+	args := []string{
+		path,
+		"-font", annotationFont,
+		"-pointsize", fmt.Sprintf("%d", pointsize),
+		"-fill", "white",
+		"-undercolor", "#00000080",
+	}
+
+	fields := newAnnotationFields(d)
+	funcs := template.FuncMap{
+		"element": func(name string) string {
+			return d.Get(name).Value
+		},
+	}
+
+	for _, corner := range annotationCorners {
+		text, ok := corners[corner]
+		if !ok {
+			continue
+		}
+
+		gravity := settingToGravity[corner]
+
+		tmpl, err := template.New(corner).Funcs(funcs).Parse(text)
+		if err != nil {
+			return errs.Errorf(errs.ConversionFailed, op, "annotation template for %s: %v", corner, err)
+		}
+
+		var rendered bytes.Buffer
+		err = tmpl.Execute(&rendered, fields)
+		if err != nil {
+			return errs.Errorf(errs.ConversionFailed, op, "annotation template for %s: %v", corner, err)
+		}
+
+		annotation := annotationText(rendered.String())
+		if annotation == "" {
+			continue
+		}
+
+		file, err := ioutil.TempFile("", "annotation")
+		if err != nil {
+			return errs.E(errs.ConversionFailed, op, err)
+		}
+		defer os.Remove(file.Name())
+
+		_, err = file.WriteString(annotation)
+		file.Close()
+		if err != nil {
+			return errs.E(errs.ConversionFailed, op, err)
+		}
+
+		offset := fmt.Sprintf("+%d+%d", margin, margin)
+		args = append(args, "-gravity", gravity, "-annotate", offset, "@"+file.Name())
+	}
+
+	convert := exec.Command("convert", append(args, format+":"+path)...)
+	output, err := metrics.CombinedOutput(convert, d.Modality)
+	if err != nil {
+		log.Printf("annotateImage stderr dump \n%s\n", string(output))
+		return err
+	}
+
+	return nil
+}
+
+// annotationText makes rendered template output safe to draw: control
+// characters other than newlines are dropped and lines are cut to
+// maxAnnotationLine runes, never inside a multibyte character. Text read
+// from an @file is not searched for ImageMagick's % escapes, so there is
+// nothing to escape.
+func annotationText(text string) string {
+	lines := strings.Split(strings.TrimSpace(text), "\n")
+
+	for i, line := range lines {
+		runes := []rune(strings.Map(func(r rune) rune {
+			if unicode.IsControl(r) {
+				return -1
+			}
+			return r
+		}, line))
+
+		if len(runes) > maxAnnotationLine {
+			runes = append(runes[:maxAnnotationLine-1], '…')
+		}
+
+		lines[i] = string(runes)
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// displayName formats a PN value, FAMILY^GIVEN^MIDDLE, as "FAMILY, GIVEN
+// MIDDLE". Ideographic and phonetic groups, after an =, follow the
+// alphabetic one.
+func displayName(value string) string {
+	groups := []string{}
+
+	for _, group := range strings.Split(value, "=") {
+		parts := strings.Split(group, "^")
+		name := strings.TrimSpace(parts[0])
+
+		given := strings.TrimSpace(strings.Join(parts[1:], " "))
+		if given != "" {
+			if name != "" {
+				name += ", "
+			}
+			name += given
+		}
+
+		if name != "" {
+			groups = append(groups, name)
+		}
+	}
+
+	return strings.Join(groups, " ")
+}
+
+// displayDate formats a DA value, YYYYMMDD, as YYYY-MM-DD.
+func displayDate(value string) string {
+	value = strings.TrimSpace(value)
+	if len(value) != 8 {
+		return value
+	}
+
+	return value[:4] + "-" + value[4:6] + "-" + value[6:]
+}
+
+func imageSize(path, modality string) (int, int, error) {
+	identify := exec.Command("identify", "-format", "%w %h", path)
+	output, err := metrics.CombinedOutput(identify, modality)
+	if err != nil {
+		log.Printf("imageSize stderr dump \n%s\n", string(output))
+		return 0, 0, err
+	}
+
+	var width, height int
+	_, err = fmt.Sscanf(string(output), "%d %d", &width, &height)
+	if err != nil {
+		return 0, 0, fmt.Errorf("identify `%s`: %v", output, err)
+	}
+
+	return width, height, nil
+}
@@ -0,0 +1,42 @@
+package conversions
+
+import (
+	"fmt"
+
+	"github.com/nerdyworm/sess/errs"
+	"github.com/nerdyworm/sess/models"
+	"github.com/nerdyworm/sess/storage"
+)
+
+// SetBranding resolves where the account draws its logo and which
+// revision of the logo is drawn, when the options ask for branding.
+func (o *Options) SetBranding(account *models.Account) error {
+	if !o.Brand {
+		return nil
+	}
+
+	revision, err := logoRevision(account)
+	if err != nil {
+		return err
+	}
+
+	o.Logo = gravityForBrandingLogo(account) + "," + revision
+	return nil
+}
+
+// logoRevision names the content of the account's logo, its checksum or
+// its size and modtime when the store does not know the checksum.
+func logoRevision(account *models.Account) (string, error) {
+	info, err := storage.Primary.Stat(account.LogoKey())
+	if errs.Is(err, errs.NotFound) {
+		return "", errs.Errorf(errs.ConversionFailed, "logoRevision", "branding logo: %v", err)
+	} else if err != nil {
+		return "", err
+	}
+
+	if info.Checksum != "" {
+		return info.Checksum, nil
+	}
+
+	return fmt.Sprintf("%x-%x", info.Size, info.ModTime.UnixNano()), nil
+}
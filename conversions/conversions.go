@@ -0,0 +1,19 @@
+package conversions
+
+import "github.com/nerdyworm/sess/config"
+
+var (
+	annotationFont = "Noto-Sans-CJK-JP"
+	deidentifySalt string
+)
+
+func Setup(cfg config.Convert) {
+	annotationFont = cfg.AnnotationFont
+	deidentifySalt = cfg.DeidentifySalt
+}
+
+// CanDeidentify is false until a salt is configured, without one remapped
+// UIDs could be recomputed from the originals.
+func CanDeidentify() bool {
+	return deidentifySalt != ""
+}
@@ -0,0 +1,95 @@
+package conversions
+
+import "testing"
+
+// TestKeyStable pins keys of options that existed before the others were
+// added, they have to keep naming what is already cached.
+func TestKeyStable(t *testing.T) {
+	tests := []struct {
+		converter Converter
+		key       string
+	}{
+		{InstanceToJPG{InstanceID: "abc"}, "convertions/6395b81afb898dff409c75e6497d57a0.jpg"},
+		{InstanceToJPG{InstanceID: "abc", Options: Options{Size: 512, Brand: true}}, "convertions/26cd93ff53b71e666a7f962510768c2a.jpg"},
+		{InstanceToJPG{InstanceID: "abc", Options: Options{Format: "jpeg"}}, "convertions/6395b81afb898dff409c75e6497d57a0.jpg"},
+		{InstanceFrameToJPG{InstanceID: "abc", Frame: 2, Options: Options{Size: 512}}, "convertions/e21c9757e73a52fcaab894fecd4ffc9a.jpg"},
+		{InstanceToMovie{InstanceID: "abc"}, "convertions/6395b81afb898dff409c75e6497d57a0.mp4"},
+		{InstanceToMetadata{InstanceID: "abc"}, "convertions/6b64dd66aa58df54ff292208b3b3cd28.json"},
+	}
+
+	for _, test := range tests {
+		if key := test.converter.Key(); key != test.key {
+			t.Errorf("%#v.Key() = %s, want %s", test.converter, key, test.key)
+		}
+	}
+}
+
+func TestKeyUnique(t *testing.T) {
+	annotations := map[string]string{"top_left": "{{.PatientName}}", "bottom_right": "{{.StudyDate}}"}
+
+	tests := []struct {
+		name      string
+		converter Converter
+	}{
+		{"jpg", InstanceToJPG{InstanceID: "abc"}},
+		{"other instance", InstanceToJPG{InstanceID: "abd"}},
+		{"size", InstanceToJPG{InstanceID: "abc", Options: Options{Size: 512}}},
+		{"brand", InstanceToJPG{InstanceID: "abc", Options: Options{Brand: true}}},
+		{"quality", InstanceToJPG{InstanceID: "abc", Options: Options{Quality: 80}}},
+		{"window", InstanceToJPG{InstanceID: "abc", Options: Options{WindowCenter: "40", WindowWidth: "400"}}},
+		{"other window", InstanceToJPG{InstanceID: "abc", Options: Options{WindowCenter: "400", WindowWidth: "40"}}},
+		{"png", InstanceToJPG{InstanceID: "abc", Options: Options{Format: "png"}}},
+		{"webp", InstanceToJPG{InstanceID: "abc", Options: Options{Format: "webp"}}},
+		{"geometry", InstanceToJPG{InstanceID: "abc", Options: Options{Width: 100, Height: 50, Fit: "contain"}}},
+		{"fit", InstanceToJPG{InstanceID: "abc", Options: Options{Width: 100, Height: 50, Fit: "cover"}}},
+		{"crop", InstanceToJPG{InstanceID: "abc", Options: Options{Crop: Region{X: 1, Y: 2, Width: 3, Height: 4}}}},
+		{"annotate", InstanceToJPG{InstanceID: "abc", Options: Options{Annotate: true}}},
+		{"annotations", InstanceToJPG{InstanceID: "abc", Options: Options{Annotate: true, Annotations: annotations}}},
+		{"other annotations", InstanceToJPG{InstanceID: "abc", Options: Options{Annotate: true, Annotations: map[string]string{"top_left": "{{.StudyDate}}", "bottom_right": "{{.PatientName}}"}}}},
+		{"logo", InstanceToJPG{InstanceID: "abc", Options: Options{Brand: true, Logo: "NorthWest,abc"}}},
+		{"other logo revision", InstanceToJPG{InstanceID: "abc", Options: Options{Brand: true, Logo: "NorthWest,abd"}}},
+		{"other logo gravity", InstanceToJPG{InstanceID: "abc", Options: Options{Brand: true, Logo: "SouthEast,abc"}}},
+		{"frame", InstanceFrameToJPG{InstanceID: "abc", Frame: 1}},
+		{"other frame", InstanceFrameToJPG{InstanceID: "abc", Frame: 2}},
+		{"movie", InstanceToMovie{InstanceID: "abc", Options: Options{Size: 1}}},
+		{"metadata", InstanceToMetadata{InstanceID: "abc"}},
+	}
+
+	seen := map[string]string{}
+	for _, test := range tests {
+		key := test.converter.Key()
+		if other, ok := seen[key]; ok {
+			t.Errorf("%s and %s share the key %s", test.name, other, key)
+		}
+		seen[key] = test.name
+
+		for i := 0; i < 10; i++ {
+			if again := test.converter.Key(); again != key {
+				t.Errorf("%s: Key() = %s, then %s", test.name, key, again)
+				break
+			}
+		}
+	}
+}
+
+// TestKeyLosslessQuality gives a png the key it has without a quality, the
+// encoder ignores it.
+func TestKeyLosslessQuality(t *testing.T) {
+	tests := []struct {
+		format string
+		same   bool
+	}{
+		{"png", true},
+		{"jpeg", false},
+		{"webp", false},
+	}
+
+	for _, test := range tests {
+		with := InstanceToJPG{InstanceID: "abc", Options: Options{Format: test.format, Quality: 80}}
+		without := InstanceToJPG{InstanceID: "abc", Options: Options{Format: test.format}}
+
+		if same := with.Key() == without.Key(); same != test.same {
+			t.Errorf("%s: key with quality %s, without %s", test.format, with.Key(), without.Key())
+		}
+	}
+}
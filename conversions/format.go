@@ -0,0 +1,88 @@
+package conversions
+
+import (
+	"fmt"
+
+	"github.com/nerdyworm/sess/errs"
+)
+
+// imageFormats maps the format names clients send to the ImageMagick
+// coder the image is encoded with.
+var imageFormats = map[string]string{
+	"":     "jpeg",
+	"jpg":  "jpeg",
+	"jpeg": "jpeg",
+	"png":  "png",
+	"webp": "webp",
+}
+
+var (
+	contentTypeByFormat = map[string]string{
+		"jpeg": "image/jpeg",
+		"png":  "image/png",
+		"webp": "image/webp",
+	}
+
+	extensionByFormat = map[string]string{
+		"jpeg": "jpg",
+		"png":  "png",
+		"webp": "webp",
+	}
+)
+
+// FormatForContentType is the inverse of ContentType for negotiated
+// requests.
+func FormatForContentType(contentType string) string {
+	for format, t := range contentTypeByFormat {
+		if t == contentType {
+			return format
+		}
+	}
+
+	return ""
+}
+
+// SetFormat validates the name of an image format and sets it on the
+// options.
+func (o *Options) SetFormat(format string) error {
+	coder, ok := imageFormats[format]
+	if !ok {
+		return errs.Errorf(errs.Invalid, "Options.SetFormat", "unknown format `%s`", format)
+	}
+
+	o.Format = coder
+	return nil
+}
+
+// ImageFormat is the coder of an image conversion, jpeg unless another one
+// was asked for. It is empty for formats that are not images, such as mp4.
+func (o Options) ImageFormat() string {
+	return imageFormats[o.Format]
+}
+
+// IsLossless reports whether the image is encoded without loss, which also
+// means it has to be rendered without a lossy intermediate.
+func (o Options) IsLossless() bool {
+	return o.ImageFormat() == "png"
+}
+
+// EncodeQuality is the quality the image is encoded at. Only the lossy
+// formats have one, a png comes out the same whatever was asked for.
+func (o Options) EncodeQuality() int {
+	switch o.ImageFormat() {
+	case "jpeg", "webp":
+		return o.Quality
+	}
+
+	return 0
+}
+
+func (o Options) imageContentType() string {
+	return contentTypeByFormat[o.ImageFormat()]
+}
+
+// imageKey is the cache key of an image rendered with these options from
+// the sum of their hash. Jpegs keep the extension they always had.
+func (o Options) imageKey(sum []byte) string {
+	return fmt.Sprintf("convertions/%x.%s", sum, extensionByFormat[o.ImageFormat()])
+}
@@ -0,0 +1,217 @@
+package conversions
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/nerdyworm/sess/errs"
+)
+
+const (
+	// MaxDimension bounds the width and height a client may ask for.
+	MaxDimension = 4096
+	// MaxUpscale bounds how far the source, or its crop, is enlarged.
+	MaxUpscale = 4
+)
+
+var fitModes = map[string]bool{
+	"contain": true,
+	"cover":   true,
+	"fill":    true,
+	"none":    true,
+}
+
+// Region is a rectangle in source pixel coordinates.
+type Region struct {
+	X      int
+	Y      int
+	Width  int
+	Height int
+}
+
+func (r Region) IsZero() bool {
+	return r.Width == 0 && r.Height == 0
+}
+
+// SetGeometry validates an output size and fit mode and sets them on the
+// options. Either dimension may be 0 to keep the aspect ratio, fit defaults
+// to contain.
+func (o *Options) SetGeometry(width, height int, fit string) error {
+	op := "Options.SetGeometry"
+
+	if width < 0 || height < 0 || width > MaxDimension || height > MaxDimension {
+		return errs.Errorf(errs.Invalid, op, "size %dx%d is out of range, the maximum is %d", width, height, MaxDimension)
+	}
+
+	if fit == "" {
+		fit = "contain"
+	}
+
+	if !fitModes[fit] {
+		return errs.Errorf(errs.Invalid, op, "unknown fit `%s`", fit)
+	}
+
+	if (fit == "cover" || fit == "fill") && (width == 0 || height == 0) {
+		return errs.Errorf(errs.Invalid, op, "fit `%s` needs both a width and a height", fit)
+	}
+
+	o.Width = width
+	o.Height = height
+	o.Fit = fit
+	return nil
+}
+
+// SetCrop validates a region of interest and sets it on the options.
+func (o *Options) SetCrop(region Region) error {
+	if region.X < 0 || region.Y < 0 || region.Width < 1 || region.Height < 1 {
+		return errs.Errorf(errs.Invalid, "Options.SetCrop", "invalid crop %+v", region)
+	}
+
+	o.Crop = region
+	return nil
+}
+
+// HasGeometry reports whether the output is sized by Width and Height, as
+// opposed to the square Size or not at all.
+func (o Options) HasGeometry() bool {
+	return o.Width > 0 || o.Height > 0
+}
+
+func (o Options) writeGeometryKey(hash io.Writer) {
+	if o.HasGeometry() {
+		io.WriteString(hash, fmt.Sprintf("geometry=%dx%d,%s", o.Width, o.Height, o.Fit))
+	}
+
+	if !o.Crop.IsZero() {
+		c := o.Crop
+		io.WriteString(hash, fmt.Sprintf("crop=%d,%d,%d,%d", c.X, c.Y, c.Width, c.Height))
+	}
+}
+
+// bound limits the output to MaxUpscale times the source, keeping the
+// aspect ratio the client asked for. An unknown source size, 0, is not
+// bounded.
+func (o Options) bound(sourceWidth, sourceHeight int) (int, int) {
+	width, height := o.Width, o.Height
+
+	if !o.Crop.IsZero() {
+		sourceWidth, sourceHeight = o.Crop.Width, o.Crop.Height
+	}
+
+	if sourceWidth == 0 || sourceHeight == 0 {
+		return width, height
+	}
+
+	scale := 1.0
+	if limit := MaxUpscale * sourceWidth; width > limit {
+		scale = float64(limit) / float64(width)
+	}
+
+	if limit := MaxUpscale * sourceHeight; height > limit {
+		if s := float64(limit) / float64(height); s < scale {
+			scale = s
+		}
+	}
+
+	return int(float64(width) * scale), int(float64(height) * scale)
+}
+
+// imageGeometryArgs are the ImageMagick arguments that crop and size an
+// image of sourceWidth by sourceHeight.
+func (o Options) imageGeometryArgs(sourceWidth, sourceHeight int) []string {
+	args := []string{}
+
+	if !o.Crop.IsZero() {
+		c := o.Crop
+		args = append(args, "-crop", fmt.Sprintf("%dx%d+%d+%d", c.Width, c.Height, c.X, c.Y), "+repage")
+	}
+
+	if !o.HasGeometry() {
+		if o.Size > 0 {
+			resize := fmt.Sprintf("%dx%d^", o.Size, o.Size)
+			extent := fmt.Sprintf("%dx%d", o.Size, o.Size)
+			args = append(args, "-thumbnail", resize, "-gravity", "center", "-extent", extent)
+		}
+
+		return args
+	}
+
+	width, height := o.bound(sourceWidth, sourceHeight)
+	size := dimensions(width, height)
+
+	switch o.Fit {
+	case "cover":
+		args = append(args, "-thumbnail", size+"^", "-gravity", "center", "-extent", size)
+	case "fill":
+		args = append(args, "-thumbnail", size+"!")
+	case "none":
+		if width > 0 && height > 0 {
+			args = append(args, "-gravity", "center", "-background", "black", "-extent", size)
+		}
+	default:
+		args = append(args, "-thumbnail", size)
+	}
+
+	return args
+}
+
+// movieFilter is the ffmpeg filter chain that crops and sizes the frames of
+// a movie. Dimensions are kept even, which yuv420p requires.
+func (o Options) movieFilter(sourceWidth, sourceHeight int) string {
+	filters := []string{}
+
+	if !o.Crop.IsZero() {
+		c := o.Crop
+		filters = append(filters, fmt.Sprintf("crop=%d:%d:%d:%d", c.Width, c.Height, c.X, c.Y))
+	}
+
+	if o.HasGeometry() {
+		width, height := o.bound(sourceWidth, sourceHeight)
+		w, h := even(width), even(height)
+
+		switch {
+		case o.Fit == "cover":
+			filters = append(filters,
+				fmt.Sprintf("scale=%d:%d:force_original_aspect_ratio=increase", w, h),
+				fmt.Sprintf("crop=%d:%d", w, h))
+		case o.Fit == "fill":
+			filters = append(filters, fmt.Sprintf("scale=%d:%d", w, h))
+		case o.Fit == "none":
+			if width > 0 && height > 0 {
+				filters = append(filters,
+					fmt.Sprintf("crop='min(iw,%d)':'min(ih,%d)'", w, h),
+					fmt.Sprintf("pad=%d:%d:(ow-iw)/2:(oh-ih)/2", w, h))
+			}
+		case width == 0:
+			filters = append(filters, fmt.Sprintf("scale=-2:%d", h))
+		case height == 0:
+			filters = append(filters, fmt.Sprintf("scale=%d:-2", w))
+		default:
+			filters = append(filters, fmt.Sprintf("scale=%d:%d:force_original_aspect_ratio=decrease", w, h))
+		}
+	}
+
+	filters = append(filters, "scale=trunc(iw/2)*2:trunc(ih/2)*2")
+
+	return strings.Join(filters, ",")
+}
+
+func dimensions(width, height int) string {
+	switch {
+	case width == 0:
+		return fmt.Sprintf("x%d", height)
+	case height == 0:
+		return fmt.Sprintf("%d", width)
+	}
+
+	return fmt.Sprintf("%dx%d", width, height)
+}
+
+func even(n int) int {
+	if n > 0 && n < 2 {
+		return 2
+	}
+
+	return n - n%2
+}
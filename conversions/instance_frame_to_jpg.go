@@ -0,0 +1,39 @@
+package conversions
+
+import (
+	"crypto/md5"
+	"fmt"
+	"io"
+)
+
+// InstanceFrameToJPG renders a single frame of a multiframe instance, such
+// as an ultrasound or XA cine. Frames count from 1.
+type InstanceFrameToJPG struct {
+	InstanceID string
+	Frame      int
+	Options    Options
+}
+
+func (i InstanceFrameToJPG) Key() string {
+	hash := md5.New()
+
+	io.WriteString(hash, i.InstanceID)
+	io.WriteString(hash, fmt.Sprintf("frame=%d", i.Frame))
+	io.WriteString(hash, fmt.Sprintf("%d", i.Options.Size))
+	io.WriteString(hash, brandKey(i.Options.Brand))
+	i.Options.writeKey(hash)
+
+	return i.Options.imageKey(hash.Sum(nil))
+}
+
+func (i InstanceFrameToJPG) Source() string {
+	return i.InstanceID
+}
+
+func (i InstanceFrameToJPG) ContentType() string {
+	return i.Options.imageContentType()
+}
+
+func (i InstanceFrameToJPG) Convert() (io.ReadCloser, error) {
+	return renderImage("InstanceFrameToJPG.Convert", i.InstanceID, i.Frame, i.Options)
+}
@@ -0,0 +1,82 @@
+package conversions
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/nerdyworm/sess/dicom"
+	"github.com/nerdyworm/sess/errs"
+)
+
+// InstanceToDeidentified is the original instance with the PS3.15 basic
+// confidentiality profile applied, for research exports.
+type InstanceToDeidentified struct {
+	InstanceID  string
+	Profile     string
+	RetainDates bool
+}
+
+// Key changes with the salt and the profile table, exports remapped with
+// an old salt or made with an older table are not served again.
+func (i InstanceToDeidentified) Key() string {
+	hash := md5.New()
+
+	io.WriteString(hash, "deidentify")
+	io.WriteString(hash, i.InstanceID)
+	io.WriteString(hash, fmt.Sprintf("profile=%s", i.Profile))
+	io.WriteString(hash, fmt.Sprintf("retain_dates=%t", i.RetainDates))
+	io.WriteString(hash, fmt.Sprintf("profile_version=%d", dicom.ProfileVersion))
+	io.WriteString(hash, fmt.Sprintf("salt=%x", sha256.Sum256([]byte(deidentifySalt))))
+
+	return fmt.Sprintf("convertions/%x.dcm", hash.Sum(nil))
+}
+
+func (i InstanceToDeidentified) Source() string {
+	return i.InstanceID
+}
+
+func (i InstanceToDeidentified) ContentType() string {
+	return "application/dicom"
+}
+
+func (i InstanceToDeidentified) Convert() (io.ReadCloser, error) {
+	op := "InstanceToDeidentified.Convert"
+
+	if i.Profile != "basic" {
+		return nil, errs.Errorf(errs.Invalid, op, "unknown profile `%s`", i.Profile)
+	}
+
+	if !CanDeidentify() {
+		return nil, errs.Errorf(errs.Unavailable, op, "no deidentify salt is configured")
+	}
+
+	_, dcm, cleanup, err := fetchDicom(op, i.InstanceID)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	err = dcm.CheckDeidentifiable()
+	if err != nil {
+		return nil, errs.E(errs.Invalid, op, err)
+	}
+
+	err = dcm.Deidentify(dicom.DeidentifyOptions{
+		RetainDates: i.RetainDates,
+		Salt:        deidentifySalt,
+	})
+	if err != nil {
+		return nil, errs.E(errs.ConversionFailed, op, err)
+	}
+
+	// the copy is removed by cleanup, the open file stays readable
+	file, err := os.Open(dcm.Path)
+	if err != nil {
+		return nil, errs.E(errs.ConversionFailed, op, err)
+	}
+
+	return file, nil
+}
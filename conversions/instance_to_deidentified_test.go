@@ -0,0 +1,31 @@
+package conversions
+
+import "testing"
+
+func TestInstanceToDeidentifiedKey(t *testing.T) {
+	defer func(salt string) { deidentifySalt = salt }(deidentifySalt)
+
+	converter := InstanceToDeidentified{InstanceID: "abc", Profile: "basic"}
+
+	tests := []struct {
+		name      string
+		salt      string
+		converter InstanceToDeidentified
+		same      bool
+	}{
+		{"same salt", "one", converter, true},
+		{"other salt", "two", converter, false},
+		{"dates retained", "one", InstanceToDeidentified{InstanceID: "abc", Profile: "basic", RetainDates: true}, false},
+		{"other instance", "one", InstanceToDeidentified{InstanceID: "abd", Profile: "basic"}, false},
+	}
+
+	deidentifySalt = "one"
+	key := converter.Key()
+
+	for _, test := range tests {
+		deidentifySalt = test.salt
+		if got := test.converter.Key(); (got == key) != test.same {
+			t.Errorf("%s: Key() = %s, same as %s is %v, want %v", test.name, got, key, got == key, test.same)
+		}
+	}
+}
@@ -2,14 +2,15 @@ package conversions
 
 import (
 	"crypto/md5"
-	"errors"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"os/exec"
+	"strings"
 
-	"github.com/nerdyworm/sess/dicom"
+	"github.com/nerdyworm/sess/errs"
+	"github.com/nerdyworm/sess/metrics"
 	"github.com/nerdyworm/sess/models"
 	"github.com/nerdyworm/sess/repos"
 	"github.com/nerdyworm/sess/storage"
@@ -17,9 +18,63 @@ import (
 )
 
 type Options struct {
-	Size   int
-	Brand  bool
-	Format string
+	Size         int
+	Width        int
+	Height       int
+	Fit          string
+	Crop         Region
+	Brand        bool
+	Annotate     bool
+	Format       string
+	Quality      int
+	WindowCenter string
+	WindowWidth  string
+	// Annotations are the corner templates drawn when Annotate is set,
+	// resolved from the account by SetAnnotations so that they are part of
+	// the key.
+	Annotations map[string]string `json:",omitempty"`
+	// Logo is where the account's logo goes and which revision of it is
+	// drawn when Brand is set, resolved by SetBranding so that a new logo
+	// gets new keys.
+	Logo string `json:",omitempty"`
+}
+
+// writeKey adds the options that are not part of every converter's key to
+// hash. Zero values are skipped so that keys made before an option existed
+// stay valid.
+func (o Options) writeKey(hash io.Writer) {
+	if quality := o.EncodeQuality(); quality > 0 {
+		io.WriteString(hash, fmt.Sprintf("quality=%d", quality))
+	}
+
+	if o.HasWindow() {
+		io.WriteString(hash, fmt.Sprintf("window=%s,%s", o.WindowCenter, o.WindowWidth))
+	}
+
+	if format := o.ImageFormat(); format != "" && format != "jpeg" {
+		io.WriteString(hash, fmt.Sprintf("format=%s", format))
+	}
+
+	o.writeGeometryKey(hash)
+
+	if o.Annotate {
+		io.WriteString(hash, "annotate")
+		o.writeAnnotationsKey(hash)
+	}
+
+	if o.Brand && o.Logo != "" {
+		io.WriteString(hash, fmt.Sprintf("logo=%s", o.Logo))
+	}
+}
+
+// brandKey is what fmt printed for the brand with the %b verb, which does
+// not take a bool; every key hashed before that was noticed has it.
+func brandKey(brand bool) string {
+	return fmt.Sprintf("%%!b(bool=%t)", brand)
+}
+
+func (o Options) HasWindow() bool {
+	return o.WindowCenter != "" && o.WindowWidth != ""
 }
 
 type InstanceToJPG struct {
@@ -33,105 +88,150 @@ func (i InstanceToJPG) Key() string {
 
 	io.WriteString(hash, i.InstanceID)
 	io.WriteString(hash, fmt.Sprintf("%d", i.Options.Size))
-	io.WriteString(hash, fmt.Sprintf("%b", i.Options.Brand))
+	io.WriteString(hash, brandKey(i.Options.Brand))
+	i.Options.writeKey(hash)
 
-	return fmt.Sprintf("convertions/%x.jpg", hash.Sum(nil))
+	return i.Options.imageKey(hash.Sum(nil))
+}
+
+func (i InstanceToJPG) Source() string {
+	return i.InstanceID
 }
 
 func (i InstanceToJPG) ContentType() string {
-	return "image/jpg"
+	return i.Options.imageContentType()
 }
 
 func (i InstanceToJPG) Convert() (io.ReadCloser, error) {
-	if i.InstanceID == "" {
-		return nil, errors.New("Empty Mongo ID")
-	}
+	return renderImage("InstanceToJPG.Convert", i.InstanceID, 1, i.Options)
+}
 
-	instance, err := repos.Instances.FindByID(i.InstanceID)
+// renderImage renders one frame of an instance, counting from 1, and
+// applies the options to it. Formats other than jpeg are rendered through a
+// png so that they are only lossy if their own encoding is.
+func renderImage(op, instanceID string, n int, options Options) (io.ReadCloser, error) {
+	instance, dicom, cleanup, err := fetchDicom(op, instanceID)
 	if err != nil {
 		return nil, err
 	}
+	defer cleanup()
 
-	reader, err := storage.Primary.Get(instance.Key())
-	if err != nil {
-		return nil, err
+	if options.HasWindow() {
+		dicom.SetWindow(options.WindowCenter, options.WindowWidth)
 	}
-	defer reader.Close()
 
-	key := util.RandomString(32) + instance.Key()
+	format := options.ImageFormat()
+	intermediate := "jpeg"
+	if format != "jpeg" {
+		intermediate = "png"
+	}
 
-	err = storage.Scratch.Put(key, reader)
+	err = dicom.ExtractFrameAs(n, intermediate)
 	if err != nil {
-		return nil, err
+		return nil, extractError(op, err)
 	}
-	defer storage.Scratch.Delete(key)
 
-	path := storage.Scratch.GetPath(key)
+	frame := dicom.InstanceKey()
 
-	dicom, err := dicom.New(path)
-	if err != nil {
-		return nil, err
+	if dicom.Modality == "DOC" {
+		err = convertDocToImage(frame, dicom.Modality)
+		if err != nil {
+			return nil, errs.E(errs.ConversionFailed, op, err)
+		}
 	}
-	defer dicom.Clean()
 
-	err = dicom.ExtractFirst()
-	if err != nil {
-		return nil, err
+	if args := options.imageGeometryArgs(dicom.Columns, dicom.Rows); len(args) > 0 {
+		err = transformImage(frame, args, intermediate, dicom.Modality)
+		if err != nil {
+			return nil, errs.E(errs.ConversionFailed, op, err)
+		}
 	}
 
-	frame := dicom.InstanceKey()
-
-	if dicom.Modality == "DOC" {
-		err = convertDocToImage(frame)
+	var account *models.Account
+	if options.Brand || options.Annotate {
+		account, err = repos.Accounts.FindByID(instance.AccountID)
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	if i.Options.Size > 0 {
-		err = resizeImage(frame, i.Options.Size)
+	if options.Annotate {
+		err = annotateImage(frame, dicom, options.annotations(account), intermediate)
 		if err != nil {
-			return nil, err
+			return nil, errs.E(errs.ConversionFailed, op, err)
 		}
 	}
 
-	if i.Options.Brand {
-		account, err := repos.Accounts.FindByID(instance.AccountID)
+	if options.Brand {
+		err = applyAccountBranding(frame, account, options.Logo, dicom.Modality)
 		if err != nil {
-			return nil, err
+			return nil, errs.E(errs.ConversionFailed, op, err)
 		}
+	}
 
-		err = applyAccountBranding(frame, account)
+	if format != "jpeg" || options.EncodeQuality() > 0 {
+		err = encodeImage(frame, format, options.EncodeQuality(), dicom.Modality)
 		if err != nil {
-			return nil, err
+			return nil, errs.E(errs.ConversionFailed, op, err)
 		}
 	}
 
-	return os.Open(frame)
+	file, err := os.Open(frame)
+	if err != nil {
+		return nil, errs.E(errs.ConversionFailed, op, err)
+	}
+
+	return file, nil
 }
 
-func resizeImage(path string, size int) error {
-	resize := fmt.Sprintf("%dx%d^", size, size)
-	extent := fmt.Sprintf("%dx%d", size, size)
+// transformImage runs the image at path through the ImageMagick args and
+// writes it back as format.
+func transformImage(path string, args []string, format, modality string) error {
+	args = append([]string{path}, args...)
+	args = append(args, format+":"+path)
 
-	convert := exec.Command("convert", path, "-thumbnail", resize, "-gravity", "center", "-extent", extent, "jpeg:"+path)
-	output, err := convert.CombinedOutput()
+	convert := exec.Command("convert", args...)
+	output, err := metrics.CombinedOutput(convert, modality)
 	if err != nil {
-		log.Printf("resizeImage stderr dump \n%s\n", string(output))
+		log.Printf("transformImage stderr dump \n%s\n", string(output))
 		return err
 	}
 
 	return nil
 }
 
-func convertDocToImage(path string) error {
+// encodeImage re-encodes the image at path as format. Quality is left to
+// ImageMagick's default when it is 0, png is always lossless and ignores
+// it, and a webp at 100 is encoded losslessly.
+func encodeImage(path, format string, quality int, modality string) error {
+	args := []string{path}
+
+	if quality > 0 && format != "png" {
+		args = append(args, "-quality", fmt.Sprintf("%d", quality))
+	}
+
+	if quality == 100 && format == "webp" {
+		args = append(args, "-define", "webp:lossless=true")
+	}
+
+	convert := exec.Command("convert", append(args, format+":"+path)...)
+	output, err := metrics.CombinedOutput(convert, modality)
+	if err != nil {
+		log.Printf("encodeImage stderr dump \n%s\n", string(output))
+		return err
+	}
+
+	return nil
+}
+
+func convertDocToImage(path, modality string) error {
 	convert := exec.Command(
 		"convert",
 		path,
 		path+"-%05d.jpg",
 	)
 
-	output, err := convert.CombinedOutput()
+	output, err := metrics.CombinedOutput(convert, modality)
 	if err != nil {
 		log.Printf("convert doc to image dump \n%s\n", string(output))
 		return err
@@ -145,10 +245,30 @@ func convertDocToImage(path string) error {
 	return nil
 }
 
-func applyAccountBranding(path string, account *models.Account) error {
+// applyAccountBranding draws the account's logo onto the image at path. A
+// logo resolved into the options has to still be the account's, otherwise
+// the new logo would be cached under the old one's key.
+func applyAccountBranding(path string, account *models.Account, logo, modality string) error {
+	gravity := gravityForBrandingLogo(account)
+
+	if logo != "" {
+		parts := strings.SplitN(logo, ",", 2)
+
+		revision, err := logoRevision(account)
+		if err != nil {
+			return err
+		}
+
+		if len(parts) != 2 || parts[1] != revision {
+			return errs.Errorf(errs.Unavailable, "applyAccountBranding", "branding logo changed while rendering")
+		}
+
+		gravity = parts[0]
+	}
+
 	r, err := storage.Primary.Get(account.LogoKey())
 	if err != nil {
-		return err
+		return errs.Errorf(errs.ConversionFailed, "applyAccountBranding", "branding logo: %v", err)
 	}
 	defer r.Close()
 
@@ -165,13 +285,13 @@ func applyAccountBranding(path string, account *models.Account) error {
 	composite := exec.Command(
 		"composite",
 		"-gravity",
-		gravityForBrandingLogo(account),
+		gravity,
 		p,
 		path,
 		path,
 	)
 
-	output, err := composite.CombinedOutput()
+	output, err := metrics.CombinedOutput(composite, modality)
 	if err != nil {
 		log.Printf("applyAccountBranding dump \n%s\n", string(output))
 		return err
@@ -0,0 +1,53 @@
+package conversions
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/nerdyworm/sess/dicom"
+	"github.com/nerdyworm/sess/errs"
+)
+
+type InstanceToMetadata struct {
+	InstanceID string
+}
+
+func (i InstanceToMetadata) Key() string {
+	hash := md5.New()
+
+	io.WriteString(hash, "metadata")
+	io.WriteString(hash, i.InstanceID)
+
+	return fmt.Sprintf("convertions/%x.json", hash.Sum(nil))
+}
+
+func (i InstanceToMetadata) Source() string {
+	return i.InstanceID
+}
+
+func (i InstanceToMetadata) ContentType() string {
+	return "application/dicom+json"
+}
+
+// Convert renders the instance's attributes as a DICOM JSON array with a
+// single data set, which is what WADO-RS metadata requests expect.
+func (i InstanceToMetadata) Convert() (io.ReadCloser, error) {
+	op := "InstanceToMetadata.Convert"
+
+	_, dcm, cleanup, err := fetchDicom(op, i.InstanceID)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	b, err := json.Marshal([]map[string]dicom.JSONAttribute{dcm.JSON()})
+	if err != nil {
+		return nil, errs.E(errs.ConversionFailed, op, err)
+	}
+
+	return ioutil.NopCloser(bytes.NewReader(b)), nil
+}
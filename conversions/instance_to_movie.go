@@ -2,17 +2,14 @@ package conversions
 
 import (
 	"crypto/md5"
-	"errors"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"os/exec"
 
-	"github.com/nerdyworm/sess/dicom"
-	"github.com/nerdyworm/sess/repos"
-	"github.com/nerdyworm/sess/storage"
-	"github.com/nerdyworm/sess/util"
+	"github.com/nerdyworm/sess/errs"
+	"github.com/nerdyworm/sess/metrics"
 )
 
 type InstanceToMovie struct {
@@ -25,50 +22,36 @@ func (i InstanceToMovie) Key() string {
 
 	io.WriteString(hash, i.InstanceID)
 	io.WriteString(hash, fmt.Sprintf("%d", i.Options.Size))
-	io.WriteString(hash, fmt.Sprintf("%b", i.Options.Brand))
+	io.WriteString(hash, brandKey(i.Options.Brand))
+	i.Options.writeKey(hash)
 
 	return fmt.Sprintf("convertions/%x.mp4", hash.Sum(nil))
 }
 
+func (i InstanceToMovie) Source() string {
+	return i.InstanceID
+}
+
 func (i InstanceToMovie) ContentType() string {
 	return "video/mp4"
 }
 
 func (i InstanceToMovie) Convert() (io.ReadCloser, error) {
-	if i.InstanceID == "" {
-		return nil, errors.New("Empty Mongo ID")
-	}
-
-	instance, err := repos.Instances.FindByID(i.InstanceID)
-	if err != nil {
-		return nil, err
-	}
-
-	reader, err := storage.Primary.Get(instance.Key())
-	if err != nil {
-		return nil, err
-	}
-	defer reader.Close()
-
-	key := util.RandomString(32) + instance.Key()
+	op := "InstanceToMovie.Convert"
 
-	err = storage.Scratch.Put(key, reader)
+	_, dicom, cleanup, err := fetchDicom(op, i.InstanceID)
 	if err != nil {
 		return nil, err
 	}
-	defer storage.Scratch.Delete(key)
-
-	path := storage.Scratch.GetPath(key)
+	defer cleanup()
 
-	dicom, err := dicom.New(path)
-	if err != nil {
-		return nil, err
+	if i.Options.HasWindow() {
+		dicom.SetWindow(i.Options.WindowCenter, i.Options.WindowWidth)
 	}
-	defer dicom.Clean()
 
 	err = dicom.Extract()
 	if err != nil {
-		return nil, err
+		return nil, errs.E(errs.ConversionFailed, op, err)
 	}
 
 	frame := dicom.InstanceKey()
@@ -86,17 +69,23 @@ func (i InstanceToMovie) Convert() (io.ReadCloser, error) {
 		"-y",
 		"-r", rate,
 		"-i", patern,
+		"-vf", i.Options.movieFilter(dicom.Columns, dicom.Rows),
 		"-c:v", "libx264",
 		"-r", rate,
 		"-pix_fmt", "yuv420p",
 		movieFilename,
 	)
 
-	output, err := convert.CombinedOutput()
+	output, err := metrics.CombinedOutput(convert, dicom.Modality)
 	if err != nil {
 		log.Printf("%s\n", string(output))
-		return nil, err
+		return nil, errs.E(errs.ConversionFailed, op, err)
+	}
+
+	file, err := os.Open(movieFilename)
+	if err != nil {
+		return nil, errs.E(errs.ConversionFailed, op, err)
 	}
 
-	return os.Open(movieFilename)
+	return file, nil
 }
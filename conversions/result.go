@@ -9,6 +9,8 @@ type Result struct {
 
 type Converter interface {
 	Key() string
+	// Source is the id of the instance the output is derived from.
+	Source() string
 	ContentType() string
 	Convert() (io.ReadCloser, error)
 }
@@ -0,0 +1,65 @@
+package conversions
+
+import (
+	"github.com/nerdyworm/sess/dicom"
+	"github.com/nerdyworm/sess/errs"
+	"github.com/nerdyworm/sess/models"
+	"github.com/nerdyworm/sess/repos"
+	"github.com/nerdyworm/sess/storage"
+	"github.com/nerdyworm/sess/util"
+)
+
+// fetchDicom copies the original of an instance from primary storage into
+// scratch and parses it. The returned cleanup func removes the copy and
+// anything rendered from it.
+func fetchDicom(op, instanceID string) (*models.Instance, dicom.Dicom, func(), error) {
+	if instanceID == "" {
+		return nil, dicom.Dicom{}, nil, errs.Errorf(errs.InvalidID, op, "Empty Mongo ID")
+	}
+
+	instance, err := repos.Instances.FindByID(instanceID)
+	if err != nil {
+		return nil, dicom.Dicom{}, nil, err
+	}
+
+	// the key is part of a scratch path
+	if !dicom.ValidUID(instance.Key()) {
+		return nil, dicom.Dicom{}, nil, errs.Errorf(errs.Invalid, op, "invalid uid `%s`", instance.Key())
+	}
+
+	reader, err := storage.Primary.Get(instance.Key())
+	if err != nil {
+		return nil, dicom.Dicom{}, nil, err
+	}
+	defer reader.Close()
+
+	key := util.RandomString(32) + instance.Key()
+
+	err = storage.Scratch.Put(key, reader)
+	if err != nil {
+		return nil, dicom.Dicom{}, nil, err
+	}
+
+	dcm, err := dicom.New(storage.Scratch.GetPath(key))
+	if err != nil {
+		storage.Scratch.Delete(key)
+		return nil, dicom.Dicom{}, nil, errs.E(errs.ConversionFailed, op, err)
+	}
+
+	cleanup := func() {
+		dcm.Clean()
+		storage.Scratch.Delete(key)
+	}
+
+	return instance, dcm, cleanup, nil
+}
+
+// extractError reports a frame that does not exist as not found rather
+// than as a failed conversion.
+func extractError(op string, err error) error {
+	if err == dicom.ErrFrameOutOfRange {
+		return errs.E(errs.NotFound, op, err)
+	}
+
+	return errs.E(errs.ConversionFailed, op, err)
+}
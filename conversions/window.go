@@ -0,0 +1,57 @@
+package conversions
+
+import (
+	"strconv"
+
+	"github.com/nerdyworm/sess/errs"
+)
+
+// Window is a VOI window, center and width are in the modality's units,
+// Hounsfield units for CT.
+type Window struct {
+	Center float64
+	Width  float64
+}
+
+// WindowPresets are the named windows radiologists ask for by name.
+var WindowPresets = map[string]Window{
+	"lung":    {Center: -600, Width: 1500},
+	"bone":    {Center: 400, Width: 1800},
+	"brain":   {Center: 40, Width: 80},
+	"abdomen": {Center: 40, Width: 400},
+}
+
+// SetWindow validates an explicit window and sets it on the options. Values
+// are normalized so that 40 and 40.0 share a cache key.
+func (o *Options) SetWindow(center, width string) error {
+	op := "Options.SetWindow"
+
+	c, err := strconv.ParseFloat(center, 64)
+	if err != nil {
+		return errs.Errorf(errs.Invalid, op, "invalid window center `%s`", center)
+	}
+
+	w, err := strconv.ParseFloat(width, 64)
+	if err != nil || w < 1 {
+		return errs.Errorf(errs.Invalid, op, "invalid window width `%s`", width)
+	}
+
+	o.setWindow(Window{Center: c, Width: w})
+	return nil
+}
+
+// SetPreset sets the window of one of WindowPresets.
+func (o *Options) SetPreset(name string) error {
+	window, ok := WindowPresets[name]
+	if !ok {
+		return errs.Errorf(errs.Invalid, "Options.SetPreset", "unknown window preset `%s`", name)
+	}
+
+	o.setWindow(window)
+	return nil
+}
+
+func (o *Options) setWindow(window Window) {
+	o.WindowCenter = strconv.FormatFloat(window.Center, 'f', -1, 64)
+	o.WindowWidth = strconv.FormatFloat(window.Width, 'f', -1, 64)
+}
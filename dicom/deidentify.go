@@ -0,0 +1,567 @@
+package dicom
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"math/big"
+	"os/exec"
+	"sort"
+	"strings"
+
+	"github.com/nerdyworm/sess/metrics"
+)
+
+// Actions of the PS3.15 Annex E profile tables.
+const (
+	actionRemove  = "X"
+	actionZero    = "Z"
+	actionReplace = "U"
+)
+
+// ProfileVersion changes whenever the profile tables below do, so that
+// exports made with an older table are not served from the cache.
+const ProfileVersion = 2
+
+// basicProfile is PS3.15 Table E.1-1, the Basic Application Level
+// Confidentiality Profile, without its dates and times, which are in
+// profileDates. Where the table allows a choice that includes D, replacing
+// with a dummy value, the attribute is zeroed if the table allows that and
+// removed otherwise. Sequences of referenced images keep their items, the
+// UIDs in them are replaced. Tags are lowercase, the way dcm2xml reports
+// them.
+var basicProfile = map[string]string{
+	"0008,0014": actionReplace, // Instance Creator UID
+	"0008,0018": actionReplace, // SOP Instance UID
+	"0008,0050": actionZero,    // Accession Number
+	"0008,0055": actionRemove,  // Station AE Title
+	"0008,0058": actionReplace, // Failed SOP Instance UID List
+	"0008,0080": actionRemove,  // Institution Name
+	"0008,0081": actionRemove,  // Institution Address
+	"0008,0082": actionRemove,  // Institution Code Sequence
+	"0008,0090": actionZero,    // Referring Physician's Name
+	"0008,0092": actionRemove,  // Referring Physician's Address
+	"0008,0094": actionRemove,  // Referring Physician's Telephone Numbers
+	"0008,0096": actionRemove,  // Referring Physician Identification Sequence
+	"0008,009c": actionZero,    // Consulting Physician's Name
+	"0008,009d": actionRemove,  // Consulting Physician Identification Sequence
+	"0008,010d": actionReplace, // Context Group Extension Creator UID
+	"0008,1010": actionRemove,  // Station Name
+	"0008,1030": actionRemove,  // Study Description
+	"0008,103e": actionRemove,  // Series Description
+	"0008,1040": actionRemove,  // Institutional Department Name
+	"0008,1041": actionRemove,  // Institutional Department Type Code Sequence
+	"0008,1048": actionRemove,  // Physician(s) of Record
+	"0008,1049": actionRemove,  // Physician(s) of Record Identification Sequence
+	"0008,1050": actionRemove,  // Performing Physicians' Name
+	"0008,1052": actionRemove,  // Performing Physician Identification Sequence
+	"0008,1060": actionRemove,  // Name of Physician(s) Reading Study
+	"0008,1062": actionRemove,  // Physician(s) Reading Study Identification Sequence
+	"0008,1070": actionRemove,  // Operators' Name
+	"0008,1072": actionRemove,  // Operators' Identification Sequence
+	"0008,1080": actionRemove,  // Admitting Diagnoses Description
+	"0008,1084": actionRemove,  // Admitting Diagnoses Code Sequence
+	"0008,1110": actionRemove,  // Referenced Study Sequence
+	"0008,1111": actionRemove,  // Referenced Performed Procedure Step Sequence
+	"0008,1120": actionRemove,  // Referenced Patient Sequence
+	"0008,1155": actionReplace, // Referenced SOP Instance UID
+	"0008,1195": actionReplace, // Transaction UID
+	"0008,2111": actionRemove,  // Derivation Description
+	"0008,3010": actionReplace, // Irradiation Event UID
+	"0008,4000": actionRemove,  // Identifying Comments
+	"0008,9123": actionReplace, // Creator Version UID
+	"0010,0010": actionZero,    // Patient's Name
+	"0010,0020": actionZero,    // Patient ID
+	"0010,0021": actionRemove,  // Issuer of Patient ID
+	"0010,0024": actionRemove,  // Issuer of Patient ID Qualifiers Sequence
+	"0010,0026": actionRemove,  // Source Patient Group Identification Sequence
+	"0010,0027": actionRemove,  // Group of Patients Identification Sequence
+	"0010,0030": actionZero,    // Patient's Birth Date
+	"0010,0032": actionRemove,  // Patient's Birth Time
+	"0010,0033": actionRemove,  // Patient's Birth Date in Alternative Calendar
+	"0010,0034": actionRemove,  // Patient's Death Date in Alternative Calendar
+	"0010,0035": actionRemove,  // Patient's Alternative Calendar
+	"0010,0040": actionZero,    // Patient's Sex
+	"0010,0050": actionRemove,  // Patient's Insurance Plan Code Sequence
+	"0010,0101": actionRemove,  // Patient's Primary Language Code Sequence
+	"0010,0102": actionRemove,  // Patient's Primary Language Modifier Code Sequence
+	"0010,1000": actionRemove,  // Other Patient IDs
+	"0010,1001": actionRemove,  // Other Patient Names
+	"0010,1002": actionRemove,  // Other Patient IDs Sequence
+	"0010,1005": actionRemove,  // Patient's Birth Name
+	"0010,1010": actionRemove,  // Patient's Age
+	"0010,1020": actionRemove,  // Patient's Size
+	"0010,1030": actionRemove,  // Patient's Weight
+	"0010,1040": actionRemove,  // Patient's Address
+	"0010,1050": actionRemove,  // Insurance Plan Identification
+	"0010,1060": actionRemove,  // Patient's Mother's Birth Name
+	"0010,1080": actionRemove,  // Military Rank
+	"0010,1081": actionRemove,  // Branch of Service
+	"0010,1090": actionRemove,  // Medical Record Locator
+	"0010,2000": actionRemove,  // Medical Alerts
+	"0010,2110": actionRemove,  // Allergies
+	"0010,2150": actionRemove,  // Country of Residence
+	"0010,2152": actionRemove,  // Region of Residence
+	"0010,2154": actionRemove,  // Patient's Telephone Numbers
+	"0010,2155": actionRemove,  // Patient's Telecom Information
+	"0010,2160": actionRemove,  // Ethnic Group
+	"0010,2180": actionRemove,  // Occupation
+	"0010,21a0": actionRemove,  // Smoking Status
+	"0010,21b0": actionRemove,  // Additional Patient History
+	"0010,21c0": actionRemove,  // Pregnancy Status
+	"0010,21f0": actionRemove,  // Patient's Religious Preference
+	"0010,2203": actionRemove,  // Patient's Sex Neutered
+	"0010,2292": actionRemove,  // Patient Breed Description
+	"0010,2294": actionRemove,  // Breed Registration Sequence
+	"0010,2297": actionRemove,  // Responsible Person
+	"0010,2299": actionRemove,  // Responsible Organization
+	"0010,4000": actionRemove,  // Patient Comments
+	"0018,0010": actionZero,    // Contrast/Bolus Agent
+	"0018,1000": actionRemove,  // Device Serial Number
+	"0018,1002": actionReplace, // Device UID
+	"0018,1004": actionRemove,  // Plate ID
+	"0018,1005": actionRemove,  // Generator ID
+	"0018,1007": actionRemove,  // Cassette ID
+	"0018,1008": actionRemove,  // Gantry ID
+	"0018,1030": actionRemove,  // Protocol Name
+	"0018,1400": actionRemove,  // Acquisition Device Processing Description
+	"0018,4000": actionRemove,  // Acquisition Comments
+	"0018,700a": actionRemove,  // Detector ID
+	"0018,9424": actionRemove,  // Acquisition Protocol Description
+	"0018,a003": actionRemove,  // Contribution Description
+	"0020,000d": actionReplace, // Study Instance UID
+	"0020,000e": actionReplace, // Series Instance UID
+	"0020,0010": actionZero,    // Study ID
+	"0020,0052": actionReplace, // Frame of Reference UID
+	"0020,0200": actionReplace, // Synchronization Frame of Reference UID
+	"0020,3401": actionRemove,  // Modifying Device ID
+	"0020,3404": actionRemove,  // Modifying Device Manufacturer
+	"0020,3406": actionRemove,  // Modified Image Description
+	"0020,4000": actionRemove,  // Image Comments
+	"0020,9158": actionRemove,  // Frame Comments
+	"0020,9161": actionReplace, // Concatenation UID
+	"0020,9164": actionReplace, // Dimension Organization UID
+	"0028,1199": actionReplace, // Palette Color Lookup Table UID
+	"0028,1214": actionReplace, // Large Palette Color Lookup Table UID
+	"0028,4000": actionRemove,  // Image Presentation Comments
+	"0032,0012": actionRemove,  // Study ID Issuer
+	"0032,1020": actionRemove,  // Scheduled Study Location
+	"0032,1021": actionRemove,  // Scheduled Study Location AE Title
+	"0032,1030": actionRemove,  // Reason for Study
+	"0032,1032": actionRemove,  // Requesting Physician
+	"0032,1033": actionRemove,  // Requesting Service
+	"0032,1060": actionRemove,  // Requested Procedure Description
+	"0032,1070": actionRemove,  // Requested Contrast Agent
+	"0032,4000": actionRemove,  // Study Comments
+	"0038,0004": actionRemove,  // Referenced Patient Alias Sequence
+	"0038,0010": actionRemove,  // Admission ID
+	"0038,0011": actionRemove,  // Issuer of Admission ID
+	"0038,001e": actionRemove,  // Scheduled Patient Institution Residence
+	"0038,0040": actionRemove,  // Discharge Diagnosis Description
+	"0038,0050": actionRemove,  // Special Needs
+	"0038,0060": actionRemove,  // Service Episode ID
+	"0038,0061": actionRemove,  // Issuer of Service Episode ID
+	"0038,0062": actionRemove,  // Service Episode Description
+	"0038,0300": actionRemove,  // Current Patient Location
+	"0038,0400": actionRemove,  // Patient's Institution Residence
+	"0038,0500": actionRemove,  // Patient State
+	"0038,4000": actionRemove,  // Visit Comments
+	"0040,0001": actionRemove,  // Scheduled Station AE Title
+	"0040,0006": actionRemove,  // Scheduled Performing Physician's Name
+	"0040,0007": actionRemove,  // Scheduled Procedure Step Description
+	"0040,000b": actionRemove,  // Scheduled Performing Physician Identification Sequence
+	"0040,0010": actionRemove,  // Scheduled Station Name
+	"0040,0011": actionRemove,  // Scheduled Procedure Step Location
+	"0040,0012": actionRemove,  // Pre-Medication
+	"0040,0241": actionRemove,  // Performed Station AE Title
+	"0040,0242": actionRemove,  // Performed Station Name
+	"0040,0243": actionRemove,  // Performed Location
+	"0040,0253": actionRemove,  // Performed Procedure Step ID
+	"0040,0254": actionRemove,  // Performed Procedure Step Description
+	"0040,0275": actionRemove,  // Request Attributes Sequence
+	"0040,0280": actionRemove,  // Comments on the Performed Procedure Step
+	"0040,0555": actionRemove,  // Acquisition Context Sequence
+	"0040,1001": actionRemove,  // Requested Procedure ID
+	"0040,1004": actionRemove,  // Patient Transport Arrangements
+	"0040,1005": actionRemove,  // Requested Procedure Location
+	"0040,1010": actionRemove,  // Names of Intended Recipients of Results
+	"0040,1011": actionRemove,  // Intended Recipients of Results Identification Sequence
+	"0040,1101": actionRemove,  // Person Identification Code Sequence
+	"0040,1102": actionRemove,  // Person's Address
+	"0040,1103": actionRemove,  // Person's Telephone Numbers
+	"0040,1104": actionRemove,  // Person's Telecom Information
+	"0040,1400": actionRemove,  // Requested Procedure Comments
+	"0040,2001": actionRemove,  // Reason for the Imaging Service Request
+	"0040,2008": actionRemove,  // Order Entered By
+	"0040,2009": actionRemove,  // Order Enterer's Location
+	"0040,2010": actionRemove,  // Order Callback Phone Number
+	"0040,2016": actionZero,    // Placer Order Number / Imaging Service Request
+	"0040,2017": actionZero,    // Filler Order Number / Imaging Service Request
+	"0040,2400": actionRemove,  // Imaging Service Request Comments
+	"0040,3001": actionRemove,  // Confidentiality Constraint on Patient Data Description
+	"0040,4023": actionReplace, // Referenced General Purpose Scheduled Procedure Step Transaction UID
+	"0040,4025": actionRemove,  // Scheduled Station Name Code Sequence
+	"0040,4027": actionRemove,  // Scheduled Station Geographic Location Code Sequence
+	"0040,4028": actionRemove,  // Performed Station Name Code Sequence
+	"0040,4030": actionRemove,  // Performed Station Geographic Location Code Sequence
+	"0040,4034": actionRemove,  // Scheduled Human Performers Sequence
+	"0040,4035": actionRemove,  // Actual Human Performers Sequence
+	"0040,4036": actionRemove,  // Human Performer's Organization
+	"0040,4037": actionRemove,  // Human Performer's Name
+	"0040,a027": actionRemove,  // Verifying Organization
+	"0040,a073": actionRemove,  // Verifying Observer Sequence
+	"0040,a075": actionZero,    // Verifying Observer Name
+	"0040,a078": actionRemove,  // Author Observer Sequence
+	"0040,a07a": actionRemove,  // Participant Sequence
+	"0040,a07c": actionRemove,  // Custodial Organization Sequence
+	"0040,a088": actionZero,    // Verifying Observer Identification Code Sequence
+	"0040,a123": actionZero,    // Person Name
+	"0040,a124": actionReplace, // UID
+	"0040,a353": actionRemove,  // Address (Trial)
+	"0040,a402": actionReplace, // Observation Subject UID (Trial)
+	"0040,a730": actionRemove,  // Content Sequence
+	"0040,db0c": actionReplace, // Template Extension Organization UID
+	"0040,db0d": actionReplace, // Template Extension Creator UID
+	"0050,0020": actionRemove,  // Device Description
+	"0070,0001": actionRemove,  // Graphic Annotation Sequence
+	"0070,0084": actionZero,    // Content Creator's Name
+	"0070,0086": actionRemove,  // Content Creator's Identification Code Sequence
+	"0070,031a": actionReplace, // Fiducial UID
+	"0088,0140": actionReplace, // Storage Media File-set UID
+	"0088,0200": actionRemove,  // Icon Image Sequence
+	"0088,0904": actionRemove,  // Topic Title
+	"0088,0906": actionRemove,  // Topic Subject
+	"0088,0910": actionRemove,  // Topic Author
+	"0088,0912": actionRemove,  // Topic Keywords
+	"2030,0020": actionRemove,  // Text String
+	"3006,0024": actionReplace, // Referenced Frame of Reference UID
+	"3006,00c2": actionReplace, // Related Frame of Reference UID
+	"300a,0013": actionReplace, // Dose Reference UID
+	"300e,0008": actionRemove,  // Reviewer Name
+	"4000,0010": actionRemove,  // Arbitrary
+	"4000,4000": actionRemove,  // Text Comments
+	"4008,0042": actionRemove,  // Results ID Issuer
+	"4008,0102": actionRemove,  // Interpretation Recorder
+	"4008,010a": actionRemove,  // Interpretation Transcriber
+	"4008,010b": actionRemove,  // Interpretation Text
+	"4008,010c": actionRemove,  // Interpretation Author
+	"4008,0111": actionRemove,  // Interpretation Approver Sequence
+	"4008,0114": actionRemove,  // Physician Approving Interpretation
+	"4008,0115": actionRemove,  // Interpretation Diagnosis Description
+	"4008,0118": actionRemove,  // Results Distribution List Sequence
+	"4008,0119": actionRemove,  // Distribution Name
+	"4008,011a": actionRemove,  // Distribution Address
+	"4008,0202": actionRemove,  // Interpretation ID Issuer
+	"4008,0300": actionRemove,  // Impressions
+	"4008,4000": actionRemove,  // Results Comments
+	"0400,0100": actionRemove,  // Digital Signature UID
+	"0400,0402": actionRemove,  // Referenced Digital Signature Sequence
+	"0400,0403": actionRemove,  // Referenced SOP Instance MAC Sequence
+	"0400,0404": actionRemove,  // MAC
+	"0400,0550": actionRemove,  // Modified Attributes Sequence
+	"0400,0561": actionRemove,  // Original Attributes Sequence
+	"fffa,fffa": actionRemove,  // Digital Signatures Sequence
+	"fffc,fffc": actionRemove,  // Data Set Trailing Padding
+}
+
+// repeatingProfile are the entries of Table E.1-1 for repeating groups, an
+// x matches any hex digit.
+var repeatingProfile = map[string]string{
+	"50xx,xxxx": actionRemove, // Curve Data
+	"60xx,3000": actionRemove, // Overlay Data
+	"60xx,4000": actionRemove, // Overlay Comments
+}
+
+// profileDates are the dates and times of Table E.1-1, kept by the Retain
+// Longitudinal Temporal Information with Full Dates Option.
+var profileDates = map[string]string{
+	"0008,0012": actionRemove, // Instance Creation Date
+	"0008,0013": actionRemove, // Instance Creation Time
+	"0008,0015": actionRemove, // Instance Coercion DateTime
+	"0008,0020": actionZero,   // Study Date
+	"0008,0021": actionRemove, // Series Date
+	"0008,0022": actionRemove, // Acquisition Date
+	"0008,0023": actionZero,   // Content Date
+	"0008,0024": actionRemove, // Overlay Date
+	"0008,0025": actionRemove, // Curve Date
+	"0008,002a": actionRemove, // Acquisition DateTime
+	"0008,0030": actionZero,   // Study Time
+	"0008,0031": actionRemove, // Series Time
+	"0008,0032": actionRemove, // Acquisition Time
+	"0008,0033": actionZero,   // Content Time
+	"0008,0034": actionRemove, // Overlay Time
+	"0008,0035": actionRemove, // Curve Time
+	"0008,0201": actionRemove, // Timezone Offset From UTC
+	"0010,21d0": actionRemove, // Last Menstrual Date
+	"0018,1012": actionRemove, // Date of Secondary Capture
+	"0018,1014": actionRemove, // Time of Secondary Capture
+	"0018,1072": actionRemove, // Radiopharmaceutical Start Time
+	"0018,1073": actionRemove, // Radiopharmaceutical Stop Time
+	"0018,1078": actionRemove, // Radiopharmaceutical Start DateTime
+	"0018,1079": actionRemove, // Radiopharmaceutical Stop DateTime
+	"0018,1200": actionRemove, // Date of Last Calibration
+	"0018,1201": actionRemove, // Time of Last Calibration
+	"0018,9074": actionRemove, // Frame Acquisition DateTime
+	"0018,9151": actionRemove, // Frame Reference DateTime
+	"0018,9516": actionRemove, // Start Acquisition DateTime
+	"0018,9517": actionRemove, // End Acquisition DateTime
+	"0032,0032": actionRemove, // Study Verified Date
+	"0032,0033": actionRemove, // Study Verified Time
+	"0032,0034": actionRemove, // Study Read Date
+	"0032,0035": actionRemove, // Study Read Time
+	"0032,1040": actionRemove, // Study Arrival Date
+	"0032,1041": actionRemove, // Study Arrival Time
+	"0032,1050": actionRemove, // Study Completion Date
+	"0032,1051": actionRemove, // Study Completion Time
+	"0038,001a": actionRemove, // Scheduled Admission Date
+	"0038,001b": actionRemove, // Scheduled Admission Time
+	"0038,001c": actionRemove, // Scheduled Discharge Date
+	"0038,001d": actionRemove, // Scheduled Discharge Time
+	"0038,0020": actionRemove, // Admitting Date
+	"0038,0021": actionRemove, // Admitting Time
+	"0038,0030": actionRemove, // Discharge Date
+	"0038,0032": actionRemove, // Discharge Time
+	"0040,0002": actionRemove, // Scheduled Procedure Step Start Date
+	"0040,0003": actionRemove, // Scheduled Procedure Step Start Time
+	"0040,0004": actionRemove, // Scheduled Procedure Step End Date
+	"0040,0005": actionRemove, // Scheduled Procedure Step End Time
+	"0040,0244": actionRemove, // Performed Procedure Step Start Date
+	"0040,0245": actionRemove, // Performed Procedure Step Start Time
+	"0040,0250": actionRemove, // Performed Procedure Step End Date
+	"0040,0251": actionRemove, // Performed Procedure Step End Time
+	"0040,2004": actionRemove, // Issue Date of Imaging Service Request
+	"0040,2005": actionRemove, // Issue Time of Imaging Service Request
+	"0040,4010": actionRemove, // Scheduled Procedure Step Modification DateTime
+	"0040,4011": actionRemove, // Expected Completion DateTime
+	"0040,a030": actionZero,   // Verification DateTime
+	"0040,a032": actionRemove, // Observation DateTime
+	"0040,a120": actionRemove, // DateTime
+	"0040,a121": actionRemove, // Date
+	"0040,a122": actionRemove, // Time
+	"0040,a192": actionRemove, // Observation Date (Trial)
+	"0040,a193": actionRemove, // Observation Time (Trial)
+	"0070,0082": actionZero,   // Presentation Creation Date
+	"0070,0083": actionZero,   // Presentation Creation Time
+	"0072,000a": actionRemove, // Hanging Protocol Creation DateTime
+	"3006,0008": actionZero,   // Structure Set Date
+	"3006,0009": actionZero,   // Structure Set Time
+	"3008,0250": actionRemove, // Treatment Date
+	"3008,0251": actionRemove, // Treatment Time
+	"300e,0004": actionRemove, // Review Date
+	"300e,0005": actionRemove, // Review Time
+	"4008,0100": actionRemove, // Interpretation Recorded Date
+	"4008,0101": actionRemove, // Interpretation Recorded Time
+	"4008,0108": actionRemove, // Interpretation Transcription Date
+	"4008,0109": actionRemove, // Interpretation Transcription Time
+	"4008,0112": actionRemove, // Interpretation Approval Date
+	"4008,0113": actionRemove, // Interpretation Approval Time
+}
+
+// encapsulatedDocument is where Encapsulated PDF and CDA instances keep
+// the document, which the profile can not reach into.
+const encapsulatedDocument = "0042,0011"
+
+// CheckDeidentifiable refuses instances the basic profile can not make
+// safe by editing attributes: those with identifying text burned into the
+// pixels and encapsulated documents.
+func (d Dicom) CheckDeidentifiable() error {
+	if strings.ToUpper(strings.TrimSpace(d.Get("BurnedInAnnotation").Value)) == "YES" {
+		return fmt.Errorf("instance has burned in annotation")
+	}
+
+	if d.Modality == "DOC" || d.tagsPresent()[encapsulatedDocument] {
+		return fmt.Errorf("instance is an encapsulated document")
+	}
+
+	return nil
+}
+
+// profileAction is what the profile does to tag, looking at the repeating
+// groups when the tag itself is not in it.
+func profileAction(profile map[string]string, tag string) string {
+	if action, ok := profile[tag]; ok {
+		return action
+	}
+
+	for pattern, action := range repeatingProfile {
+		if matchesTag(pattern, tag) {
+			return action
+		}
+	}
+
+	return ""
+}
+
+func matchesTag(pattern, tag string) bool {
+	if len(pattern) != len(tag) {
+		return false
+	}
+
+	for i := range pattern {
+		if pattern[i] != 'x' && pattern[i] != tag[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+type DeidentifyOptions struct {
+	// RetainDates keeps dates and times, PS3.15's Retain Longitudinal
+	// Temporal Information with Full Dates Option.
+	RetainDates bool
+	// Salt is mixed into remapped UIDs so that they can not be recomputed
+	// from the originals by anyone without it.
+	Salt string
+}
+
+// Deidentify applies the basic profile to the file at Path in place with
+// dcmodify. UIDs are remapped to 2.25 UIDs derived from the study and the
+// original UID, so every instance of a study keeps pointing at the same
+// series, frame of reference and referenced instances. Private tags are
+// removed.
+func (d *Dicom) Deidentify(options DeidentifyOptions) error {
+	dcmodify := exec.Command("dcmodify", d.deidentifyArgs(options)...)
+	output, err := metrics.CombinedOutput(dcmodify, d.Modality)
+	if err != nil {
+		log.Printf("dcmodify error\n%s\n", string(output))
+		return err
+	}
+
+	return nil
+}
+
+// deidentifyArgs are the dcmodify arguments that apply the profile to the
+// file at Path.
+func (d Dicom) deidentifyArgs(options DeidentifyOptions) []string {
+	profile := basicProfile
+	method := "PS3.15 Basic Application Level Confidentiality Profile"
+
+	if !options.RetainDates {
+		profile = make(map[string]string, len(basicProfile)+len(profileDates))
+		for tag, action := range basicProfile {
+			profile[tag] = action
+		}
+		for tag, action := range profileDates {
+			profile[tag] = action
+		}
+	} else {
+		method += ", Retain Longitudinal Temporal Information with Full Dates Option"
+	}
+
+	args := []string{"--no-backup", "--erase-private"}
+
+	tags := []string{}
+	for tag := range d.tagsPresent() {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+
+	// UIDs are replaced at each path they occur at, the other actions
+	// apply at every nesting level
+	for _, tag := range tags {
+		switch profileAction(profile, tag) {
+		case actionRemove:
+			args = append(args, "--erase-all", "("+tag+")")
+		case actionZero:
+			args = append(args, "--modify-all", "("+tag+")=")
+		}
+	}
+
+	study := d.StudyInstanceUID
+	for _, uid := range d.uidPaths(profile) {
+		args = append(args, "--modify", fmt.Sprintf("%s=%s", uid.path, RemapUID(options.Salt, study, uid.value)))
+	}
+
+	args = append(args,
+		"--insert", "(0012,0062)=YES",
+		"--insert", "(0012,0063)="+method,
+		d.Path,
+	)
+
+	return args
+}
+
+// RemapUID derives a UID under the 2.25 root from a name based UUID of the
+// study and the original UID.
+func RemapUID(salt, study, uid string) string {
+	sum := sha256.Sum256([]byte(salt + "\x00" + study + "\x00" + uid))
+
+	uuid := sum[:16]
+	uuid[6] = (uuid[6] & 0x0f) | 0x50
+	uuid[8] = (uuid[8] & 0x3f) | 0x80
+
+	return "2.25." + new(big.Int).SetBytes(uuid).String()
+}
+
+type uidPath struct {
+	path  string
+	value string
+}
+
+// uidPaths finds the UIDs the profile replaces, with the dcmodify path to
+// each of them, e.g. (0008,1140)[0].(0008,1155).
+func (d Dicom) uidPaths(profile map[string]string) []uidPath {
+	paths := []uidPath{}
+
+	var walk func(prefix string, elements []Element, sequences []Sequence)
+	walk = func(prefix string, elements []Element, sequences []Sequence) {
+		for _, element := range elements {
+			tag := strings.ToLower(element.Tag)
+			value := strings.TrimSpace(element.Value)
+
+			if profileAction(profile, tag) == actionReplace && value != "" {
+				paths = append(paths, uidPath{prefix + "(" + tag + ")", value})
+			}
+		}
+
+		for _, sequence := range sequences {
+			tag := strings.ToLower(sequence.Tag)
+			if profileAction(profile, tag) == actionRemove {
+				continue
+			}
+
+			for i, item := range sequence.Items {
+				walk(fmt.Sprintf("%s(%s)[%d].", prefix, tag, i), item.Elements, item.Sequences)
+			}
+		}
+	}
+
+	walk("", d.dataSetElements(), d.Sequences)
+	return paths
+}
+
+// tagsPresent is every tag in the data set, at any nesting level.
+func (d Dicom) tagsPresent() map[string]bool {
+	present := make(map[string]bool)
+
+	var walk func(elements []Element, sequences []Sequence)
+	walk = func(elements []Element, sequences []Sequence) {
+		for _, element := range elements {
+			present[strings.ToLower(element.Tag)] = true
+		}
+
+		for _, sequence := range sequences {
+			present[strings.ToLower(sequence.Tag)] = true
+			for _, item := range sequence.Items {
+				walk(item.Elements, item.Sequences)
+			}
+		}
+	}
+
+	walk(d.dataSetElements(), d.Sequences)
+	return present
+}
+
+// dataSetElements leaves out the file meta elements, dcmodify keeps those
+// in step with the data set itself.
+func (d Dicom) dataSetElements() []Element {
+	elements := []Element{}
+	for _, element := range d.Elements {
+		if !strings.HasPrefix(element.Tag, "0002") {
+			elements = append(elements, element)
+		}
+	}
+
+	return elements
+}
@@ -0,0 +1,176 @@
+package dicom
+
+import (
+	"math/big"
+	"strings"
+	"testing"
+)
+
+func TestRemapUID(t *testing.T) {
+	uid := RemapUID("salt", "1.2.3", "1.2.3.4")
+
+	tests := []struct {
+		name  string
+		salt  string
+		study string
+		uid   string
+		same  bool
+	}{
+		{name: "same inputs", salt: "salt", study: "1.2.3", uid: "1.2.3.4", same: true},
+		{name: "other salt", salt: "pepper", study: "1.2.3", uid: "1.2.3.4"},
+		{name: "no salt", salt: "", study: "1.2.3", uid: "1.2.3.4"},
+		{name: "other study", salt: "salt", study: "1.2.4", uid: "1.2.3.4"},
+		{name: "other uid", salt: "salt", study: "1.2.3", uid: "1.2.3.5"},
+		{name: "fields run together", salt: "salt", study: "1.2.31", uid: ".2.3.4"},
+	}
+
+	for _, test := range tests {
+		got := RemapUID(test.salt, test.study, test.uid)
+		if (got == uid) != test.same {
+			t.Errorf("%s: RemapUID = %s, same as %s is %v, want %v", test.name, got, uid, got == uid, test.same)
+		}
+
+		if len(got) > 64 {
+			t.Errorf("%s: %s is longer than 64 characters", test.name, got)
+		}
+
+		n, ok := new(big.Int).SetString(strings.TrimPrefix(got, "2.25."), 10)
+		if !strings.HasPrefix(got, "2.25.") || !ok {
+			t.Errorf("%s: %s is not a 2.25 UID", test.name, got)
+			continue
+		}
+
+		// a version 5, RFC 4122 variant UUID
+		uuid := make([]byte, 16)
+		n.FillBytes(uuid)
+		if uuid[6]>>4 != 5 || uuid[8]>>6 != 2 {
+			t.Errorf("%s: %x is not a version 5 UUID", test.name, uuid)
+		}
+	}
+}
+
+func TestDeidentifyArgs(t *testing.T) {
+	d := Dicom{
+		Path:             "/tmp/in.dcm",
+		StudyInstanceUID: "1.2.3",
+		Elements: []Element{
+			{Tag: "0002,0003", Value: "1.2.3.4"},
+			{Tag: "0008,0018", Value: "1.2.3.4"},
+			{Tag: "0008,0020", Value: "20170101"},
+			{Tag: "0008,0060", Value: "CT"},
+			{Tag: "0010,0010", Value: "Doe^Jane"},
+			{Tag: "0010,1000", Value: "other"},
+			{Tag: "0020,000D", Value: "1.2.3"},
+			{Tag: "0020,0052", Value: ""},
+			{Tag: "6000,3000", Value: "overlay"},
+		},
+		Sequences: []Sequence{
+			{Tag: "0008,1140", Items: []Item{
+				{Elements: []Element{{Tag: "0008,1150", Value: "1.2.840.10008.5.1.4.1.1.2"}, {Tag: "0008,1155", Value: "1.2.3.9"}}},
+				{Elements: []Element{{Tag: "0008,1155", Value: " 1.2.3.10 "}}},
+			}},
+			{Tag: "0008,1110", Items: []Item{
+				{Elements: []Element{{Tag: "0008,1155", Value: "1.2.3.8"}}},
+			}},
+		},
+	}
+
+	remap := func(uid string) string {
+		return RemapUID("salt", "1.2.3", uid)
+	}
+
+	always := []string{
+		"--no-backup",
+		"--erase-private",
+		"--modify-all (0010,0010)=",
+		"--erase-all (0010,1000)",
+		"--erase-all (6000,3000)",
+		"--erase-all (0008,1110)",
+		"--modify (0008,0018)=" + remap("1.2.3.4"),
+		"--modify (0020,000d)=" + remap("1.2.3"),
+		"--modify (0008,1140)[0].(0008,1155)=" + remap("1.2.3.9"),
+		"--modify (0008,1140)[1].(0008,1155)=" + remap("1.2.3.10"),
+		"--insert (0012,0062)=YES",
+	}
+
+	never := []string{
+		"(0002,0003)",
+		"(0008,0060)",
+		"(0008,1150)",
+		"(0020,0052)",
+		"(0008,1110)[0]",
+		"--erase-all (0008,1140)",
+	}
+
+	tests := []struct {
+		name    string
+		options DeidentifyOptions
+		want    []string
+		unwant  []string
+	}{
+		{
+			name:    "dates removed",
+			options: DeidentifyOptions{Salt: "salt"},
+			want: append([]string{
+				"--modify-all (0008,0020)=",
+				"--insert (0012,0063)=PS3.15 Basic Application Level Confidentiality Profile /tmp/in.dcm",
+			}, always...),
+			unwant: never,
+		},
+		{
+			name:    "dates retained",
+			options: DeidentifyOptions{Salt: "salt", RetainDates: true},
+			want: append([]string{
+				"--insert (0012,0063)=PS3.15 Basic Application Level Confidentiality Profile, Retain Longitudinal Temporal Information with Full Dates Option /tmp/in.dcm",
+			}, always...),
+			unwant: append([]string{"(0008,0020)"}, never...),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			args := d.deidentifyArgs(test.options)
+			joined := strings.Join(args, " ")
+
+			if args[len(args)-1] != d.Path {
+				t.Errorf("last argument is %q, want the path", args[len(args)-1])
+			}
+
+			for _, want := range test.want {
+				if !strings.Contains(joined, want) {
+					t.Errorf("missing %q in %s", want, joined)
+				}
+			}
+
+			for _, unwant := range test.unwant {
+				if strings.Contains(joined, unwant) {
+					t.Errorf("unexpected %q in %s", unwant, joined)
+				}
+			}
+		})
+	}
+}
+
+func TestProfileAction(t *testing.T) {
+	tests := []struct {
+		tag    string
+		action string
+	}{
+		{"0010,0010", actionZero},
+		{"0008,0018", actionReplace},
+		{"0010,1000", actionRemove},
+		{"5000,0010", actionRemove},
+		{"501e,3000", actionRemove},
+		{"6000,3000", actionRemove},
+		{"6002,4000", actionRemove},
+		{"6000,0010", ""},
+		{"0008,0060", ""},
+		{"0008,0020", ""},
+	}
+
+	for _, test := range tests {
+		if action := profileAction(basicProfile, test.tag); action != test.action {
+			t.Errorf("profileAction(%s) = %q, want %q", test.tag, action, test.action)
+		}
+	}
+}
@@ -3,14 +3,19 @@ package dicom
 import (
 	"bytes"
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"os/exec"
+	"regexp"
 	"strconv"
+	"strings"
 	"sync"
 
+	"github.com/nerdyworm/sess/config"
+	"github.com/nerdyworm/sess/metrics"
 	"github.com/nerdyworm/sess/util"
 
 	"code.google.com/p/go-charset/charset"
@@ -19,6 +24,24 @@ import (
 
 var ROOT = "/tmp/scratch/dicom_root/"
 
+func Setup(cfg config.DICOM) {
+	ROOT = cfg.Root
+}
+
+var (
+	ErrFrameOutOfRange = errors.New("dicom: frame out of range")
+	ErrInvalidUID      = errors.New("dicom: invalid uid")
+)
+
+var uidPattern = regexp.MustCompile(`^[0-9]+(\.[0-9]+)*$`)
+
+// ValidUID reports whether uid is a UID of PS3.5 9.1, dotted numbers of at
+// most 64 characters. UIDs end up in storage keys and file paths, which
+// only UIDs like these are safe in.
+func ValidUID(uid string) bool {
+	return len(uid) <= 64 && uidPattern.MatchString(uid)
+}
+
 type Dicom struct {
 	Path              string
 	SOPInstanceUID    string
@@ -29,12 +52,17 @@ type Dicom struct {
 	CineRate          string
 	Modality          string
 	NumberOfFrames    int
+	Rows              int
+	Columns           int
 	WindowCenter      string
 	WindowWidth       string
+	Photometric       string
 	Elements          []Element
+	Sequences         []Sequence
 	elementsByName    map[string]Element
 
 	extractedFrames bool
+	windowOverride  bool
 	basePath        string
 }
 
@@ -57,12 +85,23 @@ func New(path string) (dicom Dicom, err error) {
 	dicom.Modality = dicom.Get("Modality").Value
 	dicom.WindowCenter = dicom.Get("WindowCenter").Value
 	dicom.WindowWidth = dicom.Get("WindowWidth").Value
+	dicom.Photometric = dicom.Get("PhotometricInterpretation").Value
+
+	for _, uid := range []string{dicom.StudyInstanceUID, dicom.SeriesInstanceUID, dicom.SOPInstanceUID} {
+		if uid != "" && !ValidUID(uid) {
+			err = fmt.Errorf("%w `%s`", ErrInvalidUID, uid)
+			return
+		}
+	}
 
 	frames := dicom.Get("NumberOfFrames").Value
 	if frames != "" {
 		dicom.NumberOfFrames, _ = strconv.Atoi(frames)
 	}
 
+	dicom.Rows, _ = strconv.Atoi(dicom.Get("Rows").Value)
+	dicom.Columns, _ = strconv.Atoi(dicom.Get("Columns").Value)
+
 	return
 }
 
@@ -95,37 +134,108 @@ func (d Dicom) InstanceKey() string {
 }
 
 func (d *Dicom) ExtractFirst() error {
+	return d.ExtractFrame(1)
+}
+
+// ExtractFrame renders frame n, counting from 1, to InstanceKey() as a
+// jpeg.
+func (d *Dicom) ExtractFrame(n int) error {
+	return d.ExtractFrameAs(n, "jpeg")
+}
+
+// ExtractFrameAs renders frame n as format, either jpeg or the lossless
+// png. DOC instances are always rendered to a pdf.
+func (d *Dicom) ExtractFrameAs(n int, format string) error {
+	if n < 1 || (n > 1 && n > d.NumberOfFrames) {
+		return ErrFrameOutOfRange
+	}
+
 	root := d.SeriesKey()
 	if err := os.MkdirAll(root, 0777); err != nil {
 		return err
 	}
 
-	if d.Modality == "CT" {
-		dcmj2pnm := exec.Command("dcmj2pnm", "--conv-guess-lossy", "--write-jpeg", "+Ww", d.WindowCenter, d.WindowWidth, d.Path, d.InstanceKey())
-		output, err := dcmj2pnm.CombinedOutput()
-		if err != nil {
-			log.Printf("dcmj2pnm error\n%s\n", string(output))
-			return err
-		}
-	} else if d.Modality == "DOC" {
+	if d.Modality == "DOC" {
 		dcm2pdf := exec.Command("dcm2pdf", d.Path, d.InstanceKey())
-		output, err := dcm2pdf.CombinedOutput()
+		output, err := metrics.CombinedOutput(dcm2pdf, d.Modality)
 		if err != nil {
 			log.Printf("dcm2pdf error\n%s\n", string(output))
 			return err
 		}
-	} else {
-		dcmj2pnm := exec.Command("dcmj2pnm", "--conv-guess-lossy", "--write-jpeg", d.Path, d.InstanceKey())
-		output, err := dcmj2pnm.CombinedOutput()
-		if err != nil {
-			log.Printf("dcmj2pnm error\n%s\n", string(output))
-			return err
-		}
+
+		return nil
+	}
+
+	write := "--write-jpeg"
+	if format == "png" {
+		write = "--write-png"
+	}
+
+	args := []string{"--conv-guess-lossy", write, "--frame", strconv.Itoa(n)}
+	args = append(args, d.windowArgs()...)
+	args = append(args, d.Path, d.InstanceKey())
+
+	dcmj2pnm := exec.Command("dcmj2pnm", args...)
+	output, err := metrics.CombinedOutput(dcmj2pnm, d.Modality)
+	if err != nil {
+		log.Printf("dcmj2pnm error\n%s\n", string(output))
+		return err
 	}
 
 	return nil
 }
 
+// SetWindow overrides the window the instance carries. It is applied when
+// rendering any grayscale image, whatever the modality.
+func (d *Dicom) SetWindow(center, width string) {
+	d.WindowCenter = center
+	d.WindowWidth = width
+	d.windowOverride = true
+}
+
+// IsGrayscale reports whether the pixel data is MONOCHROME1 or MONOCHROME2,
+// the only photometric interpretations a window applies to.
+func (d Dicom) IsGrayscale() bool {
+	if d.Photometric == "" {
+		return d.Modality == "CT"
+	}
+
+	return strings.HasPrefix(strings.TrimSpace(d.Photometric), "MONOCHROME")
+}
+
+// windowArgs applies an overridden window to any grayscale image. The
+// instance's own window is only applied to CT, as it always has been, so
+// that derivatives already in the cache match new renders.
+func (d Dicom) windowArgs() []string {
+	if !d.IsGrayscale() || (!d.windowOverride && d.Modality != "CT") {
+		return nil
+	}
+
+	center := firstValue(d.WindowCenter)
+	width := firstValue(d.WindowWidth)
+	if center == "" || width == "" {
+		return nil
+	}
+
+	return []string{"+Ww", center, width}
+}
+
+// Window is the window a render applies, empty when it applies none.
+func (d Dicom) Window() (center, width string) {
+	args := d.windowArgs()
+	if args == nil {
+		return "", ""
+	}
+
+	return args[1], args[2]
+}
+
+// firstValue returns the first of a multi-valued element, e.g. the 40 in
+// a WindowCenter of `40\400`.
+func firstValue(value string) string {
+	return strings.TrimSpace(strings.Split(value, "\\")[0])
+}
+
 func (d *Dicom) Extract() error {
 	if d.extractedFrames {
 		return nil
@@ -137,15 +247,18 @@ func (d *Dicom) Extract() error {
 	}
 
 	if d.Modality == "CT" {
-		dcmj2pnm := exec.Command("dcmj2pnm", "--all-frames", "--write-jpeg", "+Ww", d.WindowCenter, d.WindowWidth, d.Path, d.InstanceKey())
-		output, err := dcmj2pnm.CombinedOutput()
+		args := append([]string{"--all-frames", "--write-jpeg"}, d.windowArgs()...)
+		args = append(args, d.Path, d.InstanceKey())
+
+		dcmj2pnm := exec.Command("dcmj2pnm", args...)
+		output, err := metrics.CombinedOutput(dcmj2pnm, d.Modality)
 		if err != nil {
 			log.Printf("dcmj2pnm error\n%s\n", string(output))
 			return err
 		}
 	} else if d.Modality == "DOC" {
 		dcm2pdf := exec.Command("dcm2pdf", d.Path, d.InstanceKey())
-		output, err := dcm2pdf.CombinedOutput()
+		output, err := metrics.CombinedOutput(dcm2pdf, d.Modality)
 		if err != nil {
 			log.Printf("dcm2pdf error\n%s\n", string(output))
 			return err
@@ -158,19 +271,20 @@ func (d *Dicom) Extract() error {
 			w.Add(1)
 
 			go func(start int) {
-				dcmj2pnm := exec.Command(
-					"dcmj2pnm",
+				args := []string{
 					"--write-jpeg",
 					"--conv-guess-lossy",
 					"--use-frame-number",
 					"--frame-range",
 					fmt.Sprintf("%d", start),
 					fmt.Sprintf("%d", batchSize),
-					d.Path,
-					d.InstanceKey(),
-				)
+				}
+				args = append(args, d.windowArgs()...)
+				args = append(args, d.Path, d.InstanceKey())
+
+				dcmj2pnm := exec.Command("dcmj2pnm", args...)
 
-				output, err := dcmj2pnm.CombinedOutput()
+				output, err := metrics.CombinedOutput(dcmj2pnm, d.Modality)
 				if err != nil {
 					log.Printf("dcmj2pnm error\n%s\n", string(output))
 				}
@@ -198,7 +312,7 @@ func (d *Dicom) Extract() error {
 func (d *Dicom) ExtractAttributes() error {
 	dcm2xml := exec.Command("dcm2xml", d.Path)
 
-	output, err := dcm2xml.CombinedOutput()
+	output, err := metrics.CombinedOutput(dcm2xml, d.Modality)
 	if err != nil {
 		log.Printf("dcm2xml error\n%s\n", string(output))
 		return err
@@ -220,6 +334,7 @@ func (d *Dicom) ExtractAttributes() error {
 		d.Elements = append(d.Elements, element)
 	}
 
+	d.Sequences = dcm.DataSet.Sequences
 	return nil
 }
 
@@ -247,17 +362,20 @@ type Sequence struct {
 	Card  int    `xml:"card,attr"`
 	Name  string `xml:"name,attr"`
 	Tag   string `xml:"tag,attr"`
-	Vr    int    `xml:"vr,attr"`
-	Items []struct {
-		Elements []Element `xml:"element"`
-	} `xml:"item"`
+	Vr    string `xml:"vr,attr"`
+	Items []Item `xml:"item"`
+}
+
+type Item struct {
+	Elements  []Element  `xml:"element"`
+	Sequences []Sequence `xml:"sequence"`
 }
 
 type Element struct {
 	Name  string `xml:"name,attr"`
 	Len   int    `xml:"len,attr"`
 	Vm    int    `xml:"vm,attr"`
-	Vr    int    `xml:"vr,attr"`
+	Vr    string `xml:"vr,attr"`
 	Tag   string `xml:"tag,attr"`
 	Value string `xml:",chardata"`
 }
@@ -0,0 +1,32 @@
+package dicom
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidUID(t *testing.T) {
+	tests := []struct {
+		uid   string
+		valid bool
+	}{
+		{"1.2.840.10008.5.1.4.1.1.2", true},
+		{"2.25." + strings.Repeat("9", 59), true},
+		{"2.25." + strings.Repeat("9", 60), false},
+		{"1", true},
+		{"", false},
+		{"1..2", false},
+		{".1.2", false},
+		{"1.2.", false},
+		{"1.2.3 ", false},
+		{"1.2/../3", false},
+		{"../../etc/passwd", false},
+		{"1.2.3\x00", false},
+	}
+
+	for _, test := range tests {
+		if valid := ValidUID(test.uid); valid != test.valid {
+			t.Errorf("ValidUID(%q) = %v, want %v", test.uid, valid, test.valid)
+		}
+	}
+}
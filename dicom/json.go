@@ -0,0 +1,77 @@
+package dicom
+
+import (
+	"strconv"
+	"strings"
+)
+
+var (
+	binaryVRs = map[string]bool{
+		"OB": true, "OD": true, "OF": true, "OL": true, "OW": true, "UN": true, "SQ": true,
+	}
+
+	intVRs = map[string]bool{
+		"IS": true, "SL": true, "SS": true, "UL": true, "US": true,
+	}
+
+	floatVRs = map[string]bool{
+		"DS": true, "FL": true, "FD": true,
+	}
+)
+
+type JSONAttribute struct {
+	VR    string        `json:"vr"`
+	Value []interface{} `json:"Value,omitempty"`
+}
+
+type PersonName struct {
+	Alphabetic string `json:"Alphabetic"`
+}
+
+// JSON returns the data set in the DICOM JSON model (PS3.18 Annex F) keyed
+// by tag. File meta elements are left out and binary values are reported
+// without a Value.
+func (d Dicom) JSON() map[string]JSONAttribute {
+	attributes := make(map[string]JSONAttribute)
+
+	for _, element := range d.Elements {
+		tag := strings.ToUpper(strings.Replace(element.Tag, ",", "", 1))
+		if tag == "" || strings.HasPrefix(tag, "0002") {
+			continue
+		}
+
+		attribute := JSONAttribute{VR: element.Vr}
+		if !binaryVRs[element.Vr] && element.Value != "" {
+			attribute.Value = jsonValues(element.Vr, element.Value)
+		}
+
+		attributes[tag] = attribute
+	}
+
+	return attributes
+}
+
+func jsonValues(vr, value string) []interface{} {
+	values := []interface{}{}
+
+	for _, v := range strings.Split(value, "\\") {
+		v = strings.TrimSpace(v)
+
+		switch {
+		case vr == "PN":
+			values = append(values, PersonName{v})
+		case intVRs[vr]:
+			if n, err := strconv.Atoi(v); err == nil {
+				values = append(values, n)
+			}
+		case floatVRs[vr]:
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				values = append(values, f)
+			}
+		default:
+			values = append(values, v)
+		}
+	}
+
+	return values
+}
@@ -0,0 +1,107 @@
+package errs
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Kind classifies an error so that callers, mostly the http handlers, can
+// decide how to report it without inspecting driver specific errors.
+type Kind int
+
+const (
+	Unknown Kind = iota
+	NotFound
+	InvalidID
+	Unavailable
+	ConversionFailed
+	Timeout
+	Unauthorized
+	Forbidden
+	Invalid
+	NotAcceptable
+	UnsupportedMediaType
+	TooLarge
+)
+
+var kindNames = map[Kind]string{
+	Unknown:              "unknown",
+	NotFound:             "not_found",
+	InvalidID:            "invalid_id",
+	Unavailable:          "upstream_unavailable",
+	ConversionFailed:     "conversion_failed",
+	Timeout:              "timeout",
+	Unauthorized:         "unauthorized",
+	Forbidden:            "forbidden",
+	Invalid:              "invalid",
+	NotAcceptable:        "not_acceptable",
+	UnsupportedMediaType: "unsupported_media_type",
+	TooLarge:             "too_large",
+}
+
+func (k Kind) String() string {
+	if name, ok := kindNames[k]; ok {
+		return name
+	}
+
+	return kindNames[Unknown]
+}
+
+// ParseKind is the inverse of Kind.String, it is used to carry kinds across
+// the job queue.
+func ParseKind(s string) Kind {
+	for kind, name := range kindNames {
+		if name == s {
+			return kind
+		}
+	}
+
+	return Unknown
+}
+
+type Error struct {
+	Kind Kind
+	Op   string
+	Err  error
+}
+
+func (e *Error) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("%s: %s", e.Op, e.Kind)
+	}
+
+	return fmt.Sprintf("%s: %v", e.Op, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// E wraps err with a kind and the operation that failed. Errors that
+// already carry a kind keep it.
+func E(kind Kind, op string, err error) error {
+	if KindOf(err) != Unknown {
+		return &Error{KindOf(err), op, err}
+	}
+
+	return &Error{kind, op, err}
+}
+
+// Errorf is shorthand for E(kind, op, fmt.Errorf(format, args...)).
+func Errorf(kind Kind, op string, format string, args ...interface{}) error {
+	return &Error{kind, op, fmt.Errorf(format, args...)}
+}
+
+// KindOf returns the kind of the outermost *Error in err's chain.
+func KindOf(err error) Kind {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Kind
+	}
+
+	return Unknown
+}
+
+func Is(err error, kind Kind) bool {
+	return KindOf(err) == kind
+}
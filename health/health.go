@@ -0,0 +1,134 @@
+package health
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/nerdyworm/sess/queue"
+	"github.com/nerdyworm/sess/repos"
+	"github.com/nerdyworm/sess/storage"
+)
+
+const checkTimeout = 5 * time.Second
+
+// Tools are the external programs conversions shell out to.
+var Tools = []string{"dcm2xml", "dcmj2pnm", "convert", "composite", "identify", "dcmodify", "ffmpeg"}
+
+type Check struct {
+	Name string
+	Fn   func() error
+}
+
+type Result struct {
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+}
+
+type Report struct {
+	Status       string            `json:"status"`
+	Dependencies map[string]Result `json:"dependencies,omitempty"`
+}
+
+// Dependencies are the checks a process has to pass before it can take
+// traffic.
+func Dependencies() []Check {
+	checks := []Check{
+		{"mongo", repos.Ping},
+		{"amqp", queue.Ping},
+		{"storage.cache", func() error { return storage.Ping(storage.Cache) }},
+		{"storage.primary", func() error { return storage.Ping(storage.Primary) }},
+	}
+
+	for _, tool := range Tools {
+		tool := tool
+		checks = append(checks, Check{"tool." + tool, func() error {
+			_, err := exec.LookPath(tool)
+			return err
+		}})
+	}
+
+	return checks
+}
+
+// Liveness only tells the orchestrator that the process is serving http.
+func Liveness(w http.ResponseWriter, r *http.Request) {
+	writeReport(w, http.StatusOK, Report{Status: "ok"})
+}
+
+// Readiness runs every dependency check and answers 503 when any of them
+// fail.
+func Readiness(w http.ResponseWriter, r *http.Request) {
+	report := Run(Dependencies())
+
+	status := http.StatusOK
+	if report.Status != "ok" {
+		status = http.StatusServiceUnavailable
+	}
+
+	writeReport(w, status, report)
+}
+
+// Run runs checks concurrently, giving each of them checkTimeout.
+func Run(checks []Check) Report {
+	report := Report{Status: "ok", Dependencies: make(map[string]Result)}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	for _, check := range checks {
+		wg.Add(1)
+
+		go func(check Check) {
+			defer wg.Done()
+
+			result := run(check)
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			report.Dependencies[check.Name] = result
+			if result.Status != "ok" {
+				report.Status = "unavailable"
+			}
+		}(check)
+	}
+
+	wg.Wait()
+	return report
+}
+
+func run(check Check) Result {
+	start := time.Now()
+	done := make(chan error, 1)
+
+	go func() {
+		done <- check.Fn()
+	}()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-time.After(checkTimeout):
+		err = fmt.Errorf("timed out after %v", checkTimeout)
+	}
+
+	result := Result{Status: "ok", Duration: time.Since(start).String()}
+	if err != nil {
+		result.Status = "unavailable"
+		result.Error = err.Error()
+	}
+
+	return result
+}
+
+func writeReport(w http.ResponseWriter, status int, report Report) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(report)
+}
@@ -1,36 +1,63 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
 	"log"
 	"os"
+	"time"
 
 	"github.com/codegangsta/cli"
 	"github.com/nerdyworm/sess/app"
+	"github.com/nerdyworm/sess/audit"
+	"github.com/nerdyworm/sess/config"
+	"github.com/nerdyworm/sess/conversions"
+	"github.com/nerdyworm/sess/dicom"
+	"github.com/nerdyworm/sess/models"
 	"github.com/nerdyworm/sess/queue"
 	"github.com/nerdyworm/sess/repos"
+	"github.com/nerdyworm/sess/signing"
+	"github.com/nerdyworm/sess/storage"
 	"github.com/nerdyworm/sess/workers"
 )
 
+var (
+	cfg config.Config
+)
+
 func main() {
 	log.SetFlags(log.Lshortfile)
 
-	repos.Setup()
-	defer repos.Shutdown()
-
-	queue.Setup()
-	defer queue.Shutdown()
-
-	app.Setup()
-
 	a := cli.NewApp()
 	a.Name = "web"
 	a.Usage = "run web server"
+	a.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:   "config",
+			Usage:  "path to a json config file, environment variables override it",
+			EnvVar: "SESS_CONFIG",
+		},
+	}
+	a.Before = func(c *cli.Context) error {
+		var err error
+
+		cfg, err = config.Load(c.GlobalString("config"))
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		signing.Setup(cfg.Signing)
+		return nil
+	}
 	a.Commands = []cli.Command{
 		cli.Command{
 			Name:        "web",
 			Description: "run http server",
 			Action: func(c *cli.Context) {
-				app.Run()
+				setupServices()
+				defer shutdownServices()
+
+				app.Run(cfg.HTTP)
 			},
 		},
 
@@ -38,10 +65,206 @@ func main() {
 			Name:        "workers",
 			Description: "run workers",
 			Action: func(c *cli.Context) {
-				workers.Run()
+				setupServices()
+				defer shutdownServices()
+
+				workers.Run(cfg.Workers)
+			},
+		},
+
+		cli.Command{
+			Name:        "sign-url",
+			Usage:       "sign-url [--expires 24h] /cdn/v1/studies/{study_id}/instances/{instance_id}.jpg?size=200",
+			Description: "print a signed, expiring url that can be used without a session",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "expires",
+					Value: "24h",
+					Usage: "how long the url is valid for",
+				},
+			},
+			Action: func(c *cli.Context) {
+				if len(c.Args()) != 1 {
+					log.Fatal("sign-url expects exactly one url")
+				}
+
+				ttl, err := time.ParseDuration(c.String("expires"))
+				if err != nil {
+					log.Fatal(err)
+				}
+
+				signed, err := signing.Default.Sign(c.Args()[0], time.Now().Add(ttl))
+				if err != nil {
+					log.Fatal(err)
+				}
+
+				fmt.Println(signed)
+			},
+		},
+
+		cli.Command{
+			Name:  "cache",
+			Usage: "manage the derivative cache",
+			Subcommands: []cli.Command{
+				cli.Command{
+					Name:        "purge",
+					Usage:       "purge [--instance id] [--study id] [--account id]",
+					Description: "delete every cached derivative of an instance, study or account",
+					Flags: []cli.Flag{
+						cli.StringFlag{Name: "instance", Usage: "instance id"},
+						cli.StringFlag{Name: "study", Usage: "study id"},
+						cli.StringFlag{Name: "account", Usage: "account id"},
+					},
+					Action: func(c *cli.Context) {
+						storage.Setup(cfg.Storage)
+						repos.Setup(cfg.Mongo)
+						defer repos.Shutdown()
+
+						result, err := app.Purge(app.PurgeRequest{
+							InstanceID: c.String("instance"),
+							StudyID:    c.String("study"),
+							AccountID:  c.String("account"),
+						})
+						if err != nil {
+							log.Fatal(err)
+						}
+
+						fmt.Printf("deleted %d, %d already gone\n", result.Deleted, result.Missing)
+					},
+				},
+				cli.Command{
+					Name:        "gc",
+					Usage:       "gc",
+					Description: "evict what the disk cache's max size and age do not allow, once",
+					Action: func(c *cli.Context) {
+						storage.Setup(cfg.Storage)
+
+						result, err := storage.SweepCache()
+						if err != nil {
+							log.Fatal(err)
+						}
+
+						fmt.Printf("evicted %d (%d bytes), %d left (%d bytes)\n", result.Evicted, result.EvictedBytes, result.Entries, result.Bytes)
+					},
+				},
+			},
+		},
+
+		cli.Command{
+			Name:  "audit",
+			Usage: "inspect the access audit log",
+			Subcommands: []cli.Command{
+				cli.Command{
+					Name:        "query",
+					Usage:       "query [--user id] [--patient id] [--account id] [--instance id] [--from 2006-01-02] [--to 2006-01-02] [--limit 100] [--offset 0]",
+					Description: "print matching audit events, oldest first, one json object per line",
+					Flags: []cli.Flag{
+						cli.StringFlag{Name: "user", Usage: "user id"},
+						cli.StringFlag{Name: "patient", Usage: "patient id"},
+						cli.StringFlag{Name: "account", Usage: "account id"},
+						cli.StringFlag{Name: "instance", Usage: "instance id"},
+						cli.StringFlag{Name: "from", Usage: "earliest event, a date or an RFC 3339 time"},
+						cli.StringFlag{Name: "to", Usage: "events before this date or RFC 3339 time"},
+						cli.IntFlag{Name: "limit", Value: repos.DefaultLimit, Usage: "max events to print"},
+						cli.IntFlag{Name: "offset", Usage: "matching events to skip"},
+					},
+					Action: func(c *cli.Context) {
+						from, err := parseTime(c.String("from"))
+						if err != nil {
+							log.Fatal(err)
+						}
+
+						to, err := parseTime(c.String("to"))
+						if err != nil {
+							log.Fatal(err)
+						}
+
+						searcher, err := audit.OpenSearcher(cfg.Audit)
+						if err != nil {
+							log.Fatal(err)
+						}
+
+						if cfg.Audit.Sink == "mongo" {
+							repos.Setup(cfg.Mongo)
+							defer repos.Shutdown()
+						}
+
+						events, err := searcher.Search(repos.AuditQuery{
+							UserID:     c.String("user"),
+							PatientID:  c.String("patient"),
+							AccountID:  c.String("account"),
+							InstanceID: c.String("instance"),
+							From:       from,
+							To:         to,
+							Page:       repos.Page{Limit: c.Int("limit"), Offset: c.Int("offset")},
+						})
+						if err != nil {
+							log.Fatal(err)
+						}
+
+						printEvents(events)
+					},
+				},
+			},
+		},
+
+		cli.Command{
+			Name:  "config",
+			Usage: "inspect configuration",
+			Subcommands: []cli.Command{
+				cli.Command{
+					Name:        "print",
+					Description: "print the effective config with secrets redacted",
+					Action: func(c *cli.Context) {
+						b, err := json.MarshalIndent(cfg.Redacted(), "", "  ")
+						if err != nil {
+							log.Fatal(err)
+						}
+
+						fmt.Println(string(b))
+					},
+				},
 			},
 		},
 	}
 
 	a.Run(os.Args)
 }
+
+func setupServices() {
+	dicom.Setup(cfg.DICOM)
+	conversions.Setup(cfg.Convert)
+	storage.Setup(cfg.Storage)
+	storage.StartSweeper()
+	repos.Setup(cfg.Mongo)
+	queue.Setup(cfg.AMQP)
+	audit.Setup(cfg.Audit)
+	app.Setup(cfg)
+}
+
+func shutdownServices() {
+	audit.Shutdown()
+	queue.Shutdown()
+	repos.Shutdown()
+}
+
+// parseTime accepts a bare date, taken as midnight UTC, or an RFC 3339
+// time. An empty string is the zero time.
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+
+	return time.Parse(time.RFC3339, s)
+}
+
+func printEvents(events []*models.AuditEvent) {
+	encoder := json.NewEncoder(os.Stdout)
+	for _, event := range events {
+		encoder.Encode(event)
+	}
+}
@@ -0,0 +1,136 @@
+package metrics
+
+import (
+	"net/http"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/nerdyworm/sess/errs"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	HTTPRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sess_http_requests_total",
+		Help: "HTTP requests by route, method and status code.",
+	}, []string{"route", "method", "code"})
+
+	HTTPDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "sess_http_request_duration_seconds",
+		Help:    "HTTP request latency by route and method.",
+		Buckets: []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 90},
+	}, []string{"route", "method"})
+
+	CacheLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sess_cache_lookups_total",
+		Help: "Derivative cache Exists calls by result, one of hit, miss or error.",
+	}, []string{"result"})
+
+	CacheBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "sess_cache_bytes",
+		Help: "Bytes held by the disk cache as of its last sweep.",
+	})
+
+	CacheEntries = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "sess_cache_entries",
+		Help: "Derivatives held by the disk cache as of its last sweep.",
+	})
+
+	CacheEvictions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sess_cache_evictions_total",
+		Help: "Derivatives evicted from the disk cache by reason, age or size.",
+	}, []string{"reason"})
+
+	CacheTierReads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sess_cache_tier_reads_total",
+		Help: "Tiered cache reads by the tier that answered them.",
+	}, []string{"tier"})
+
+	PublishWait = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "sess_job_publish_wait_seconds",
+		Help:    "Time from publishing a job to receiving its reply.",
+		Buckets: []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 90},
+	}, []string{"job", "outcome"})
+
+	JobDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "sess_job_duration_seconds",
+		Help:    "Time workers spend processing a job.",
+		Buckets: []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 90},
+	}, []string{"job", "outcome"})
+
+	JobRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sess_job_retries_total",
+		Help: "Jobs put back on the queue for another try.",
+	}, []string{"job"})
+
+	JobFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sess_job_failures_total",
+		Help: "Jobs that failed after their last try.",
+	}, []string{"job", "kind"})
+
+	ExecDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "sess_exec_duration_seconds",
+		Help:    "Run time of dcmtk, ImageMagick and ffmpeg commands.",
+		Buckets: []float64{.01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"tool", "modality", "outcome"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		HTTPRequests,
+		HTTPDuration,
+		CacheLookups,
+		CacheBytes,
+		CacheEntries,
+		CacheEvictions,
+		CacheTierReads,
+		PublishWait,
+		JobDuration,
+		JobRetries,
+		JobFailures,
+		ExecDuration,
+	)
+}
+
+// Handler serves the registered metrics in the prometheus text format.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+func ObserveRequest(route, method string, code int, elapsed time.Duration) {
+	HTTPRequests.WithLabelValues(route, method, strconv.Itoa(code)).Inc()
+	HTTPDuration.WithLabelValues(route, method).Observe(elapsed.Seconds())
+}
+
+// Outcome labels err as ok, or by its errs kind.
+func Outcome(err error) string {
+	if err == nil {
+		return "ok"
+	}
+
+	return errs.KindOf(err).String()
+}
+
+// CombinedOutput runs cmd and records how long it took, labeled by the
+// tool and the modality of the instance it was run for.
+func CombinedOutput(cmd *exec.Cmd, modality string) ([]byte, error) {
+	if modality == "" {
+		modality = "unknown"
+	}
+
+	start := time.Now()
+	output, err := cmd.CombinedOutput()
+
+	outcome := "ok"
+	if err != nil {
+		outcome = "error"
+	}
+
+	tool := filepath.Base(cmd.Path)
+	ExecDuration.WithLabelValues(tool, modality, outcome).Observe(time.Since(start).Seconds())
+
+	return output, err
+}
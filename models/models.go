@@ -1,6 +1,9 @@
 package models
 
-import "fmt"
+import (
+	"fmt"
+	"time"
+)
 
 type Account struct {
 	ID           string
@@ -10,6 +13,12 @@ type Account struct {
 
 type AccountSettings struct {
 	LogoPosition string
+	// WindowPresets names the window preset rendered by default for a
+	// modality, e.g. "CT": "abdomen".
+	WindowPresets map[string]string
+	// Annotations are the text/template overlays drawn in each corner,
+	// keyed by the same positions as LogoPosition.
+	Annotations map[string]string
 }
 
 // XXX - branding logos need to be migrated to
@@ -25,20 +34,115 @@ type User struct {
 }
 
 type Study struct {
-	ID        string
-	AccountID string
+	ID                string
+	AccountID         string
+	StudyInstanceUID  string
+	PatientID         string
+	PatientName       string
+	StudyDate         string
+	AccessionNumber   string
+	StudyDescription  string
+	ModalitiesInStudy []string
+}
+
+// Series is not stored on its own, it is rolled up from the instances that
+// share a SeriesInstanceUID.
+type Series struct {
+	AccountID         string
+	StudyInstanceUID  string
+	SeriesInstanceUID string
+	Modality          string
+	SeriesNumber      int
+	SeriesDescription string
+	NumberOfInstances int
 }
 
 type Instance struct {
-	ID             string
-	AccountID      string
-	SOPInstanceUID string
+	ID                string
+	AccountID         string
+	StudyInstanceUID  string
+	SeriesInstanceUID string
+	SOPInstanceUID    string
+	SOPClassUID       string
+	Modality          string
+	SeriesNumber      int
+	SeriesDescription string
+	InstanceNumber    int
+	// PatientID is empty for instances recorded before it was kept on
+	// them, their study has it.
+	PatientID string
 }
 
 func (i Instance) Key() string {
 	return i.SOPInstanceUID
 }
 
+const (
+	ConversionQueued  = "queued"
+	ConversionRunning = "running"
+	ConversionDone    = "done"
+	ConversionFailed  = "failed"
+)
+
+// Conversion tracks an asynchronous conversion so that any web process can
+// report on it.
+type Conversion struct {
+	ID         string
+	AccountID  string
+	InstanceID string
+	JobName    string
+	Key        string
+	URL        string
+	Status     string
+	Error      string
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+}
+
+// Derivative indexes a cached conversion by what it was made from, so that
+// the cache can be purged when an instance, study or account changes.
+type Derivative struct {
+	Key              string
+	AccountID        string
+	StudyInstanceUID string
+	InstanceID       string
+	CreatedAt        time.Time
+}
+
+// Waiter is a job deferred behind another worker's conversion of the same
+// key, the holder of the key's lock replies to it when it is done.
+type Waiter struct {
+	JobID         string
+	ReplyTo       string
+	CorrelationID string
+}
+
+const (
+	AuditServed      = "served"
+	AuditNotModified = "not_modified"
+)
+
+// AuditEvent records one response that disclosed patient data. Requests
+// made with a signed url have no user, SigningKey names the key that
+// signed it instead.
+type AuditEvent struct {
+	ID               string    `json:"id,omitempty"`
+	Time             time.Time `json:"time"`
+	RequestID        string    `json:"request_id"`
+	UserID           string    `json:"user_id,omitempty"`
+	SigningKey       string    `json:"signing_key,omitempty"`
+	AccountID        string    `json:"account_id"`
+	InstanceID       string    `json:"instance_id"`
+	StudyInstanceUID string    `json:"study_instance_uid"`
+	PatientID        string    `json:"patient_id,omitempty"`
+	Derivative       string    `json:"derivative"`
+	ClientIP         string    `json:"client_ip"`
+	Method           string    `json:"method"`
+	Path             string    `json:"path"`
+	Status           int       `json:"status"`
+	Outcome          string    `json:"outcome"`
+}
+
 func IsUserInAccount(user *User, accountId string) bool {
 	for _, id := range user.AccountIds {
 		if id == accountId {
@@ -1,6 +1,9 @@
 package repos
 
 import (
+	"sync"
+	"time"
+
 	"github.com/nerdyworm/sess/models"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
@@ -21,29 +24,37 @@ type mongoAccountsRepo struct {
 }
 
 func NewMongoAccountsRepo(session *mgo.Session, db *mgo.Database) *mongoAccountsRepo {
-	domainsDb := session.DB("domains")
-	return &mongoAccountsRepo{session, domainsDb, domainsDb.C("domains")}
+	return &mongoAccountsRepo{session, db, db.C("domains")}
 }
 
 func (repo mongoAccountsRepo) FindByID(id string) (*models.Account, error) {
 	account := mongoAccount{}
 
-	err := repo.accounts.Find(bson.M{"_id": bson.ObjectIdHex(id)}).One(&account)
+	oid, err := objectID("Accounts.FindByID", id)
 	if err != nil {
 		return nil, err
 	}
 
+	err = repo.accounts.Find(bson.M{"_id": oid}).One(&account)
+	if err != nil {
+		return nil, findError("Accounts.FindByID", err)
+	}
+
 	return &models.Account{
 		ID:           account.Id.Hex(),
 		InternalName: account.DomainName,
 		Settings: models.AccountSettings{
-			LogoPosition: account.Settings.BrandingLogoAttachmentCorner,
+			LogoPosition:  account.Settings.BrandingLogoAttachmentCorner,
+			WindowPresets: account.Settings.DefaultWindowPresets,
+			Annotations:   account.Settings.Annotations,
 		},
 	}, nil
 }
 
 type mongoAccountSettings struct {
-	BrandingLogoAttachmentCorner string `bson:"branding_logo_attachment_corner"`
+	BrandingLogoAttachmentCorner string            `bson:"branding_logo_attachment_corner"`
+	DefaultWindowPresets         map[string]string `bson:"default_window_presets"`
+	Annotations                  map[string]string `bson:"annotations"`
 }
 
 type mongoAccount struct {
@@ -51,3 +62,66 @@ type mongoAccount struct {
 	DomainName string               `bson:"domain_name"`
 	Settings   mongoAccountSettings `bson:"domain_setting"`
 }
+
+// accountsCacheSize is how many accounts cachedAccountsRepo holds before it
+// sweeps out the expired ones.
+const accountsCacheSize = 1000
+
+// cachedAccountsRepo keeps accounts for a while, every rendered image needs
+// its account's settings and they change rarely. Changes are seen once the
+// entry expires.
+type cachedAccountsRepo struct {
+	AccountsRepo
+	ttl      time.Duration
+	mu       sync.Mutex
+	accounts map[string]cachedAccount
+}
+
+type cachedAccount struct {
+	account *models.Account
+	expires time.Time
+}
+
+func NewCachedAccountsRepo(repo AccountsRepo, ttl time.Duration) *cachedAccountsRepo {
+	return &cachedAccountsRepo{
+		AccountsRepo: repo,
+		ttl:          ttl,
+		accounts:     map[string]cachedAccount{},
+	}
+}
+
+func (repo *cachedAccountsRepo) FindByID(id string) (*models.Account, error) {
+	now := time.Now()
+
+	repo.mu.Lock()
+	cached, ok := repo.accounts[id]
+	repo.mu.Unlock()
+
+	if ok && now.Before(cached.expires) {
+		account := *cached.account
+		return &account, nil
+	}
+
+	account, err := repo.AccountsRepo.FindByID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	if len(repo.accounts) >= accountsCacheSize {
+		for k, cached := range repo.accounts {
+			if !now.Before(cached.expires) {
+				delete(repo.accounts, k)
+			}
+		}
+	}
+
+	if len(repo.accounts) < accountsCacheSize {
+		copied := *account
+		repo.accounts[id] = cachedAccount{&copied, now.Add(repo.ttl)}
+	}
+
+	return account, nil
+}
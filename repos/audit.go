@@ -0,0 +1,179 @@
+package repos
+
+import (
+	"log"
+	"time"
+
+	"github.com/nerdyworm/sess/models"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	AuditEvents AuditEventsRepo
+)
+
+type AuditEventsRepo interface {
+	Create(*models.AuditEvent) error
+	Search(AuditQuery) ([]*models.AuditEvent, error)
+}
+
+// AuditQuery filters audit events, every field that is set has to match.
+// Events are returned oldest first.
+type AuditQuery struct {
+	UserID     string
+	AccountID  string
+	PatientID  string
+	InstanceID string
+	From       time.Time
+	To         time.Time
+	Page
+}
+
+// Matches applies the query to a single event, for sinks that can only be
+// scanned.
+func (q AuditQuery) Matches(event *models.AuditEvent) bool {
+	switch {
+	case q.UserID != "" && event.UserID != q.UserID:
+		return false
+	case q.AccountID != "" && event.AccountID != q.AccountID:
+		return false
+	case q.PatientID != "" && event.PatientID != q.PatientID:
+		return false
+	case q.InstanceID != "" && event.InstanceID != q.InstanceID:
+		return false
+	case !q.From.IsZero() && event.Time.Before(q.From):
+		return false
+	case !q.To.IsZero() && !event.Time.Before(q.To):
+		return false
+	}
+
+	return true
+}
+
+type mongoAuditEventsRepo struct {
+	session *mgo.Session
+	db      *mgo.Database
+	events  *mgo.Collection
+}
+
+func NewMongoAuditEventsRepo(session *mgo.Session, db *mgo.Database) *mongoAuditEventsRepo {
+	repo := &mongoAuditEventsRepo{session, db, db.C("sess_audit_events")}
+
+	for _, key := range [][]string{{"user_id", "time"}, {"patient_id", "time"}, {"time"}} {
+		err := repo.events.EnsureIndexKey(key...)
+		if err != nil {
+			log.Printf("[AuditEvents][ERROR] ensuring index %v %v\n", key, err)
+		}
+	}
+
+	return repo
+}
+
+func (repo mongoAuditEventsRepo) Create(event *models.AuditEvent) error {
+	doc := mongoAuditEvent{
+		Id:               bson.NewObjectId(),
+		Time:             event.Time,
+		RequestID:        event.RequestID,
+		UserID:           event.UserID,
+		SigningKey:       event.SigningKey,
+		AccountID:        event.AccountID,
+		InstanceID:       event.InstanceID,
+		StudyInstanceUID: event.StudyInstanceUID,
+		PatientID:        event.PatientID,
+		Derivative:       event.Derivative,
+		ClientIP:         event.ClientIP,
+		Method:           event.Method,
+		Path:             event.Path,
+		Status:           event.Status,
+		Outcome:          event.Outcome,
+	}
+
+	err := repo.events.Insert(doc)
+	if err != nil {
+		return findError("AuditEvents.Create", err)
+	}
+
+	event.ID = doc.Id.Hex()
+	return nil
+}
+
+func (repo mongoAuditEventsRepo) Search(query AuditQuery) ([]*models.AuditEvent, error) {
+	filter := bson.M{}
+
+	if query.UserID != "" {
+		filter["user_id"] = query.UserID
+	}
+
+	if query.AccountID != "" {
+		filter["account_id"] = query.AccountID
+	}
+
+	if query.PatientID != "" {
+		filter["patient_id"] = query.PatientID
+	}
+
+	if query.InstanceID != "" {
+		filter["instance_id"] = query.InstanceID
+	}
+
+	if !query.From.IsZero() || !query.To.IsZero() {
+		times := bson.M{}
+		if !query.From.IsZero() {
+			times["$gte"] = query.From
+		}
+		if !query.To.IsZero() {
+			times["$lt"] = query.To
+		}
+		filter["time"] = times
+	}
+
+	docs := []mongoAuditEvent{}
+	err := repo.events.Find(filter).Sort("time").Skip(query.offset()).Limit(query.limit()).All(&docs)
+	if err != nil {
+		return nil, findError("AuditEvents.Search", err)
+	}
+
+	events := make([]*models.AuditEvent, 0, len(docs))
+	for _, doc := range docs {
+		events = append(events, &models.AuditEvent{
+			ID:               doc.Id.Hex(),
+			Time:             doc.Time,
+			RequestID:        doc.RequestID,
+			UserID:           doc.UserID,
+			SigningKey:       doc.SigningKey,
+			AccountID:        doc.AccountID,
+			InstanceID:       doc.InstanceID,
+			StudyInstanceUID: doc.StudyInstanceUID,
+			PatientID:        doc.PatientID,
+			Derivative:       doc.Derivative,
+			ClientIP:         doc.ClientIP,
+			Method:           doc.Method,
+			Path:             doc.Path,
+			Status:           doc.Status,
+			Outcome:          doc.Outcome,
+		})
+	}
+
+	return events, nil
+}
+
+// ids are kept as the hex strings the api uses, the events outlive the
+// documents they refer to.
+type mongoAuditEvent struct {
+	Id               bson.ObjectId `bson:"_id"`
+	Time             time.Time     `bson:"time"`
+	RequestID        string        `bson:"request_id"`
+	UserID           string        `bson:"user_id,omitempty"`
+	SigningKey       string        `bson:"signing_key,omitempty"`
+	AccountID        string        `bson:"account_id"`
+	InstanceID       string        `bson:"instance_id"`
+	StudyInstanceUID string        `bson:"study_instance_uid"`
+	PatientID        string        `bson:"patient_id,omitempty"`
+	Derivative       string        `bson:"derivative"`
+	ClientIP         string        `bson:"client_ip"`
+	Method           string        `bson:"method"`
+	Path             string        `bson:"path"`
+	Status           int           `bson:"status"`
+	Outcome          string        `bson:"outcome"`
+}
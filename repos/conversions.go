@@ -0,0 +1,127 @@
+package repos
+
+import (
+	"time"
+
+	"github.com/nerdyworm/sess/models"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	Conversions ConversionsRepo
+)
+
+type ConversionsRepo interface {
+	Create(*models.Conversion) error
+	FindByID(string) (*models.Conversion, error)
+	SetStatus(id, status, message string) error
+}
+
+type mongoConversionsRepo struct {
+	session     *mgo.Session
+	db          *mgo.Database
+	conversions *mgo.Collection
+}
+
+func NewMongoConversionsRepo(session *mgo.Session, db *mgo.Database) *mongoConversionsRepo {
+	return &mongoConversionsRepo{session, db, db.C("sess_conversions")}
+}
+
+func (repo mongoConversionsRepo) Create(conversion *models.Conversion) error {
+	op := "Conversions.Create"
+
+	accountID, err := objectID(op, conversion.AccountID)
+	if err != nil {
+		return err
+	}
+
+	instanceID, err := objectID(op, conversion.InstanceID)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	doc := mongoConversion{
+		Id:         bson.NewObjectId(),
+		DomainID:   accountID,
+		InstanceID: instanceID,
+		JobName:    conversion.JobName,
+		Key:        conversion.Key,
+		URL:        conversion.URL,
+		Status:     conversion.Status,
+		Error:      conversion.Error,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+
+	err = repo.conversions.Insert(doc)
+	if err != nil {
+		return findError(op, err)
+	}
+
+	conversion.ID = doc.Id.Hex()
+	conversion.CreatedAt = now
+	conversion.UpdatedAt = now
+	return nil
+}
+
+func (repo mongoConversionsRepo) FindByID(id string) (*models.Conversion, error) {
+	conversion := mongoConversion{}
+
+	oid, err := objectID("Conversions.FindByID", id)
+	if err != nil {
+		return nil, err
+	}
+
+	err = repo.conversions.Find(bson.M{"_id": oid}).One(&conversion)
+	if err != nil {
+		return nil, findError("Conversions.FindByID", err)
+	}
+
+	return &models.Conversion{
+		ID:         conversion.Id.Hex(),
+		AccountID:  conversion.DomainID.Hex(),
+		InstanceID: conversion.InstanceID.Hex(),
+		JobName:    conversion.JobName,
+		Key:        conversion.Key,
+		URL:        conversion.URL,
+		Status:     conversion.Status,
+		Error:      conversion.Error,
+		CreatedAt:  conversion.CreatedAt,
+		UpdatedAt:  conversion.UpdatedAt,
+	}, nil
+}
+
+func (repo mongoConversionsRepo) SetStatus(id, status, message string) error {
+	op := "Conversions.SetStatus"
+
+	oid, err := objectID(op, id)
+	if err != nil {
+		return err
+	}
+
+	err = repo.conversions.UpdateId(oid, bson.M{"$set": bson.M{
+		"status":     status,
+		"error":      message,
+		"updated_at": time.Now(),
+	}})
+	if err != nil {
+		return findError(op, err)
+	}
+
+	return nil
+}
+
+type mongoConversion struct {
+	Id         bson.ObjectId `bson:"_id"`
+	DomainID   bson.ObjectId `bson:"domain_id"`
+	InstanceID bson.ObjectId `bson:"instance_id"`
+	JobName    string        `bson:"job_name"`
+	Key        string        `bson:"key"`
+	URL        string        `bson:"url"`
+	Status     string        `bson:"status"`
+	Error      string        `bson:"error"`
+	CreatedAt  time.Time     `bson:"created_at"`
+	UpdatedAt  time.Time     `bson:"updated_at"`
+}
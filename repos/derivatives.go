@@ -0,0 +1,157 @@
+package repos
+
+import (
+	"log"
+	"time"
+
+	"github.com/nerdyworm/sess/errs"
+	"github.com/nerdyworm/sess/models"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	Derivatives DerivativesRepo
+)
+
+// DerivativesRepo indexes the cache keys produced for each instance. Cache
+// keys are opaque hashes, this is the only way back from an instance, a
+// study or an account to its derivatives.
+type DerivativesRepo interface {
+	Record(*models.Derivative) error
+	Find(DerivativeQuery) ([]models.Derivative, error)
+	Remove(keys []string) error
+}
+
+// DerivativeQuery selects derivatives by any combination of its fields, at
+// least one of which has to be set.
+type DerivativeQuery struct {
+	AccountID        string
+	StudyInstanceUID string
+	InstanceID       string
+}
+
+func (q DerivativeQuery) IsEmpty() bool {
+	return q.AccountID == "" && q.StudyInstanceUID == "" && q.InstanceID == ""
+}
+
+type mongoDerivativesRepo struct {
+	session     *mgo.Session
+	db          *mgo.Database
+	derivatives *mgo.Collection
+}
+
+func NewMongoDerivativesRepo(session *mgo.Session, db *mgo.Database) *mongoDerivativesRepo {
+	repo := &mongoDerivativesRepo{session, db, db.C("sess_derivatives")}
+
+	for _, key := range [][]string{{"instance_id"}, {"domain_id", "study_instance_uid"}} {
+		err := repo.derivatives.EnsureIndexKey(key...)
+		if err != nil {
+			log.Printf("[Derivatives][ERROR] ensuring index %v %v\n", key, err)
+		}
+	}
+
+	return repo
+}
+
+// Record upserts by key, a key that is produced again keeps a single entry.
+func (repo mongoDerivativesRepo) Record(derivative *models.Derivative) error {
+	op := "Derivatives.Record"
+
+	accountID, err := objectID(op, derivative.AccountID)
+	if err != nil {
+		return err
+	}
+
+	instanceID, err := objectID(op, derivative.InstanceID)
+	if err != nil {
+		return err
+	}
+
+	if derivative.CreatedAt.IsZero() {
+		derivative.CreatedAt = time.Now()
+	}
+
+	_, err = repo.derivatives.UpsertId(derivative.Key, mongoDerivative{
+		Key:              derivative.Key,
+		DomainID:         accountID,
+		StudyInstanceUID: derivative.StudyInstanceUID,
+		InstanceID:       instanceID,
+		CreatedAt:        derivative.CreatedAt,
+	})
+	if err != nil {
+		return findError(op, err)
+	}
+
+	return nil
+}
+
+func (repo mongoDerivativesRepo) Find(query DerivativeQuery) ([]models.Derivative, error) {
+	op := "Derivatives.Find"
+
+	if query.IsEmpty() {
+		return nil, errs.Errorf(errs.Invalid, op, "an instance, study or account is required")
+	}
+
+	filter := bson.M{}
+
+	if query.AccountID != "" {
+		accountID, err := objectID(op, query.AccountID)
+		if err != nil {
+			return nil, err
+		}
+		filter["domain_id"] = accountID
+	}
+
+	if query.InstanceID != "" {
+		instanceID, err := objectID(op, query.InstanceID)
+		if err != nil {
+			return nil, err
+		}
+		filter["instance_id"] = instanceID
+	}
+
+	if query.StudyInstanceUID != "" {
+		filter["study_instance_uid"] = query.StudyInstanceUID
+	}
+
+	docs := []mongoDerivative{}
+	err := repo.derivatives.Find(filter).All(&docs)
+	if err != nil {
+		return nil, findError(op, err)
+	}
+
+	derivatives := make([]models.Derivative, 0, len(docs))
+	for _, doc := range docs {
+		derivatives = append(derivatives, models.Derivative{
+			Key:              doc.Key,
+			AccountID:        doc.DomainID.Hex(),
+			StudyInstanceUID: doc.StudyInstanceUID,
+			InstanceID:       doc.InstanceID.Hex(),
+			CreatedAt:        doc.CreatedAt,
+		})
+	}
+
+	return derivatives, nil
+}
+
+func (repo mongoDerivativesRepo) Remove(keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	_, err := repo.derivatives.RemoveAll(bson.M{"_id": bson.M{"$in": keys}})
+	if err != nil {
+		return findError("Derivatives.Remove", err)
+	}
+
+	return nil
+}
+
+type mongoDerivative struct {
+	Key              string        `bson:"_id"`
+	DomainID         bson.ObjectId `bson:"domain_id"`
+	StudyInstanceUID string        `bson:"study_instance_uid"`
+	InstanceID       bson.ObjectId `bson:"instance_id"`
+	CreatedAt        time.Time     `bson:"created_at"`
+}
@@ -1,6 +1,7 @@
 package repos
 
 import (
+	"github.com/nerdyworm/sess/errs"
 	"github.com/nerdyworm/sess/models"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
@@ -12,6 +13,11 @@ var (
 
 type InstancesRepo interface {
 	FindByID(string) (*models.Instance, error)
+	FindByUID(accountIDs []string, studyUID, seriesUID, sopInstanceUID string) (*models.Instance, error)
+	OwnersOf(sopInstanceUID string) ([]string, error)
+	Search(InstanceQuery) ([]*models.Instance, error)
+	SearchSeries(SeriesQuery) ([]*models.Series, error)
+	Upsert(*models.Instance) error
 }
 
 type mongoInstancesRepo struct {
@@ -27,20 +33,256 @@ func NewMongoInstancesRepo(session *mgo.Session, db *mgo.Database) *mongoInstanc
 func (repo mongoInstancesRepo) FindByID(id string) (*models.Instance, error) {
 	instance := mongoInstance{}
 
-	err := repo.instances.Find(bson.M{"_id": bson.ObjectIdHex(id)}).One(&instance)
+	oid, err := objectID("Instances.FindByID", id)
 	if err != nil {
 		return nil, err
 	}
 
-	return &models.Instance{
-		ID:             instance.Id.Hex(),
-		AccountID:      instance.DomainID.Hex(),
-		SOPInstanceUID: instance.SOPInstanceUID,
-	}, nil
+	err = repo.instances.Find(bson.M{"_id": oid}).One(&instance)
+	if err != nil {
+		return nil, findError("Instances.FindByID", err)
+	}
+
+	return instance.toModel(), nil
+}
+
+// FindByUID looks the instance up in accountIDs. A nil accountIDs looks
+// in every account, which is only allowed to find one match: older data
+// may hold the same UIDs in more than one account.
+func (repo mongoInstancesRepo) FindByUID(accountIDs []string, studyUID, seriesUID, sopInstanceUID string) (*models.Instance, error) {
+	op := "Instances.FindByUID"
+
+	filter := bson.M{
+		"study_instance_uid":  studyUID,
+		"series_instance_uid": seriesUID,
+		"sop_instance_uid":    sopInstanceUID,
+	}
+
+	if accountIDs != nil {
+		accounts, err := accountsFilter(op, accountIDs)
+		if err != nil {
+			return nil, err
+		}
+
+		filter["domain_id"] = accounts
+	}
+
+	results := []mongoInstance{}
+	err := repo.instances.Find(filter).Sort("_id").Limit(2).All(&results)
+	if err != nil {
+		return nil, findError(op, err)
+	}
+
+	switch {
+	case len(results) == 0:
+		return nil, errs.Errorf(errs.NotFound, op, "instance `%s` not found", sopInstanceUID)
+	case len(results) > 1 && accountIDs == nil:
+		return nil, errs.Errorf(errs.Invalid, op, "instance `%s` is in more than one account", sopInstanceUID)
+	}
+
+	return results[0].toModel(), nil
+}
+
+// OwnersOf returns the ids of every account holding an instance with
+// sopInstanceUID. Originals are stored by SOPInstanceUID alone, so a UID
+// may only ever belong to one account.
+func (repo mongoInstancesRepo) OwnersOf(sopInstanceUID string) ([]string, error) {
+	ids := []bson.ObjectId{}
+
+	err := repo.instances.Find(bson.M{"sop_instance_uid": sopInstanceUID}).Distinct("domain_id", &ids)
+	if err != nil {
+		return nil, findError("Instances.OwnersOf", err)
+	}
+
+	owners := []string{}
+	for _, id := range ids {
+		owners = append(owners, id.Hex())
+	}
+
+	return owners, nil
+}
+
+func (repo mongoInstancesRepo) Search(query InstanceQuery) ([]*models.Instance, error) {
+	op := "Instances.Search"
+
+	accounts, err := accountsFilter(op, query.AccountIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	filter := bson.M{"domain_id": accounts}
+
+	if query.StudyInstanceUID != "" {
+		filter["study_instance_uid"] = query.StudyInstanceUID
+	}
+
+	if query.SeriesInstanceUID != "" {
+		filter["series_instance_uid"] = query.SeriesInstanceUID
+	}
+
+	if query.SOPInstanceUID != "" {
+		filter["sop_instance_uid"] = query.SOPInstanceUID
+	}
+
+	if query.Modality != "" {
+		filter["modality"] = query.Modality
+	}
+
+	results := []mongoInstance{}
+	err = repo.instances.Find(filter).
+		Sort("series_number", "instance_number", "_id").
+		Skip(query.offset()).
+		Limit(query.limit()).
+		All(&results)
+	if err != nil {
+		return nil, findError(op, err)
+	}
+
+	instances := []*models.Instance{}
+	for _, instance := range results {
+		instances = append(instances, instance.toModel())
+	}
+
+	return instances, nil
+}
+
+// SearchSeries rolls the matching instances up by SeriesInstanceUID.
+func (repo mongoInstancesRepo) SearchSeries(query SeriesQuery) ([]*models.Series, error) {
+	op := "Instances.SearchSeries"
+
+	accounts, err := accountsFilter(op, query.AccountIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	match := bson.M{"domain_id": accounts}
+
+	if query.StudyInstanceUID != "" {
+		match["study_instance_uid"] = query.StudyInstanceUID
+	}
+
+	if query.SeriesInstanceUID != "" {
+		match["series_instance_uid"] = query.SeriesInstanceUID
+	}
+
+	if query.Modality != "" {
+		match["modality"] = query.Modality
+	}
+
+	pipeline := []bson.M{
+		{"$match": match},
+		{"$group": bson.M{
+			"_id":                 "$series_instance_uid",
+			"domain_id":           bson.M{"$first": "$domain_id"},
+			"study_instance_uid":  bson.M{"$first": "$study_instance_uid"},
+			"modality":            bson.M{"$first": "$modality"},
+			"series_number":       bson.M{"$first": "$series_number"},
+			"series_description":  bson.M{"$first": "$series_description"},
+			"number_of_instances": bson.M{"$sum": 1},
+		}},
+		{"$sort": bson.D{{Name: "series_number", Value: 1}, {Name: "_id", Value: 1}}},
+		{"$skip": query.offset()},
+		{"$limit": query.limit()},
+	}
+
+	results := []mongoSeries{}
+	err = repo.instances.Pipe(pipeline).All(&results)
+	if err != nil {
+		return nil, findError(op, err)
+	}
+
+	series := []*models.Series{}
+	for _, s := range results {
+		series = append(series, &models.Series{
+			AccountID:         s.DomainID.Hex(),
+			StudyInstanceUID:  s.StudyInstanceUID,
+			SeriesInstanceUID: s.SeriesInstanceUID,
+			Modality:          s.Modality,
+			SeriesNumber:      s.SeriesNumber,
+			SeriesDescription: s.SeriesDescription,
+			NumberOfInstances: s.NumberOfInstances,
+		})
+	}
+
+	return series, nil
+}
+
+// Upsert creates or updates the instance with the same SOPInstanceUID in
+// the instance's account and sets instance.ID.
+func (repo mongoInstancesRepo) Upsert(instance *models.Instance) error {
+	op := "Instances.Upsert"
+
+	accountID, err := objectID(op, instance.AccountID)
+	if err != nil {
+		return err
+	}
+
+	change := mgo.Change{
+		Update: bson.M{
+			"$set": bson.M{
+				"study_instance_uid":  instance.StudyInstanceUID,
+				"series_instance_uid": instance.SeriesInstanceUID,
+				"sop_class_uid":       instance.SOPClassUID,
+				"modality":            instance.Modality,
+				"series_number":       instance.SeriesNumber,
+				"series_description":  instance.SeriesDescription,
+				"instance_number":     instance.InstanceNumber,
+				"patient_id":          instance.PatientID,
+			},
+		},
+		Upsert:    true,
+		ReturnNew: true,
+	}
+
+	result := mongoInstance{}
+	_, err = repo.instances.Find(bson.M{
+		"domain_id":        accountID,
+		"sop_instance_uid": instance.SOPInstanceUID,
+	}).Apply(change, &result)
+	if err != nil {
+		return findError(op, err)
+	}
+
+	instance.ID = result.Id.Hex()
+	return nil
 }
 
 type mongoInstance struct {
-	Id             bson.ObjectId `bson:"_id"`
-	DomainID       bson.ObjectId `bson:"domain_id"`
-	SOPInstanceUID string        `bson:"sop_instance_uid"`
+	Id                bson.ObjectId `bson:"_id"`
+	DomainID          bson.ObjectId `bson:"domain_id"`
+	StudyInstanceUID  string        `bson:"study_instance_uid"`
+	SeriesInstanceUID string        `bson:"series_instance_uid"`
+	SOPInstanceUID    string        `bson:"sop_instance_uid"`
+	SOPClassUID       string        `bson:"sop_class_uid"`
+	Modality          string        `bson:"modality"`
+	SeriesNumber      int           `bson:"series_number"`
+	SeriesDescription string        `bson:"series_description"`
+	InstanceNumber    int           `bson:"instance_number"`
+	PatientID         string        `bson:"patient_id"`
+}
+
+func (instance mongoInstance) toModel() *models.Instance {
+	return &models.Instance{
+		ID:                instance.Id.Hex(),
+		AccountID:         instance.DomainID.Hex(),
+		StudyInstanceUID:  instance.StudyInstanceUID,
+		SeriesInstanceUID: instance.SeriesInstanceUID,
+		SOPInstanceUID:    instance.SOPInstanceUID,
+		SOPClassUID:       instance.SOPClassUID,
+		Modality:          instance.Modality,
+		SeriesNumber:      instance.SeriesNumber,
+		SeriesDescription: instance.SeriesDescription,
+		InstanceNumber:    instance.InstanceNumber,
+		PatientID:         instance.PatientID,
+	}
+}
+
+type mongoSeries struct {
+	SeriesInstanceUID string        `bson:"_id"`
+	DomainID          bson.ObjectId `bson:"domain_id"`
+	StudyInstanceUID  string        `bson:"study_instance_uid"`
+	Modality          string        `bson:"modality"`
+	SeriesNumber      int           `bson:"series_number"`
+	SeriesDescription string        `bson:"series_description"`
+	NumberOfInstances int           `bson:"number_of_instances"`
 }
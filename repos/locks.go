@@ -0,0 +1,161 @@
+package repos
+
+import (
+	"time"
+
+	"github.com/nerdyworm/sess/models"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	Locks LocksRepo
+)
+
+// LocksRepo hands out expiring, cluster wide locks by name. Each lock is
+// held by an owner token, only the owner can renew or release it, and a
+// holder that dies without releasing its lock only blocks others until it
+// expires. Waiters queued on a lock are handed to whoever releases it, or
+// reaps it once it has expired without being taken over.
+type LocksRepo interface {
+	Acquire(name, owner string, ttl time.Duration) (bool, error)
+	Renew(name, owner string, ttl time.Duration) (bool, error)
+	Release(name, owner string) ([]models.Waiter, error)
+	Enqueue(name string, waiter models.Waiter) (bool, error)
+	Held(name string) (bool, error)
+	Reap(before time.Time) ([]models.Waiter, error)
+}
+
+type lockDocument struct {
+	ID        string          `bson:"_id"`
+	Owner     string          `bson:"owner"`
+	ExpiresAt time.Time       `bson:"expires_at"`
+	Waiters   []models.Waiter `bson:"waiters,omitempty"`
+}
+
+type mongoLocksRepo struct {
+	session *mgo.Session
+	db      *mgo.Database
+	locks   *mgo.Collection
+}
+
+func NewMongoLocksRepo(session *mgo.Session, db *mgo.Database) *mongoLocksRepo {
+	return &mongoLocksRepo{session, db, db.C("sess_locks")}
+}
+
+// Acquire takes the lock for owner when nobody holds it or its holder's
+// lease has expired. Waiters queued on an expired lock are kept, the new
+// owner answers them.
+func (repo mongoLocksRepo) Acquire(name, owner string, ttl time.Duration) (bool, error) {
+	op := "Locks.Acquire"
+	now := time.Now()
+
+	err := repo.locks.Insert(lockDocument{ID: name, Owner: owner, ExpiresAt: now.Add(ttl)})
+	if err == nil {
+		return true, nil
+	}
+
+	if !mgo.IsDup(err) {
+		return false, findError(op, err)
+	}
+
+	err = repo.locks.Update(
+		bson.M{"_id": name, "expires_at": bson.M{"$lt": now}},
+		bson.M{"$set": bson.M{"owner": owner, "expires_at": now.Add(ttl)}},
+	)
+	if err == mgo.ErrNotFound {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, findError(op, err)
+	}
+
+	return true, nil
+}
+
+// Renew extends owner's lease, it is false when the lock has been taken
+// over by someone else.
+func (repo mongoLocksRepo) Renew(name, owner string, ttl time.Duration) (bool, error) {
+	err := repo.locks.Update(
+		bson.M{"_id": name, "owner": owner},
+		bson.M{"$set": bson.M{"expires_at": time.Now().Add(ttl)}},
+	)
+	if err == mgo.ErrNotFound {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, findError("Locks.Renew", err)
+	}
+
+	return true, nil
+}
+
+// Release removes the lock if owner still holds it and returns the waiters
+// queued on it. A lock that was taken over is left to its new owner.
+func (repo mongoLocksRepo) Release(name, owner string) ([]models.Waiter, error) {
+	lock := lockDocument{}
+
+	_, err := repo.locks.Find(bson.M{"_id": name, "owner": owner}).Apply(mgo.Change{Remove: true}, &lock)
+	if err == mgo.ErrNotFound {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, findError("Locks.Release", err)
+	}
+
+	return lock.Waiters, nil
+}
+
+// Enqueue adds waiter to a lock that is held, it is false when nobody holds
+// the lock anymore. The lock document is updated atomically, so a waiter is
+// either queued before the release that hands it to the holder or not at
+// all.
+func (repo mongoLocksRepo) Enqueue(name string, waiter models.Waiter) (bool, error) {
+	err := repo.locks.Update(
+		bson.M{"_id": name, "expires_at": bson.M{"$gte": time.Now()}},
+		bson.M{"$push": bson.M{"waiters": waiter}},
+	)
+	if err == mgo.ErrNotFound {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, findError("Locks.Enqueue", err)
+	}
+
+	return true, nil
+}
+
+func (repo mongoLocksRepo) Held(name string) (bool, error) {
+	n, err := repo.locks.Find(bson.M{"_id": name, "expires_at": bson.M{"$gte": time.Now()}}).Count()
+	if err != nil {
+		return false, findError("Locks.Held", err)
+	}
+
+	return n > 0, nil
+}
+
+// Reap removes the locks that expired before before and returns the waiters
+// queued on them. Each lock is removed atomically, so its waiters go either
+// to the reaper or to an owner that took it over, never to both.
+func (repo mongoLocksRepo) Reap(before time.Time) ([]models.Waiter, error) {
+	waiters := []models.Waiter{}
+
+	for {
+		lock := lockDocument{}
+
+		_, err := repo.locks.Find(bson.M{"expires_at": bson.M{"$lt": before}}).Apply(mgo.Change{Remove: true}, &lock)
+		if err == mgo.ErrNotFound {
+			return waiters, nil
+		}
+
+		if err != nil {
+			return waiters, findError("Locks.Reap", err)
+		}
+
+		waiters = append(waiters, lock.Waiters...)
+	}
+}
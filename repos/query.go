@@ -0,0 +1,142 @@
+package repos
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/nerdyworm/sess/errs"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	DefaultLimit = 100
+	MaxLimit     = 1000
+)
+
+// Page limits the results of a search.
+type Page struct {
+	Limit  int
+	Offset int
+}
+
+func (p Page) limit() int {
+	if p.Limit <= 0 {
+		return DefaultLimit
+	}
+
+	if p.Limit > MaxLimit {
+		return MaxLimit
+	}
+
+	return p.Limit
+}
+
+func (p Page) offset() int {
+	if p.Offset < 0 {
+		return 0
+	}
+
+	return p.Offset
+}
+
+type StudyQuery struct {
+	AccountIDs       []string
+	StudyInstanceUID string
+	PatientID        string
+	PatientName      string
+	StudyDate        string
+	Modality         string
+	AccessionNumber  string
+	Page
+}
+
+type SeriesQuery struct {
+	AccountIDs        []string
+	StudyInstanceUID  string
+	SeriesInstanceUID string
+	Modality          string
+	Page
+}
+
+type InstanceQuery struct {
+	AccountIDs        []string
+	StudyInstanceUID  string
+	SeriesInstanceUID string
+	SOPInstanceUID    string
+	Modality          string
+	Page
+}
+
+// accountsFilter scopes a query to the given accounts. An empty list
+// matches nothing rather than everything.
+func accountsFilter(op string, accountIDs []string) (bson.M, error) {
+	ids := []bson.ObjectId{}
+
+	for _, id := range accountIDs {
+		oid, err := objectID(op, id)
+		if err != nil {
+			return nil, err
+		}
+
+		ids = append(ids, oid)
+	}
+
+	return bson.M{"$in": ids}, nil
+}
+
+// wildcard turns a DICOM matching value with * and ? into a case
+// insensitive regex, or returns the value as is when it has none.
+func wildcard(value string) interface{} {
+	if !strings.ContainsAny(value, "*?") {
+		return value
+	}
+
+	pattern := regexp.QuoteMeta(value)
+	pattern = strings.Replace(pattern, `\*`, ".*", -1)
+	pattern = strings.Replace(pattern, `\?`, ".", -1)
+
+	return bson.RegEx{Pattern: "^" + pattern + "$", Options: "i"}
+}
+
+// dateRange parses a DICOM date matching value, YYYYMMDD, YYYYMMDD-,
+// -YYYYMMDD or YYYYMMDD-YYYYMMDD.
+func dateRange(op, value string) (interface{}, error) {
+	if !strings.Contains(value, "-") {
+		if !isDate(value) {
+			return nil, errs.Errorf(errs.Invalid, op, "invalid date `%s`", value)
+		}
+
+		return value, nil
+	}
+
+	parts := strings.SplitN(value, "-", 2)
+	from, to := parts[0], parts[1]
+	if (from == "" && to == "") || (from != "" && !isDate(from)) || (to != "" && !isDate(to)) {
+		return nil, errs.Errorf(errs.Invalid, op, "invalid date range `%s`", value)
+	}
+
+	r := bson.M{}
+	if from != "" {
+		r["$gte"] = from
+	}
+
+	if to != "" {
+		r["$lte"] = to
+	}
+
+	return r, nil
+}
+
+func isDate(value string) bool {
+	if len(value) != 8 {
+		return false
+	}
+
+	for _, c := range value {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,55 @@
+package repos
+
+import (
+	"testing"
+
+	"github.com/nerdyworm/sess/errs"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestAccountsFilter(t *testing.T) {
+	a, b := bson.NewObjectId(), bson.NewObjectId()
+
+	tests := []struct {
+		name       string
+		accountIDs []string
+		want       []bson.ObjectId
+		err        errs.Kind
+	}{
+		{name: "nil matches nothing", accountIDs: nil, want: []bson.ObjectId{}},
+		{name: "empty matches nothing", accountIDs: []string{}, want: []bson.ObjectId{}},
+		{name: "accounts", accountIDs: []string{a.Hex(), b.Hex()}, want: []bson.ObjectId{a, b}},
+		{name: "invalid id", accountIDs: []string{a.Hex(), "nope"}, err: errs.InvalidID},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filter, err := accountsFilter("test", test.accountIDs)
+			if test.err != 0 {
+				if !errs.Is(err, test.err) {
+					t.Errorf("err = %v, want kind %v", err, test.err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ids, ok := filter["$in"].([]bson.ObjectId)
+			if !ok || len(filter) != 1 {
+				t.Fatalf("filter = %#v, want a single $in", filter)
+			}
+
+			if len(ids) != len(test.want) {
+				t.Fatalf("$in %v, want %v", ids, test.want)
+			}
+
+			for i := range ids {
+				if ids[i] != test.want[i] {
+					t.Errorf("$in %v, want %v", ids, test.want)
+				}
+			}
+		})
+	}
+}
@@ -2,8 +2,12 @@ package repos
 
 import (
 	"log"
+	"time"
 
+	"github.com/nerdyworm/sess/config"
+	"github.com/nerdyworm/sess/errs"
 	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
 )
 
 var (
@@ -11,21 +15,57 @@ var (
 	db      *mgo.Database
 )
 
-func Setup() {
+func Setup(cfg config.Mongo) {
 	var err error
 
-	session, err = mgo.Dial("localhost:27017")
+	session, err = mgo.Dial(cfg.URL)
 	if err != nil {
 		log.Fatal(err)
 	}
-	db := session.DB("curiecloud_development")
+	db := session.DB(cfg.Database)
+
+	Accounts = NewMongoAccountsRepo(session, session.DB(cfg.AccountsDatabase))
+	if ttl, _ := time.ParseDuration(cfg.AccountsCacheTTL); ttl > 0 {
+		Accounts = NewCachedAccountsRepo(Accounts, ttl)
+	}
 
-	Accounts = NewMongoAccountsRepo(session, db)
 	Users = NewMongoUsersRepo(session, db)
 	Studies = NewMongoStudiesRepo(session, db)
 	Instances = NewMongoInstancesRepo(session, db)
+	Conversions = NewMongoConversionsRepo(session, db)
+	Locks = NewMongoLocksRepo(session, db)
+	Derivatives = NewMongoDerivativesRepo(session, db)
+	AuditEvents = NewMongoAuditEventsRepo(session, db)
+}
+
+// Ping checks that mongo is reachable on a fresh socket, so a hung socket
+// in the shared session does not make every check wait on it.
+func Ping() error {
+	s := session.Copy()
+	defer s.Close()
+
+	return s.Ping()
 }
 
 func Shutdown() {
 	session.Close()
 }
+
+// objectID converts a hex id from a url or a payload into an ObjectId
+// without the panic that bson.ObjectIdHex raises on malformed input.
+func objectID(op, id string) (bson.ObjectId, error) {
+	if !bson.IsObjectIdHex(id) {
+		return "", errs.Errorf(errs.InvalidID, op, "invalid id `%s`", id)
+	}
+
+	return bson.ObjectIdHex(id), nil
+}
+
+// findError classifies an error returned by a mgo query.
+func findError(op string, err error) error {
+	if err == mgo.ErrNotFound {
+		return errs.E(errs.NotFound, op, err)
+	}
+
+	return errs.E(errs.Unavailable, op, err)
+}
@@ -12,6 +12,8 @@ var (
 
 type StudiesRepo interface {
 	FindByID(string) (*models.Study, error)
+	Search(StudyQuery) ([]*models.Study, error)
+	Upsert(*models.Study) error
 }
 
 type mongoStudiesRepo struct {
@@ -27,16 +29,142 @@ func NewMongoStudiesRepo(session *mgo.Session, db *mgo.Database) *mongoStudiesRe
 func (repo mongoStudiesRepo) FindByID(id string) (*models.Study, error) {
 	study := mongoStudy{}
 
-	err := repo.studies.Find(bson.M{"_id": bson.ObjectIdHex(id)}).One(&study)
+	oid, err := objectID("Studies.FindByID", id)
 	if err != nil {
 		return nil, err
 	}
 
-	return &models.Study{
-		ID: study.Id.Hex(),
-	}, nil
+	err = repo.studies.Find(bson.M{"_id": oid}).One(&study)
+	if err != nil {
+		return nil, findError("Studies.FindByID", err)
+	}
+
+	return study.toModel(), nil
+}
+
+func (repo mongoStudiesRepo) Search(query StudyQuery) ([]*models.Study, error) {
+	op := "Studies.Search"
+
+	accounts, err := accountsFilter(op, query.AccountIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	filter := bson.M{"domain_id": accounts}
+
+	if query.StudyInstanceUID != "" {
+		filter["study_instance_uid"] = query.StudyInstanceUID
+	}
+
+	if query.PatientID != "" {
+		filter["patient_id"] = wildcard(query.PatientID)
+	}
+
+	if query.PatientName != "" {
+		filter["patient_name"] = wildcard(query.PatientName)
+	}
+
+	if query.AccessionNumber != "" {
+		filter["accession_number"] = wildcard(query.AccessionNumber)
+	}
+
+	if query.Modality != "" {
+		filter["modalities_in_study"] = query.Modality
+	}
+
+	if query.StudyDate != "" {
+		filter["study_date"], err = dateRange(op, query.StudyDate)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	results := []mongoStudy{}
+	err = repo.studies.Find(filter).
+		Sort("-study_date", "_id").
+		Skip(query.offset()).
+		Limit(query.limit()).
+		All(&results)
+	if err != nil {
+		return nil, findError(op, err)
+	}
+
+	studies := []*models.Study{}
+	for _, study := range results {
+		studies = append(studies, study.toModel())
+	}
+
+	return studies, nil
+}
+
+// Upsert creates or updates the study with the same StudyInstanceUID in
+// the study's account, adding to its modalities, and sets study.ID.
+func (repo mongoStudiesRepo) Upsert(study *models.Study) error {
+	op := "Studies.Upsert"
+
+	accountID, err := objectID(op, study.AccountID)
+	if err != nil {
+		return err
+	}
+
+	update := bson.M{
+		"$set": bson.M{
+			"patient_id":        study.PatientID,
+			"patient_name":      study.PatientName,
+			"study_date":        study.StudyDate,
+			"accession_number":  study.AccessionNumber,
+			"study_description": study.StudyDescription,
+		},
+	}
+
+	// mongo rejects $each of null
+	if len(study.ModalitiesInStudy) > 0 {
+		update["$addToSet"] = bson.M{
+			"modalities_in_study": bson.M{"$each": study.ModalitiesInStudy},
+		}
+	}
+
+	change := mgo.Change{
+		Update:    update,
+		Upsert:    true,
+		ReturnNew: true,
+	}
+
+	result := mongoStudy{}
+	_, err = repo.studies.Find(bson.M{
+		"domain_id":          accountID,
+		"study_instance_uid": study.StudyInstanceUID,
+	}).Apply(change, &result)
+	if err != nil {
+		return findError(op, err)
+	}
+
+	study.ID = result.Id.Hex()
+	return nil
 }
 
 type mongoStudy struct {
-	Id bson.ObjectId `bson:"_id"`
+	Id                bson.ObjectId `bson:"_id"`
+	DomainID          bson.ObjectId `bson:"domain_id"`
+	StudyInstanceUID  string        `bson:"study_instance_uid"`
+	PatientID         string        `bson:"patient_id"`
+	PatientName       string        `bson:"patient_name"`
+	StudyDate         string        `bson:"study_date"`
+	AccessionNumber   string        `bson:"accession_number"`
+	StudyDescription  string        `bson:"study_description"`
+	ModalitiesInStudy []string      `bson:"modalities_in_study"`
+}
+
+func (study mongoStudy) toModel() *models.Study {
+	return &models.Study{
+		ID:                study.Id.Hex(),
+		AccountID:         study.DomainID.Hex(),
+		StudyInstanceUID:  study.StudyInstanceUID,
+		PatientID:         study.PatientID,
+		PatientName:       study.PatientName,
+		StudyDate:         study.StudyDate,
+		AccessionNumber:   study.AccessionNumber,
+		StudyDescription:  study.StudyDescription,
+		ModalitiesInStudy: study.ModalitiesInStudy,
+	}
 }
@@ -28,11 +28,16 @@ func NewMongoUsersRepo(session *mgo.Session, db *mgo.Database) *mongoUserRepo {
 func (repo mongoUserRepo) FindByID(id string) (*models.User, error) {
 	u := mongoUser{}
 
-	err := repo.users.Find(bson.M{"_id": bson.ObjectIdHex(id)}).One(&u)
+	oid, err := objectID("Users.FindByID", id)
 	if err != nil {
 		return nil, err
 	}
 
+	err = repo.users.Find(bson.M{"_id": oid}).One(&u)
+	if err != nil {
+		return nil, findError("Users.FindByID", err)
+	}
+
 	user := &models.User{
 		ID:    u.Id.Hex(),
 		Email: u.Email,
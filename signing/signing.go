@@ -0,0 +1,172 @@
+package signing
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nerdyworm/sess/config"
+)
+
+var (
+	ErrMissingSignature = errors.New("signing: missing signature")
+	ErrInvalidSignature = errors.New("signing: invalid signature")
+	ErrUnknownKey       = errors.New("signing: unknown signing key")
+	ErrExpired          = errors.New("signing: url has expired")
+	ErrNoKeys           = errors.New("signing: no signing keys configured")
+)
+
+var (
+	Default Signer
+)
+
+const (
+	SignatureParam = "sig"
+	ExpiresParam   = "expires"
+)
+
+type Key struct {
+	ID     string
+	Secret []byte
+}
+
+// Signer signs urls with its first key and accepts signatures made by any
+// of its keys, so a new key can be rolled out before the old one is retired.
+type Signer struct {
+	keys []Key
+}
+
+func New(keys ...Key) Signer {
+	return Signer{keys}
+}
+
+func Setup(cfg config.Signing) {
+	keys, err := ParseKeys(cfg.Keys)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	Default = New(keys...)
+}
+
+// ParseKeys parses a comma separated list of `id:secret` pairs, newest
+// key first.
+func ParseKeys(s string) ([]Key, error) {
+	keys := []Key{}
+
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		parts := strings.SplitN(pair, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" || strings.Contains(parts[0], ".") {
+			return nil, fmt.Errorf("signing: malformed key `%s`", parts[0])
+		}
+
+		keys = append(keys, Key{ID: parts[0], Secret: []byte(parts[1])})
+	}
+
+	return keys, nil
+}
+
+// Sign adds the expires and sig params to rawurl. The signature covers the
+// path and every query param, so none of the conversion options can be
+// changed without invalidating it.
+func (s Signer) Sign(rawurl string, expires time.Time) (string, error) {
+	if len(s.keys) == 0 {
+		return "", ErrNoKeys
+	}
+
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return "", err
+	}
+
+	query := u.Query()
+	query.Del(SignatureParam)
+	query.Set(ExpiresParam, strconv.FormatInt(expires.Unix(), 10))
+
+	key := s.keys[0]
+	query.Set(SignatureParam, key.ID+"."+sign(key, u.Path, query))
+
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+func (s Signer) Verify(u *url.URL, now time.Time) error {
+	query := u.Query()
+
+	sig := query.Get(SignatureParam)
+	if sig == "" {
+		return ErrMissingSignature
+	}
+
+	parts := strings.SplitN(sig, ".", 2)
+	if len(parts) != 2 {
+		return ErrInvalidSignature
+	}
+
+	key, ok := s.find(parts[0])
+	if !ok {
+		return ErrUnknownKey
+	}
+
+	expires, err := strconv.ParseInt(query.Get(ExpiresParam), 10, 64)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+
+	query.Del(SignatureParam)
+	if !hmac.Equal([]byte(parts[1]), []byte(sign(key, u.Path, query))) {
+		return ErrInvalidSignature
+	}
+
+	if now.Unix() > expires {
+		return ErrExpired
+	}
+
+	return nil
+}
+
+func (s Signer) find(id string) (Key, bool) {
+	for _, key := range s.keys {
+		if key.ID == id {
+			return key, true
+		}
+	}
+
+	return Key{}, false
+}
+
+// IsSigned reports whether the url carries a signature at all.
+func IsSigned(u *url.URL) bool {
+	return u.Query().Get(SignatureParam) != ""
+}
+
+// KeyID returns the id of the key the url claims to be signed with, it
+// does not verify the signature.
+func KeyID(u *url.URL) string {
+	sig := u.Query().Get(SignatureParam)
+	if i := strings.Index(sig, "."); i > 0 {
+		return sig[:i]
+	}
+
+	return ""
+}
+
+func sign(key Key, path string, query url.Values) string {
+	mac := hmac.New(sha256.New, key.Secret)
+	mac.Write([]byte(path))
+	mac.Write([]byte("\n"))
+	mac.Write([]byte(query.Encode()))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,215 @@
+package signing
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignerVerify(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	old := Key{ID: "old", Secret: []byte("old-secret")}
+	current := Key{ID: "new", Secret: []byte("new-secret")}
+
+	tests := []struct {
+		name     string
+		signer   Signer
+		verifier Signer
+		expires  time.Time
+		tamper   func(url.Values)
+		path     string
+		err      error
+	}{
+		{
+			name:     "valid",
+			signer:   New(current),
+			verifier: New(current),
+			expires:  now.Add(time.Minute),
+		},
+		{
+			name:     "expires at the second",
+			signer:   New(current),
+			verifier: New(current),
+			expires:  now,
+		},
+		{
+			name:     "expired",
+			signer:   New(current),
+			verifier: New(current),
+			expires:  now.Add(-time.Second),
+			err:      ErrExpired,
+		},
+		{
+			name:     "signed with the old key during rotation",
+			signer:   New(old),
+			verifier: New(current, old),
+			expires:  now.Add(time.Minute),
+		},
+		{
+			name:     "signed with the new key during rotation",
+			signer:   New(current, old),
+			verifier: New(current, old),
+			expires:  now.Add(time.Minute),
+		},
+		{
+			name:     "signed with a retired key",
+			signer:   New(old),
+			verifier: New(current),
+			expires:  now.Add(time.Minute),
+			err:      ErrUnknownKey,
+		},
+		{
+			name:     "key id reused with another secret",
+			signer:   New(Key{ID: "new", Secret: []byte("guessed")}),
+			verifier: New(current),
+			expires:  now.Add(time.Minute),
+			err:      ErrInvalidSignature,
+		},
+		{
+			name:     "option changed",
+			signer:   New(current),
+			verifier: New(current),
+			expires:  now.Add(time.Minute),
+			tamper:   func(q url.Values) { q.Set("size", "2048") },
+			err:      ErrInvalidSignature,
+		},
+		{
+			name:     "option added",
+			signer:   New(current),
+			verifier: New(current),
+			expires:  now.Add(time.Minute),
+			tamper:   func(q url.Values) { q.Set("brand", "true") },
+			err:      ErrInvalidSignature,
+		},
+		{
+			name:     "expiry extended",
+			signer:   New(current),
+			verifier: New(current),
+			expires:  now.Add(-time.Minute),
+			tamper:   func(q url.Values) { q.Set(ExpiresParam, "9999999999") },
+			err:      ErrInvalidSignature,
+		},
+		{
+			name:     "path changed",
+			signer:   New(current),
+			verifier: New(current),
+			expires:  now.Add(time.Minute),
+			path:     "/cdn/v1/studies/s/instances/other.jpg",
+			err:      ErrInvalidSignature,
+		},
+		{
+			name:     "signature removed",
+			signer:   New(current),
+			verifier: New(current),
+			expires:  now.Add(time.Minute),
+			tamper:   func(q url.Values) { q.Del(SignatureParam) },
+			err:      ErrMissingSignature,
+		},
+		{
+			name:     "signature without a key id",
+			signer:   New(current),
+			verifier: New(current),
+			expires:  now.Add(time.Minute),
+			tamper:   func(q url.Values) { q.Set(SignatureParam, "abc") },
+			err:      ErrInvalidSignature,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			signed, err := test.signer.Sign("https://cdn.example.com/cdn/v1/studies/s/instances/i.jpg?size=512", test.expires)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			u, err := url.Parse(signed)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if test.tamper != nil {
+				query := u.Query()
+				test.tamper(query)
+				u.RawQuery = query.Encode()
+			}
+
+			if test.path != "" {
+				u.Path = test.path
+			}
+
+			err = test.verifier.Verify(u, now)
+			if err != test.err {
+				t.Errorf("Verify = %v, want %v", err, test.err)
+			}
+		})
+	}
+}
+
+func TestSignReplacesSignature(t *testing.T) {
+	signer := New(Key{ID: "k", Secret: []byte("secret")})
+	expires := time.Unix(1500000000, 0)
+
+	once, err := signer.Sign("/a.jpg?size=1", expires)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	twice, err := signer.Sign(once, expires)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if once != twice {
+		t.Errorf("signing a signed url gave %q, want %q", twice, once)
+	}
+
+	if n := strings.Count(twice, SignatureParam+"="); n != 1 {
+		t.Errorf("%d signatures in %q", n, twice)
+	}
+}
+
+func TestSignWithoutKeys(t *testing.T) {
+	_, err := New().Sign("/a.jpg", time.Now())
+	if err != ErrNoKeys {
+		t.Errorf("Sign = %v, want %v", err, ErrNoKeys)
+	}
+}
+
+func TestParseKeys(t *testing.T) {
+	tests := []struct {
+		in  string
+		ids []string
+		err bool
+	}{
+		{in: "", ids: []string{}},
+		{in: "a:one", ids: []string{"a"}},
+		{in: " b:two , a:one ,", ids: []string{"b", "a"}},
+		{in: "a:one:with:colons", ids: []string{"a"}},
+		{in: "a", err: true},
+		{in: "a:", err: true},
+		{in: ":one", err: true},
+		{in: "a.b:one", err: true},
+	}
+
+	for _, test := range tests {
+		keys, err := ParseKeys(test.in)
+		if (err != nil) != test.err {
+			t.Errorf("ParseKeys(%q) err = %v, want error %v", test.in, err, test.err)
+			continue
+		}
+
+		if test.err {
+			continue
+		}
+
+		ids := []string{}
+		for _, key := range keys {
+			ids = append(ids, key.ID)
+		}
+
+		if strings.Join(ids, ",") != strings.Join(test.ids, ",") {
+			t.Errorf("ParseKeys(%q) ids = %v, want %v", test.in, ids, test.ids)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/nerdyworm/sess/errs"
+	"github.com/nerdyworm/sess/metrics"
+)
+
+// accessGranularity is how stale a recorded access may get before Get
+// records a new one, so hot keys are not a write on every read.
+const accessGranularity = time.Minute
+
+// Eviction bounds a FileStore. Entries not read for MaxAge are evicted,
+// then the least recently read until the store fits in MaxBytes. A zero
+// bound is not enforced.
+type Eviction struct {
+	MaxBytes int64
+	MaxAge   time.Duration
+}
+
+// Stats describe a FileStore. Bytes and Entries are as of the last sweep,
+// the lookups count Exists calls since the process started.
+type Stats struct {
+	Bytes     int64     `json:"bytes"`
+	Entries   int64     `json:"entries"`
+	Hits      int64     `json:"hits"`
+	Misses    int64     `json:"misses"`
+	HitRate   float64   `json:"hit_rate"`
+	Evictions int64     `json:"evictions"`
+	LastSweep time.Time `json:"last_sweep"`
+}
+
+type SweepResult struct {
+	Evicted      int   `json:"evicted"`
+	EvictedBytes int64 `json:"evicted_bytes"`
+	Bytes        int64 `json:"bytes"`
+	Entries      int   `json:"entries"`
+}
+
+type fileStats struct {
+	bytes     int64
+	entries   int64
+	hits      int64
+	misses    int64
+	evictions int64
+	lastSweep atomic.Value
+}
+
+func (s FileStore) Stats() Stats {
+	stats := Stats{
+		Bytes:     atomic.LoadInt64(&s.stats.bytes),
+		Entries:   atomic.LoadInt64(&s.stats.entries),
+		Hits:      atomic.LoadInt64(&s.stats.hits),
+		Misses:    atomic.LoadInt64(&s.stats.misses),
+		Evictions: atomic.LoadInt64(&s.stats.evictions),
+	}
+
+	if lookups := stats.Hits + stats.Misses; lookups > 0 {
+		stats.HitRate = float64(stats.Hits) / float64(lookups)
+	}
+
+	if last, ok := s.stats.lastSweep.Load().(time.Time); ok {
+		stats.LastSweep = last
+	}
+
+	return stats
+}
+
+type cacheEntry struct {
+	key      string
+	size     int64
+	accessed time.Time
+}
+
+// Sweep evicts what policy does not allow. An entry was last accessed when
+// its sidecar was last touched, or when it was written for entries without
+// one.
+func (s FileStore) Sweep(policy Eviction) (SweepResult, error) {
+	result := SweepResult{}
+
+	entries, err := s.entries()
+	if err != nil {
+		return result, err
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].accessed.Before(entries[j].accessed) })
+
+	var total int64
+	for _, entry := range entries {
+		total += entry.size
+	}
+
+	cutoff := time.Now().Add(-policy.MaxAge)
+	kept := 0
+
+	for _, entry := range entries {
+		reason := ""
+		switch {
+		case policy.MaxAge > 0 && entry.accessed.Before(cutoff):
+			reason = "age"
+		case policy.MaxBytes > 0 && total > policy.MaxBytes:
+			reason = "size"
+		default:
+			kept++
+			continue
+		}
+
+		err := s.Delete(entry.key)
+		if err != nil && !errs.Is(err, errs.NotFound) {
+			return result, err
+		}
+
+		total -= entry.size
+		result.Evicted++
+		result.EvictedBytes += entry.size
+		metrics.CacheEvictions.WithLabelValues(reason).Inc()
+	}
+
+	result.Bytes = total
+	result.Entries = kept
+
+	atomic.StoreInt64(&s.stats.bytes, total)
+	atomic.StoreInt64(&s.stats.entries, int64(kept))
+	atomic.AddInt64(&s.stats.evictions, int64(result.Evicted))
+	s.stats.lastSweep.Store(time.Now())
+	metrics.CacheBytes.Set(float64(total))
+	metrics.CacheEntries.Set(float64(kept))
+
+	return result, nil
+}
+
+func (s FileStore) entries() ([]cacheEntry, error) {
+	files := map[string]*cacheEntry{}
+	touched := map[string]time.Time{}
+
+	err := filepath.Walk(s.root, func(file string, stat os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+
+			return err
+		}
+
+		if stat.IsDir() || strings.HasSuffix(file, tmpSuffix) {
+			return nil
+		}
+
+		key := strings.TrimPrefix(filepath.ToSlash(file), s.root)
+		if strings.HasSuffix(key, metaSuffix) {
+			touched[strings.TrimSuffix(key, metaSuffix)] = stat.ModTime()
+			return nil
+		}
+
+		files[key] = &cacheEntry{key: key, size: stat.Size(), accessed: stat.ModTime()}
+		return nil
+	})
+	if err != nil {
+		return nil, errs.E(errs.Unavailable, "FileStore.entries", err)
+	}
+
+	entries := make([]cacheEntry, 0, len(files))
+	for key, entry := range files {
+		if accessed, ok := touched[key]; ok && accessed.After(entry.accessed) {
+			entry.accessed = accessed
+		}
+
+		entries = append(entries, *entry)
+	}
+
+	return entries, nil
+}
+
+// touch records a read of key on its sidecar, creating an empty one for
+// entries that were put before sidecars existed.
+func (s FileStore) touch(key string) {
+	meta := s.makeFile(key) + metaSuffix
+	now := time.Now()
+
+	stat, err := os.Stat(meta)
+	if os.IsNotExist(err) {
+		s.writeMeta(key, fileMeta{})
+		return
+	}
+
+	if err != nil || now.Sub(stat.ModTime()) < accessGranularity {
+		return
+	}
+
+	os.Chtimes(meta, now, now)
+}
+
+func (s FileStore) countLookup(found bool) {
+	if found {
+		atomic.AddInt64(&s.stats.hits, 1)
+	} else {
+		atomic.AddInt64(&s.stats.misses, 1)
+	}
+}
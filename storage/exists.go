@@ -0,0 +1,199 @@
+package storage
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/nerdyworm/sess/errs"
+)
+
+// existsCacheSize is how many keys existsCache holds before it sweeps out
+// the expired ones.
+const existsCacheSize = 10000
+
+// existsCache remembers the answers of Exists and Stat for a while so that
+// hot keys do not cost a request to the store every time. Writes and
+// deletes made through it update it right away; those made by other
+// processes are seen once the entry expires, or once a read that finds
+// the key missing Forgets it. Misses are kept for much shorter than hits:
+// a stale miss costs a redundant job, a stale hit a second conversion.
+type existsCache struct {
+	Storage
+	hitTTL  time.Duration
+	missTTL time.Duration
+	mu      *sync.Mutex
+	entries map[string]existsEntry
+}
+
+// existsEntry is what is known about a key, info is nil until a Stat or
+// Open of the key was made through the cache.
+type existsEntry struct {
+	exists  bool
+	info    *Info
+	expires time.Time
+}
+
+func newExistsCache(store Storage, hitTTL, missTTL time.Duration) existsCache {
+	return existsCache{
+		Storage: store,
+		hitTTL:  hitTTL,
+		missTTL: missTTL,
+		mu:      &sync.Mutex{},
+		entries: map[string]existsEntry{},
+	}
+}
+
+func (s existsCache) Exists(key string) (bool, error) {
+	if entry, ok := s.lookup(key); ok {
+		return entry.exists, nil
+	}
+
+	_, err := s.Stat(key)
+	if errs.Is(err, errs.NotFound) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (s existsCache) Stat(key string) (Info, error) {
+	if entry, ok := s.lookup(key); ok {
+		if !entry.exists {
+			return Info{}, notFound("existsCache.Stat", key)
+		}
+
+		if entry.info != nil {
+			return *entry.info, nil
+		}
+	}
+
+	info, err := s.Storage.Stat(key)
+	if errs.Is(err, errs.NotFound) {
+		s.remember(key, false)
+	} else if err == nil {
+		s.rememberInfo(key, info)
+	}
+
+	return info, err
+}
+
+// Open always goes to the store, a key that turns out to be missing is
+// remembered as such.
+func (s existsCache) Open(key string) (io.ReadCloser, Info, error) {
+	reader, info, err := Open(s.Storage, key)
+	if errs.Is(err, errs.NotFound) {
+		s.remember(key, false)
+	} else if err == nil {
+		s.rememberInfo(key, info)
+	}
+
+	return reader, info, err
+}
+
+func (s existsCache) Get(key string) (io.ReadCloser, error) {
+	reader, err := s.Storage.Get(key)
+	if errs.Is(err, errs.NotFound) {
+		s.remember(key, false)
+	}
+
+	return reader, err
+}
+
+func (s existsCache) Forget(key string) {
+	s.forget(key)
+}
+
+func (s existsCache) lookup(key string) (existsEntry, bool) {
+	s.mu.Lock()
+	entry, ok := s.entries[key]
+	s.mu.Unlock()
+
+	if !ok || !time.Now().Before(entry.expires) {
+		return existsEntry{}, false
+	}
+
+	return entry, true
+}
+
+func (s existsCache) Put(key string, reader io.Reader) error {
+	return s.PutWithOptions(key, reader, PutOptions{})
+}
+
+func (s existsCache) PutWithOptions(key string, reader io.Reader, options PutOptions) error {
+	err := s.Storage.PutWithOptions(key, reader, options)
+	if err != nil {
+		s.forget(key)
+		return err
+	}
+
+	s.remember(key, true)
+	return nil
+}
+
+func (s existsCache) Copy(src, dst string) error {
+	err := s.Storage.Copy(src, dst)
+	if err != nil {
+		s.forget(dst)
+		return err
+	}
+
+	s.remember(dst, true)
+	return nil
+}
+
+func (s existsCache) Delete(key string) error {
+	s.remember(key, false)
+	return s.Storage.Delete(key)
+}
+
+func (s existsCache) remember(key string, exists bool) {
+	s.store(key, existsEntry{exists: exists})
+}
+
+func (s existsCache) rememberInfo(key string, info Info) {
+	s.store(key, existsEntry{exists: true, info: &info})
+}
+
+func (s existsCache) store(key string, entry existsEntry) {
+	ttl := s.missTTL
+	if entry.exists {
+		ttl = s.hitTTL
+	}
+
+	if ttl <= 0 {
+		s.forget(key)
+		return
+	}
+
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.entries) >= existsCacheSize {
+		for k, old := range s.entries {
+			if !now.Before(old.expires) {
+				delete(s.entries, k)
+			}
+		}
+	}
+
+	// everything is still fresh, make room by starting over
+	if len(s.entries) >= existsCacheSize {
+		for k := range s.entries {
+			delete(s.entries, k)
+		}
+	}
+
+	entry.expires = now.Add(ttl)
+	s.entries[key] = entry
+}
+
+func (s existsCache) forget(key string) {
+	s.mu.Lock()
+	delete(s.entries, key)
+	s.mu.Unlock()
+}
@@ -2,53 +2,196 @@ package storage
 
 import (
 	"crypto/md5"
+	"encoding/json"
 	"fmt"
+	"hash/fnv"
 	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
+	"time"
+
+	"github.com/nerdyworm/sess/errs"
+	"github.com/nerdyworm/sess/util"
+)
+
+// metaSuffix names the sidecar FileStore keeps next to each file with what
+// the filesystem can not hold: the content type, checksum and metadata.
+// Files put before sidecars existed have none and are described from the
+// filesystem alone. Puts in progress are written to files with tmpSuffix.
+// A sidecar names the size and modification time of the file it was
+// written for; one that does not match its file belongs to another put
+// and is ignored.
+const (
+	metaSuffix = ".meta"
+	tmpSuffix  = ".tmp"
 )
 
+type fileMeta struct {
+	ContentType string            `json:"content_type,omitempty"`
+	Checksum    string            `json:"checksum,omitempty"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+	Size        int64             `json:"size,omitempty"`
+	ModTime     time.Time         `json:"mod_time"`
+}
+
+// describes reports whether the sidecar was written for the file stat is
+// of. Sidecars from before they were stamped describe any file.
+func (m fileMeta) describes(stat os.FileInfo) bool {
+	return m.ModTime.IsZero() || (m.Size == stat.Size() && m.ModTime.Equal(stat.ModTime()))
+}
+
+// renameLocks serialize the two renames that put a file and its sidecar in
+// place, so puts of a key in this process can not pair one's file with
+// the other's sidecar. Puts from other processes are caught by the stamp.
+var renameLocks [64]sync.Mutex
+
+func renameLock(file string) *sync.Mutex {
+	hash := fnv.New32a()
+	hash.Write([]byte(file))
+	return &renameLocks[hash.Sum32()%uint32(len(renameLocks))]
+}
+
 type FileStore struct {
-	root string
+	root  string
+	stats *fileStats
 }
 
 func NewFileStore(root string) FileStore {
-	return FileStore{root}
+	return FileStore{root, &fileStats{}}
 }
 
 func (s FileStore) Put(key string, reader io.Reader) error {
+	return s.PutWithOptions(key, reader, PutOptions{})
+}
+
+// PutWithOptions writes the file and its sidecar to temporary files that
+// are renamed into place, the file first, so readers never see a partial
+// file and a sidecar is never ahead of its file.
+func (s FileStore) PutWithOptions(key string, reader io.Reader, options PutOptions) error {
 	path := s.makePath(key)
 	file := s.makeFile(key)
 
 	err := os.MkdirAll(path, 0777)
 	if err != nil {
-		return err
+		return errs.E(errs.Unavailable, "FileStore.Put", err)
 	}
 
-	writer, err := os.Create(file)
+	tmp := file + "." + util.RandomString(8) + tmpSuffix
+	writer, err := os.Create(tmp)
 	if err != nil {
-		return err
+		return errs.E(errs.Unavailable, "FileStore.Put", err)
 	}
+	defer os.Remove(tmp)
 	defer writer.Close()
 
-	_, err = io.Copy(writer, reader)
-	return err
+	hash := md5.New()
+	_, err = io.Copy(io.MultiWriter(writer, hash), reader)
+	if err != nil {
+		return errs.E(errs.Unavailable, "FileStore.Put", err)
+	}
+
+	err = writer.Close()
+	if err != nil {
+		return errs.E(errs.Unavailable, "FileStore.Put", err)
+	}
+
+	stat, err := os.Stat(tmp)
+	if err != nil {
+		return errs.E(errs.Unavailable, "FileStore.Put", err)
+	}
+
+	metaTmp := file + metaSuffix + "." + util.RandomString(8) + tmpSuffix
+	defer os.Remove(metaTmp)
+
+	err = writeMetaFile(metaTmp, fileMeta{
+		ContentType: contentTypeFor(key, options.ContentType),
+		Checksum:    fmt.Sprintf("%x", hash.Sum(nil)),
+		Metadata:    options.Metadata,
+		Size:        stat.Size(),
+		ModTime:     stat.ModTime(),
+	})
+	if err != nil {
+		return err
+	}
+
+	lock := renameLock(file)
+	lock.Lock()
+	defer lock.Unlock()
+
+	err = os.Rename(tmp, file)
+	if err == nil {
+		err = os.Rename(metaTmp, file+metaSuffix)
+	}
+
+	if err != nil {
+		return errs.E(errs.Unavailable, "FileStore.Put", err)
+	}
+
+	return nil
 }
 
 func (s FileStore) Exists(key string) (bool, error) {
 	path := s.makeFile(key)
 	if _, err := os.Stat(path); err != nil {
 		if os.IsNotExist(err) {
+			s.countLookup(false)
 			return false, nil
 		}
+
+		return false, errs.E(errs.Unavailable, "FileStore.Exists", err)
 	}
 
+	s.countLookup(true)
 	return true, nil
 }
 
+func (s FileStore) Stat(key string) (Info, error) {
+	stat, err := os.Stat(s.makeFile(key))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return Info{}, notFound("FileStore.Stat", key)
+		}
+
+		return Info{}, errs.E(errs.Unavailable, "FileStore.Stat", err)
+	}
+
+	meta, err := s.readMeta(key)
+	if err != nil {
+		return Info{}, err
+	}
+
+	if !meta.describes(stat) {
+		meta = fileMeta{}
+	}
+
+	return Info{
+		Key:         key,
+		Size:        stat.Size(),
+		ModTime:     stat.ModTime(),
+		ContentType: contentTypeFor(key, meta.ContentType),
+		Checksum:    meta.Checksum,
+		Metadata:    meta.Metadata,
+	}, nil
+}
+
 func (s FileStore) Get(key string) (io.ReadCloser, error) {
 	file := s.makeFile(key)
-	return os.Open(file)
+
+	reader, err := os.Open(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, notFound("FileStore.Get", key)
+		}
+
+		return nil, errs.E(errs.Unavailable, "FileStore.Get", err)
+	}
+
+	s.touch(key)
+	return reader, nil
 }
 
 func (s FileStore) GetPath(key string) string {
@@ -56,9 +199,116 @@ func (s FileStore) GetPath(key string) string {
 	return file
 }
 
+// List walks the deepest directory that holds every key with prefix. Keys
+// are collected and sorted before paging so the order matches S3's, which
+// a directory walk does not when keys share a prefix up to a "/".
+func (s FileStore) List(prefix, marker string, limit int) (Listing, error) {
+	limit = limitOrDefault(limit)
+	keys := []Info{}
+
+	err := filepath.Walk(s.makePath(prefix), func(file string, stat os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+
+			return err
+		}
+
+		if stat.IsDir() || strings.HasSuffix(file, metaSuffix) || strings.HasSuffix(file, tmpSuffix) {
+			return nil
+		}
+
+		key := strings.TrimPrefix(filepath.ToSlash(file), s.root)
+		if strings.HasPrefix(key, prefix) && key > marker {
+			keys = append(keys, Info{Key: key, Size: stat.Size(), ModTime: stat.ModTime()})
+		}
+
+		return nil
+	})
+	if err != nil {
+		return Listing{}, errs.E(errs.Unavailable, "FileStore.List", err)
+	}
+
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Key < keys[j].Key })
+
+	listing := Listing{Objects: keys}
+	if len(keys) > limit {
+		listing.Objects = keys[:limit]
+		listing.NextMarker = keys[limit-1].Key
+	}
+
+	return listing, nil
+}
+
+func (s FileStore) Copy(src, dst string) error {
+	reader, err := s.Get(src)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	info, err := s.Stat(src)
+	if err != nil {
+		return err
+	}
+
+	return s.PutWithOptions(dst, reader, PutOptions{
+		ContentType: info.ContentType,
+		Metadata:    info.Metadata,
+	})
+}
+
 func (s FileStore) Delete(key string) error {
 	file := s.makeFile(key)
-	return os.Remove(file)
+
+	err := os.Remove(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return notFound("FileStore.Delete", key)
+		}
+
+		return errs.E(errs.Unavailable, "FileStore.Delete", err)
+	}
+
+	os.Remove(file + metaSuffix)
+	return nil
+}
+
+func (s FileStore) readMeta(key string) (fileMeta, error) {
+	meta := fileMeta{}
+
+	b, err := ioutil.ReadFile(s.makeFile(key) + metaSuffix)
+	if os.IsNotExist(err) {
+		return meta, nil
+	} else if err != nil {
+		return meta, errs.E(errs.Unavailable, "FileStore.readMeta", err)
+	}
+
+	err = json.Unmarshal(b, &meta)
+	if err != nil {
+		return meta, errs.E(errs.Unavailable, "FileStore.readMeta", err)
+	}
+
+	return meta, nil
+}
+
+func (s FileStore) writeMeta(key string, meta fileMeta) error {
+	return writeMetaFile(s.makeFile(key)+metaSuffix, meta)
+}
+
+func writeMetaFile(path string, meta fileMeta) error {
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(path, b, 0666)
+	if err != nil {
+		return errs.E(errs.Unavailable, "FileStore.writeMeta", err)
+	}
+
+	return nil
 }
 
 func (s FileStore) makePath(key string) string {
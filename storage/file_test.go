@@ -0,0 +1,89 @@
+package storage
+
+import (
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestFilePutConcurrent puts one key from many goroutines, whichever put
+// wins the file has to win the sidecar too.
+func TestFilePutConcurrent(t *testing.T) {
+	store := NewFileStore(t.TempDir() + "/")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			err := store.PutWithOptions("a/b.jpg", strings.NewReader(strings.Repeat("x", i)), PutOptions{
+				ContentType: "image/jpeg",
+				Metadata:    map[string]string{"n": fmt.Sprint(i)},
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	reader, err := store.Get("a/b.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	data, _ := ioutil.ReadAll(reader)
+
+	info, err := store.Stat("a/b.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Checksum != fmt.Sprintf("%x", md5.Sum(data)) || info.Metadata["n"] != fmt.Sprint(len(data)) {
+		t.Errorf("sidecar %+v describes another put than the %d bytes stored", info, len(data))
+	}
+
+	listing, err := store.List("a/", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(listing.Objects) != 1 {
+		t.Errorf("listed %+v, want the one key", listing.Objects)
+	}
+}
+
+func TestFileStaleSidecar(t *testing.T) {
+	store := NewFileStore(t.TempDir() + "/")
+
+	err := store.PutWithOptions("a.jpg", strings.NewReader("first"), PutOptions{Metadata: map[string]string{"n": "1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a put from another process renamed its file in, its sidecar lost
+	time.Sleep(10 * time.Millisecond)
+	err = ioutil.WriteFile(store.GetPath("a.jpg"), []byte("second put"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := store.Stat("a.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Checksum != "" || info.Metadata != nil {
+		t.Errorf("stale sidecar used %+v", info)
+	}
+
+	if info.ContentType != "image/jpeg" || info.Size != int64(len("second put")) {
+		t.Errorf("info %+v, want one described by the file", info)
+	}
+}
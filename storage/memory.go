@@ -0,0 +1,226 @@
+package storage
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nerdyworm/sess/errs"
+)
+
+// MemoryStore keeps objects of up to maxObject bytes in memory for ttl,
+// evicting the least recently read once it holds more than maxBytes. It is
+// meant as the front tier of a TieredStore for small, hot derivatives; the
+// ttl bounds how long it serves an object purged by another process. A ttl
+// of 0 keeps objects until they are evicted.
+type MemoryStore struct {
+	maxBytes  int64
+	maxObject int64
+	ttl       time.Duration
+
+	mu    sync.Mutex
+	size  int64
+	lru   *list.List
+	items map[string]*list.Element
+}
+
+type memoryItem struct {
+	data []byte
+	info Info
+}
+
+// memoryReader serves an object without copying it. It is a ReadSeeker so
+// that http.ServeContent can answer range requests from it.
+type memoryReader struct {
+	*bytes.Reader
+}
+
+func (memoryReader) Close() error {
+	return nil
+}
+
+func NewMemoryStore(maxBytes, maxObject int64, ttl time.Duration) *MemoryStore {
+	return &MemoryStore{
+		maxBytes:  maxBytes,
+		maxObject: maxObject,
+		ttl:       ttl,
+		lru:       list.New(),
+		items:     map[string]*list.Element{},
+	}
+}
+
+// Accepts reports whether an object of size fits, TieredStore does not
+// offer it the others.
+func (s *MemoryStore) Accepts(size int64) bool {
+	return size <= s.maxObject
+}
+
+func (s *MemoryStore) Get(key string) (io.ReadCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	element, ok := s.lookup(key)
+	if !ok {
+		return nil, notFound("MemoryStore.Get", key)
+	}
+
+	s.lru.MoveToFront(element)
+	return memoryReader{bytes.NewReader(element.Value.(*memoryItem).data)}, nil
+}
+
+func (s *MemoryStore) Put(key string, reader io.Reader) error {
+	return s.PutWithOptions(key, reader, PutOptions{})
+}
+
+// PutWithOptions refuses objects bigger than maxObject, reading no more
+// than that much of reader to find out.
+func (s *MemoryStore) PutWithOptions(key string, reader io.Reader, options PutOptions) error {
+	op := "MemoryStore.Put"
+
+	if options.Size > s.maxObject {
+		return errs.Errorf(errs.Invalid, op, "`%s` is bigger than %d bytes", key, s.maxObject)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(reader, s.maxObject+1))
+	if err != nil {
+		return errs.E(errs.Unavailable, op, err)
+	}
+
+	if int64(len(data)) > s.maxObject {
+		return errs.Errorf(errs.Invalid, op, "`%s` is bigger than %d bytes", key, s.maxObject)
+	}
+
+	item := &memoryItem{
+		data: data,
+		info: Info{
+			Key:         key,
+			Size:        int64(len(data)),
+			ModTime:     time.Now(),
+			ContentType: contentTypeFor(key, options.ContentType),
+			Checksum:    fmt.Sprintf("%x", md5.Sum(data)),
+			Metadata:    options.Metadata,
+		},
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.remove(key)
+	s.items[key] = s.lru.PushFront(item)
+	s.size += item.info.Size
+
+	for s.size > s.maxBytes && s.lru.Len() > 0 {
+		s.remove(s.lru.Back().Value.(*memoryItem).info.Key)
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) Exists(key string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok := s.lookup(key)
+	return ok, nil
+}
+
+func (s *MemoryStore) Stat(key string) (Info, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	element, ok := s.lookup(key)
+	if !ok {
+		return Info{}, notFound("MemoryStore.Stat", key)
+	}
+
+	return element.Value.(*memoryItem).info, nil
+}
+
+func (s *MemoryStore) List(prefix, marker string, limit int) (Listing, error) {
+	limit = limitOrDefault(limit)
+
+	s.mu.Lock()
+	keys := []Info{}
+	for key, element := range s.items {
+		if strings.HasPrefix(key, prefix) && key > marker && !s.expired(element) {
+			keys = append(keys, element.Value.(*memoryItem).info)
+		}
+	}
+	s.mu.Unlock()
+
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Key < keys[j].Key })
+
+	listing := Listing{Objects: keys}
+	if len(keys) > limit {
+		listing.Objects = keys[:limit]
+		listing.NextMarker = keys[limit-1].Key
+	}
+
+	return listing, nil
+}
+
+func (s *MemoryStore) Copy(src, dst string) error {
+	s.mu.Lock()
+	element, ok := s.lookup(src)
+	s.mu.Unlock()
+
+	if !ok {
+		return notFound("MemoryStore.Copy", src)
+	}
+
+	item := element.Value.(*memoryItem)
+	return s.PutWithOptions(dst, bytes.NewReader(item.data), PutOptions{
+		ContentType: item.info.ContentType,
+		Metadata:    item.info.Metadata,
+	})
+}
+
+func (s *MemoryStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.remove(key) {
+		return notFound("MemoryStore.Delete", key)
+	}
+
+	return nil
+}
+
+// lookup finds key, dropping it when it has expired. The caller holds mu.
+func (s *MemoryStore) lookup(key string) (*list.Element, bool) {
+	element, ok := s.items[key]
+	if !ok {
+		return nil, false
+	}
+
+	if s.expired(element) {
+		s.remove(key)
+		return nil, false
+	}
+
+	return element, true
+}
+
+func (s *MemoryStore) expired(element *list.Element) bool {
+	return s.ttl > 0 && time.Since(element.Value.(*memoryItem).info.ModTime) > s.ttl
+}
+
+// remove drops key, the caller holds mu.
+func (s *MemoryStore) remove(key string) bool {
+	element, ok := s.items[key]
+	if !ok {
+		return false
+	}
+
+	s.lru.Remove(element)
+	delete(s.items, key)
+	s.size -= element.Value.(*memoryItem).info.Size
+	return true
+}
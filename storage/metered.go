@@ -0,0 +1,35 @@
+package storage
+
+import (
+	"io"
+
+	"github.com/nerdyworm/sess/metrics"
+)
+
+// meteredStore counts the hits and misses of Exists on the store it wraps.
+type meteredStore struct {
+	Storage
+}
+
+func (s meteredStore) Exists(key string) (bool, error) {
+	exists, err := s.Storage.Exists(key)
+
+	switch {
+	case err != nil:
+		metrics.CacheLookups.WithLabelValues("error").Inc()
+	case exists:
+		metrics.CacheLookups.WithLabelValues("hit").Inc()
+	default:
+		metrics.CacheLookups.WithLabelValues("miss").Inc()
+	}
+
+	return exists, err
+}
+
+func (s meteredStore) Open(key string) (io.ReadCloser, Info, error) {
+	return Open(s.Storage, key)
+}
+
+func (s meteredStore) Forget(key string) {
+	Forget(s.Storage, key)
+}
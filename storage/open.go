@@ -0,0 +1,43 @@
+package storage
+
+import "io"
+
+// opener is implemented by stores that can describe an object from the
+// same request that reads it.
+type opener interface {
+	Open(key string) (io.ReadCloser, Info, error)
+}
+
+// Open reads key along with its Info. Stores that can do that in one
+// request do, the others are asked with a Stat and a Get.
+func Open(store Storage, key string) (io.ReadCloser, Info, error) {
+	if o, ok := store.(opener); ok {
+		return o.Open(key)
+	}
+
+	info, err := store.Stat(key)
+	if err != nil {
+		return nil, Info{}, err
+	}
+
+	reader, err := store.Get(key)
+	if err != nil {
+		return nil, Info{}, err
+	}
+
+	return reader, info, nil
+}
+
+// forgetter is implemented by stores that remember what they found.
+type forgetter interface {
+	Forget(key string)
+}
+
+// Forget drops what store remembers about key, so that the next lookup
+// asks the store itself. It is for keys another process removed, which a
+// read found missing although Exists said they were there.
+func Forget(store Storage, key string) {
+	if f, ok := store.(forgetter); ok {
+		f.Forget(key)
+	}
+}
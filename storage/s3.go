@@ -1,85 +1,359 @@
 package storage
 
 import (
+	"bytes"
 	"io"
 	"log"
-	"os"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/mitchellh/goamz/aws"
 	"github.com/mitchellh/goamz/s3"
-	"github.com/nerdyworm/sess/util"
+	"github.com/nerdyworm/sess/errs"
 )
 
+// S3 numbers parts from 1 to 10000.
+const maxParts = 10000
+
+// partRetryBackoff is how much longer each retry of a part waits.
+var partRetryBackoff = 500 * time.Millisecond
+
 type S3Store struct {
-	auth   aws.Auth
-	sss    *s3.S3
-	bucket *s3.Bucket
+	auth    aws.Auth
+	sss     *s3.S3
+	bucket  *s3.Bucket
+	uploads Uploads
+}
+
+// Uploads sets how objects bigger than PartSize are uploaded: in parts of
+// PartSize, Concurrency at a time, each tried Retries more times. An upload
+// holds up to Concurrency parts in memory.
+type Uploads struct {
+	PartSize    int64
+	Concurrency int
+	Retries     int
 }
 
-func NewS3Store(bucketName string) S3Store {
-	auth := aws.Auth{os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"), ""}
-	sss := s3.New(auth, aws.USEast)
+// NewS3Store returns a store for bucketName.
+func NewS3Store(auth aws.Auth, region aws.Region, bucketName string, uploads Uploads) S3Store {
+	sss := s3.New(auth, region)
 	bucket := sss.Bucket(bucketName)
-	return S3Store{auth, sss, bucket}
+	return S3Store{auth, sss, bucket, uploads}
 }
 
 func (s S3Store) Get(key string) (io.ReadCloser, error) {
 	log.Printf("S3Store#Get `%s`\n", key)
-	return s.bucket.GetReader(key)
+
+	reader, err := s.bucket.GetReader(key)
+	if err != nil {
+		return nil, s3Error("S3Store.Get", key, err)
+	}
+
+	return reader, nil
 }
 
 func (s S3Store) Put(key string, reader io.Reader) error {
+	return s.PutWithOptions(key, reader, PutOptions{})
+}
+
+// PutWithOptions streams reader to S3. Objects up to a part in size are
+// put in one request, bigger ones and readers of unknown size are uploaded
+// in parts so nothing has to be spooled to disk first.
+func (s S3Store) PutWithOptions(key string, reader io.Reader, options PutOptions) error {
 	log.Printf("S3Store#Put `%s`\n", key)
-	tmp := NewFileStore("/tmp/s3_store/puts/")
 
-	tmpKey := key + util.RandomString(32)
+	size := options.Size
+	if size <= 0 {
+		if n, ok := readerSize(reader); ok {
+			size = n
+		}
+	}
 
-	err := tmp.Put(tmpKey, reader)
-	if err != nil {
-		log.Printf("[ERROR] putting into s3 temp store `%v`", err)
-		return err
+	if size > 0 && size <= s.uploads.PartSize {
+		return s.putSingle(key, reader, size, options)
+	}
+
+	if size <= 0 {
+		// read a part's worth to find out whether the object is small
+		first := make([]byte, s.uploads.PartSize)
+		n, err := io.ReadFull(reader, first)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return s.putSingle(key, bytes.NewReader(first[:n]), int64(n), options)
+		} else if err != nil {
+			return errs.E(errs.Unavailable, "S3Store.Put", err)
+		}
+
+		reader = io.MultiReader(bytes.NewReader(first), reader)
 	}
 
-	file, err := tmp.Get(tmpKey)
+	return s.putMulti(key, reader, options)
+}
+
+func (s S3Store) putSingle(key string, reader io.Reader, size int64, options PutOptions) error {
+	err := s.bucket.PutReaderHeader(key, reader, size, s3Headers(key, options), s3.BucketOwnerFull)
 	if err != nil {
-		log.Printf("[ERROR] error opening `%v`", err)
-		return err
+		log.Printf("[ERROR] PutReader `%v`", err)
+		return s3Error("S3Store.Put", key, err)
+	}
+
+	return nil
+}
+
+// putMulti uploads reader in parts and aborts the upload on the first part
+// that fails for good, so no orphaned parts are left to be billed for.
+// InitMulti only takes a content type, objects with metadata are refused
+// rather than stored without it.
+func (s S3Store) putMulti(key string, reader io.Reader, options PutOptions) error {
+	op := "S3Store.putMulti"
+
+	if len(options.Metadata) > 0 {
+		return errs.Errorf(errs.Invalid, op, "`%s` has metadata, which can not be sent with an upload in parts", key)
 	}
-	defer file.Close()
 
-	stat, err := file.(*os.File).Stat()
+	multi, err := s.bucket.InitMulti(key, contentTypeFor(key, options.ContentType), s3.BucketOwnerFull)
 	if err != nil {
-		log.Printf("[ERROR] file.Stat() `%v`", err)
-		return err
+		return s3Error(op, key, err)
+	}
+
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		parts  []s3.Part
+		failed error
+	)
+
+	fail := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if failed == nil {
+			failed = err
+		}
+	}
+
+	hasFailed := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return failed != nil
+	}
+
+	slots := make(chan struct{}, s.uploads.Concurrency)
+
+	for n := 1; !hasFailed(); n++ {
+		body := make([]byte, s.uploads.PartSize)
+		read, err := io.ReadFull(reader, body)
+		if err == io.EOF {
+			break
+		} else if err != nil && err != io.ErrUnexpectedEOF {
+			fail(errs.E(errs.Unavailable, op, err))
+			break
+		}
+
+		if n > maxParts {
+			fail(errs.Errorf(errs.Invalid, op, "`%s` needs more than %d parts of %d bytes", key, maxParts, s.uploads.PartSize))
+			break
+		}
+
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(n int, body []byte) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			part, err := s.putPart(multi, n, body)
+			if err != nil {
+				fail(err)
+				return
+			}
+
+			mu.Lock()
+			parts = append(parts, part)
+			mu.Unlock()
+		}(n, body[:read])
+
+		if err == io.ErrUnexpectedEOF {
+			break
+		}
 	}
 
-	size := stat.Size()
-	contentType := ""
-	err = s.bucket.PutReader(key, file, size, contentType, s3.BucketOwnerFull)
+	wg.Wait()
+
+	if failed == nil {
+		sort.Slice(parts, func(i, j int) bool { return parts[i].N < parts[j].N })
+		err = multi.Complete(parts)
+		if err != nil {
+			failed = s3Error(op, key, err)
+		}
+	}
+
+	if failed != nil {
+		if err := multi.Abort(); err != nil {
+			log.Printf("[ERROR] aborting upload of `%s` %v\n", key, err)
+		}
+
+		return failed
+	}
+
+	return nil
+}
+
+func (s S3Store) putPart(multi *s3.Multi, n int, body []byte) (s3.Part, error) {
+	for attempt := 0; ; attempt++ {
+		part, err := multi.PutPart(n, bytes.NewReader(body))
+		if err == nil {
+			return part, nil
+		}
+
+		if attempt >= s.uploads.Retries {
+			return part, s3Error("S3Store.putPart", multi.Key, err)
+		}
+
+		log.Printf("[ERROR] part %d of `%s`, retrying %v\n", n, multi.Key, err)
+		time.Sleep(time.Duration(attempt+1) * partRetryBackoff)
+	}
+}
 
+// Stat is a HEAD request. The ETag is only an md5 for objects that were not
+// uploaded in parts, Checksum is left empty for the others.
+func (s S3Store) Stat(key string) (Info, error) {
+	response, err := s.bucket.Head(key)
 	if err != nil {
-		log.Printf("[ERROR] PutReader `%v`", err)
-		return err
+		return Info{}, s3Error("S3Store.Stat", key, err)
 	}
+	defer response.Body.Close()
 
-	return tmp.Delete(tmpKey)
+	return s3Info(key, response), nil
 }
 
-func (s S3Store) Exists(key string) (bool, error) {
-	log.Printf("S3Store#Exists `%s`\n", key)
+// Open is a single GET, the object is described from its headers.
+func (s S3Store) Open(key string) (io.ReadCloser, Info, error) {
+	log.Printf("S3Store#Open `%s`\n", key)
 
 	response, err := s.bucket.GetResponse(key)
 	if err != nil {
-		if err.Error() == "The specified key does not exist." {
-			return false, nil
-		} else {
-			return false, err
+		return nil, Info{}, s3Error("S3Store.Open", key, err)
+	}
+
+	return response.Body, s3Info(key, response), nil
+}
+
+func s3Info(key string, response *http.Response) Info {
+	info := Info{
+		Key:         key,
+		Size:        response.ContentLength,
+		ContentType: response.Header.Get("Content-Type"),
+		Checksum:    s3Checksum(response.Header.Get("ETag")),
+		Metadata:    map[string]string{},
+	}
+
+	if modtime, err := http.ParseTime(response.Header.Get("Last-Modified")); err == nil {
+		info.ModTime = modtime
+	}
+
+	for name, values := range response.Header {
+		if strings.HasPrefix(strings.ToLower(name), s3MetaPrefix) && len(values) > 0 {
+			info.Metadata[strings.ToLower(name[len(s3MetaPrefix):])] = values[0]
+		}
+	}
+
+	return info
+}
+
+func (s S3Store) List(prefix, marker string, limit int) (Listing, error) {
+	response, err := s.bucket.List(prefix, "", marker, limitOrDefault(limit))
+	if err != nil {
+		return Listing{}, s3Error("S3Store.List", prefix, err)
+	}
+
+	listing := Listing{Objects: make([]Info, 0, len(response.Contents))}
+	for _, key := range response.Contents {
+		info := Info{Key: key.Key, Size: key.Size, Checksum: s3Checksum(key.ETag)}
+		if modtime, err := time.Parse(time.RFC3339Nano, key.LastModified); err == nil {
+			info.ModTime = modtime
 		}
+
+		listing.Objects = append(listing.Objects, info)
+	}
+
+	// S3 only sends NextMarker along with a delimiter
+	if response.IsTruncated && len(listing.Objects) > 0 {
+		listing.NextMarker = listing.Objects[len(listing.Objects)-1].Key
+	}
+
+	return listing, nil
+}
+
+// Copy is done by S3 itself, the object's content type and metadata are
+// copied along with it.
+func (s S3Store) Copy(src, dst string) error {
+	headers := map[string][]string{
+		"x-amz-copy-source": {(&url.URL{Path: s.bucket.Name + "/" + src}).EscapedPath()},
 	}
 
-	return response.StatusCode == 200, err
+	err := s.bucket.PutReaderHeader(dst, bytes.NewReader(nil), 0, headers, s3.BucketOwnerFull)
+	if err != nil {
+		return s3Error("S3Store.Copy", src, err)
+	}
+
+	return nil
+}
+
+// Exists is a HEAD request, nothing is downloaded.
+func (s S3Store) Exists(key string) (bool, error) {
+	log.Printf("S3Store#Exists `%s`\n", key)
+
+	_, err := s.Stat(key)
+	if errs.Is(err, errs.NotFound) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return true, nil
 }
 
+// Delete can not report missing keys, S3 answers 204 for them too.
 func (s S3Store) Delete(key string) error {
-	return s.bucket.Del(key)
+	err := s.bucket.Del(key)
+	if err != nil {
+		return s3Error("S3Store.Delete", key, err)
+	}
+
+	return nil
+}
+
+const s3MetaPrefix = "x-amz-meta-"
+
+func s3Headers(key string, options PutOptions) map[string][]string {
+	headers := map[string][]string{
+		"Content-Type": {contentTypeFor(key, options.ContentType)},
+	}
+
+	for name, value := range options.Metadata {
+		headers[s3MetaPrefix+strings.ToLower(name)] = []string{value}
+	}
+
+	return headers
+}
+
+func s3Checksum(etag string) string {
+	etag = strings.Trim(etag, `"`)
+	if strings.Contains(etag, "-") {
+		return ""
+	}
+
+	return etag
+}
+
+// s3Error maps a missing bucket key to ErrNotFound. A HEAD response has
+// no body, so a 404 is all there is to go on for those.
+func s3Error(op, key string, err error) error {
+	if e, ok := err.(*s3.Error); ok && (e.StatusCode == http.StatusNotFound || e.Code == "NoSuchKey") {
+		return notFound(op, key)
+	}
+
+	return errs.E(errs.Unavailable, op, err)
 }
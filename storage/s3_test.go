@@ -0,0 +1,338 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mitchellh/goamz/aws"
+	"github.com/nerdyworm/sess/errs"
+)
+
+// fakeS3 answers the path style requests goamz makes for single puts and
+// multipart uploads. failParts makes a part number fail with a 503 that
+// many times before it is accepted.
+type fakeS3 struct {
+	mu        sync.Mutex
+	objects   map[string]fakeObject
+	uploads   map[string]*fakeUpload
+	failParts map[int]int
+	attempts  map[int]int
+	puts      int
+	initiated int
+	aborted   int
+	completed int
+}
+
+type fakeObject struct {
+	body   []byte
+	header http.Header
+}
+
+type fakeUpload struct {
+	key    string
+	header http.Header
+	parts  map[int][]byte
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{
+		objects:   map[string]fakeObject{},
+		uploads:   map[string]*fakeUpload{},
+		failParts: map[int]int{},
+		attempts:  map[int]int{},
+	}
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// /bucket/key
+	key := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)[1]
+	query := r.URL.Query()
+	body, _ := ioutil.ReadAll(r.Body)
+
+	switch {
+	case r.Method == "PUT" && query.Get("uploadId") != "":
+		upload, ok := f.uploads[query.Get("uploadId")]
+		if !ok {
+			s3ErrorResponse(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+
+		n, _ := strconv.Atoi(query.Get("partNumber"))
+		f.attempts[n]++
+		if f.failParts[n] > 0 {
+			f.failParts[n]--
+			s3ErrorResponse(w, http.StatusServiceUnavailable, "SlowDown")
+			return
+		}
+
+		upload.parts[n] = body
+		w.Header().Set("ETag", fmt.Sprintf(`"%x"`, md5.Sum(body)))
+
+	case r.Method == "PUT":
+		f.puts++
+		f.objects[key] = fakeObject{body, r.Header}
+
+	case r.Method == "POST" && query.Get("uploadId") == "":
+		f.initiated++
+		id := strconv.Itoa(f.initiated)
+		f.uploads[id] = &fakeUpload{key, r.Header, map[int][]byte{}}
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><Bucket>bucket</Bucket><Key>%s</Key><UploadId>%s</UploadId></InitiateMultipartUploadResult>", key, id)
+
+	case r.Method == "POST":
+		upload, ok := f.uploads[query.Get("uploadId")]
+		if !ok {
+			s3ErrorResponse(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+
+		complete := struct {
+			Parts []struct {
+				PartNumber int
+				ETag       string
+			} `xml:"Part"`
+		}{}
+		xml.Unmarshal(body, &complete)
+
+		object := []byte{}
+		for i, part := range complete.Parts {
+			if part.PartNumber != i+1 || part.ETag != fmt.Sprintf(`"%x"`, md5.Sum(upload.parts[part.PartNumber])) {
+				s3ErrorResponse(w, http.StatusBadRequest, "InvalidPartOrder")
+				return
+			}
+
+			object = append(object, upload.parts[part.PartNumber]...)
+		}
+
+		f.completed++
+		f.objects[upload.key] = fakeObject{object, upload.header}
+		delete(f.uploads, query.Get("uploadId"))
+		fmt.Fprintf(w, "<CompleteMultipartUploadResult><Key>%s</Key></CompleteMultipartUploadResult>", upload.key)
+
+	case r.Method == "DELETE" && query.Get("uploadId") != "":
+		f.aborted++
+		delete(f.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		s3ErrorResponse(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func s3ErrorResponse(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+// unsized hides the size of a reader, the way a pipe from a conversion
+// would.
+type unsized struct {
+	io.Reader
+}
+
+func TestS3StorePutWithOptions(t *testing.T) {
+	defer func(backoff time.Duration) { partRetryBackoff = backoff }(partRetryBackoff)
+	partRetryBackoff = time.Millisecond
+
+	body := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+
+	tests := []struct {
+		name      string
+		size      int
+		unsized   bool
+		options   PutOptions
+		retries   int
+		failParts map[int]int
+		err       errs.Kind
+		puts      int
+		parts     int
+		aborted   int
+		attempts  map[int]int
+	}{
+		{
+			name:    "single part of known size",
+			size:    10,
+			options: PutOptions{ContentType: "image/jpeg", Metadata: map[string]string{"source": "abc"}},
+			puts:    1,
+		},
+		{
+			name:    "single part of unknown size",
+			size:    12,
+			unsized: true,
+			puts:    1,
+		},
+		{
+			name:  "multipart",
+			size:  len(body),
+			parts: 3,
+		},
+		{
+			name:    "multipart of unknown size",
+			size:    len(body),
+			unsized: true,
+			parts:   3,
+		},
+		{
+			name:      "part retried",
+			size:      len(body),
+			retries:   2,
+			failParts: map[int]int{2: 2},
+			parts:     3,
+			attempts:  map[int]int{1: 1, 2: 3, 3: 1},
+		},
+		{
+			name:      "aborted when a part fails for good",
+			size:      len(body),
+			retries:   1,
+			failParts: map[int]int{2: 5},
+			err:       errs.Unavailable,
+			parts:     3,
+			aborted:   1,
+			attempts:  map[int]int{2: 2},
+		},
+		{
+			name:    "metadata refused for multipart",
+			size:    len(body),
+			options: PutOptions{Metadata: map[string]string{"source": "abc"}},
+			err:     errs.Invalid,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := newFakeS3()
+			for n, times := range test.failParts {
+				fake.failParts[n] = times
+			}
+
+			server := httptest.NewServer(fake)
+			defer server.Close()
+
+			region := aws.Region{Name: "fake", S3Endpoint: server.URL}
+			store := NewS3Store(aws.Auth{AccessKey: "key", SecretKey: "secret"}, region, "bucket", Uploads{
+				PartSize:    16,
+				Concurrency: 2,
+				Retries:     test.retries,
+			})
+
+			var reader io.Reader = bytes.NewReader(body[:test.size])
+			if test.unsized {
+				reader = unsized{reader}
+			}
+
+			err := store.PutWithOptions("a/key", reader, test.options)
+			if test.err != 0 {
+				if !errs.Is(err, test.err) {
+					t.Fatalf("err = %v, want kind %v", err, test.err)
+				}
+			} else if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+
+			fake.mu.Lock()
+			defer fake.mu.Unlock()
+
+			if fake.puts != test.puts {
+				t.Errorf("puts = %d, want %d", fake.puts, test.puts)
+			}
+
+			if fake.aborted != test.aborted {
+				t.Errorf("aborted = %d, want %d", fake.aborted, test.aborted)
+			}
+
+			if len(fake.uploads) != 0 {
+				t.Errorf("%d uploads left open", len(fake.uploads))
+			}
+
+			if test.parts > 0 && test.err == 0 && fake.completed != 1 {
+				t.Errorf("completed = %d, want 1", fake.completed)
+			}
+
+			if test.err == errs.Invalid && fake.initiated != 0 {
+				t.Errorf("initiated %d uploads for a refused put", fake.initiated)
+			}
+
+			for n, want := range test.attempts {
+				if fake.attempts[n] != want {
+					t.Errorf("attempts at part %d = %d, want %d", n, fake.attempts[n], want)
+				}
+			}
+
+			object, ok := fake.objects["a/key"]
+			if test.err != 0 {
+				if ok {
+					t.Errorf("object stored by a failed put")
+				}
+				return
+			}
+
+			if !ok {
+				t.Fatalf("object not stored")
+			}
+
+			if want := body[:test.size]; !bytes.Equal(object.body, want) {
+				t.Errorf("stored %q, want %q", object.body, want)
+			}
+
+			if contentType := test.options.ContentType; contentType != "" && object.header.Get("Content-Type") != contentType {
+				t.Errorf("Content-Type = %q, want %q", object.header.Get("Content-Type"), contentType)
+			}
+
+			for name, value := range test.options.Metadata {
+				if got := object.header.Get(s3MetaPrefix + name); got != value {
+					t.Errorf("%s = %q, want %q", s3MetaPrefix+name, got, value)
+				}
+			}
+		})
+	}
+}
+
+// TestS3StorePutWithOptionsPartOrder checks parts are completed in order
+// however their uploads finish.
+func TestS3StorePutWithOptionsPartOrder(t *testing.T) {
+	fake := newFakeS3()
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	store := NewS3Store(aws.Auth{AccessKey: "key", SecretKey: "secret"}, aws.Region{Name: "fake", S3Endpoint: server.URL}, "bucket", Uploads{
+		PartSize:    4,
+		Concurrency: 8,
+	})
+
+	body := []byte(strings.Repeat("0123456789", 10))
+	err := store.PutWithOptions("ordered", bytes.NewReader(body), PutOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	if got := fake.objects["ordered"].body; !bytes.Equal(got, body) {
+		t.Errorf("stored %q, want %q", got, body)
+	}
+
+	numbers := []int{}
+	for n := range fake.attempts {
+		numbers = append(numbers, n)
+	}
+	sort.Ints(numbers)
+
+	if len(numbers) != 25 || numbers[0] != 1 || numbers[24] != 25 {
+		t.Errorf("parts %v, want 1 to 25", numbers)
+	}
+}
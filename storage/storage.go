@@ -1,19 +1,208 @@
 package storage
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"io"
+	"log"
+	"mime"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/mitchellh/goamz/aws"
+	"github.com/nerdyworm/sess/config"
+	"github.com/nerdyworm/sess/errs"
 )
 
 var (
-	Primary = NewS3Store("ben-trice-space-development")
-	//Cache   = NewS3Store("ben-trice-space-development")
-	Cache   = NewFileStore("/tmp/scratch/cache/")
-	Scratch = NewFileStore("/tmp/scratch/")
+	Primary Storage
+	Cache   Storage
+	Scratch FileStore
+
+	// disk is set when the cache has a disk tier, an S3 tier is expired by
+	// its bucket's lifecycle rules instead.
+	disk *diskCache
 )
 
+// ErrNotFound is what every store's Get, Stat, Copy and Delete wrap when
+// the key is missing, the error also carries the errs.NotFound kind.
+// Exists answers false instead.
+var ErrNotFound = errors.New("storage: key not found")
+
 type Storage interface {
 	Get(string) (io.ReadCloser, error)
 	Put(string, io.Reader) error
+	PutWithOptions(string, io.Reader, PutOptions) error
 	Exists(string) (bool, error)
+	Stat(string) (Info, error)
+	List(prefix, marker string, limit int) (Listing, error)
+	Copy(src, dst string) error
 	Delete(string) error
 }
+
+// DefaultListLimit is the page size of List when no limit is given, it is
+// also the most S3 returns at once.
+const DefaultListLimit = 1000
+
+// PutOptions describe an object being put. Size is the length of the
+// reader, 0 when it is not known; stores that need it will find it
+// themselves when the reader is a file. Metadata keys are lower case.
+type PutOptions struct {
+	ContentType string
+	Size        int64
+	Metadata    map[string]string
+}
+
+// Info describes a stored object. Checksum is the hex md5 of the content,
+// empty when the store does not know it. Listings only fill in Key, Size
+// and ModTime for certain, Stat fills in the rest.
+type Info struct {
+	Key         string
+	Size        int64
+	ModTime     time.Time
+	ContentType string
+	Checksum    string
+	Metadata    map[string]string
+}
+
+// Listing is one page of keys in key order. NextMarker is passed as the
+// marker of the next call, it is empty on the last page.
+type Listing struct {
+	Objects    []Info
+	NextMarker string
+}
+
+// Setup builds the stores from config. The cache is tiered from whichever
+// of memory, local disk and an S3 bucket are configured, fastest first; the
+// disk only goes in front of a bucket when asked to. An S3 tier remembers
+// what Exists found for a while, a disk tier is bounded by the eviction
+// settings. Config has validated the durations.
+func Setup(cfg config.Storage) {
+	region, ok := aws.Regions[cfg.AWSRegion]
+	if cfg.S3Endpoint != "" {
+		region = aws.Region{Name: cfg.AWSRegion, S3Endpoint: cfg.S3Endpoint}
+	} else if !ok {
+		log.Fatalf("unknown aws region `%s`", cfg.AWSRegion)
+	}
+
+	auth := aws.Auth{AccessKey: cfg.AWSAccessKeyID, SecretKey: cfg.AWSSecretAccessKey}
+	uploads := Uploads{
+		PartSize:    int64(cfg.S3PartSizeMB) << 20,
+		Concurrency: cfg.S3UploadConcurrency,
+		Retries:     cfg.S3PartRetries,
+	}
+
+	Primary = NewS3Store(auth, region, cfg.PrimaryBucket, uploads)
+
+	tiers := []Tier{}
+
+	if cfg.CacheMemoryMB > 0 {
+		ttl, _ := time.ParseDuration(cfg.CacheMemoryTTL)
+		memory := NewMemoryStore(int64(cfg.CacheMemoryMB)<<20, int64(cfg.CacheMemoryObjectKB)<<10, ttl)
+		tiers = append(tiers, Tier{"memory", memory})
+	}
+
+	if cfg.CacheRoot != "" && (cfg.CacheBucket == "" || cfg.CacheDiskTier) {
+		store := NewFileStore(cfg.CacheRoot)
+		maxAge, _ := time.ParseDuration(cfg.CacheMaxAge)
+		interval, _ := time.ParseDuration(cfg.CacheSweepInterval)
+
+		disk = &diskCache{
+			store:    store,
+			policy:   Eviction{MaxBytes: int64(cfg.CacheMaxMB) << 20, MaxAge: maxAge},
+			interval: interval,
+		}
+		tiers = append(tiers, Tier{"disk", store})
+	}
+
+	if cfg.CacheBucket != "" {
+		hitTTL, _ := time.ParseDuration(cfg.ExistsHitTTL)
+		missTTL, _ := time.ParseDuration(cfg.ExistsMissTTL)
+		store := newExistsCache(NewS3Store(auth, region, cfg.CacheBucket, uploads), hitTTL, missTTL)
+		tiers = append(tiers, Tier{"s3", store})
+	}
+
+	mode := WriteThrough
+	if cfg.CacheWriteMode == "back" {
+		mode = WriteBack
+	}
+
+	if len(tiers) == 1 {
+		Cache = meteredStore{tiers[0].Store}
+	} else {
+		Cache = meteredStore{NewTieredStore(mode, tiers...)}
+	}
+
+	Scratch = NewFileStore(cfg.ScratchRoot)
+}
+
+// pingKey is never written, Ping only asks the store about it.
+const pingKey = "health/sentinel"
+
+// Ping checks that store answers with a Stat of a fixed key; a missing key
+// is an answer too. It never writes, Primary holds patient data and every
+// request to it is audited.
+func Ping(store Storage) error {
+	_, err := store.Stat(pingKey)
+	if err != nil && !errs.Is(err, errs.NotFound) {
+		return err
+	}
+
+	return nil
+}
+
+func notFound(op, key string) error {
+	return errs.E(errs.NotFound, op, fmt.Errorf("%w `%s`", ErrNotFound, key))
+}
+
+// contentTypeFor falls back on the key's extension when no content type was
+// given.
+func contentTypeFor(key, contentType string) string {
+	if contentType != "" {
+		return contentType
+	}
+
+	if byExtension := mime.TypeByExtension(path.Ext(key)); byExtension != "" {
+		return byExtension
+	}
+
+	return "application/octet-stream"
+}
+
+// readerSize returns the number of bytes left in r when that can be known
+// without reading it.
+func readerSize(r io.Reader) (int64, bool) {
+	switch v := r.(type) {
+	case *os.File:
+		stat, err := v.Stat()
+		if err != nil || !stat.Mode().IsRegular() {
+			return 0, false
+		}
+
+		offset, err := v.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return 0, false
+		}
+
+		return stat.Size() - offset, true
+	case *bytes.Reader:
+		return int64(v.Len()), true
+	case *bytes.Buffer:
+		return int64(v.Len()), true
+	case *strings.Reader:
+		return int64(v.Len()), true
+	}
+
+	return 0, false
+}
+
+func limitOrDefault(limit int) int {
+	if limit <= 0 || limit > DefaultListLimit {
+		return DefaultListLimit
+	}
+
+	return limit
+}
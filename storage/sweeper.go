@@ -0,0 +1,54 @@
+package storage
+
+import (
+	"log"
+	"time"
+
+	"github.com/nerdyworm/sess/errs"
+)
+
+type diskCache struct {
+	store    FileStore
+	policy   Eviction
+	interval time.Duration
+}
+
+// SweepCache runs one eviction pass over the disk cache.
+func SweepCache() (SweepResult, error) {
+	if disk == nil {
+		return SweepResult{}, errs.Errorf(errs.Invalid, "storage.SweepCache", "the cache is not on disk")
+	}
+
+	return disk.store.Sweep(disk.policy)
+}
+
+// CacheStats describes the disk cache, ok is false for an S3 cache.
+func CacheStats() (stats Stats, ok bool) {
+	if disk == nil {
+		return Stats{}, false
+	}
+
+	return disk.store.Stats(), true
+}
+
+// StartSweeper sweeps the disk cache now and then every sweep interval in
+// the background. Every process sharing the cache directory may run one,
+// evicting a key twice is harmless.
+func StartSweeper() {
+	if disk == nil || disk.interval <= 0 {
+		return
+	}
+
+	go func() {
+		for {
+			result, err := SweepCache()
+			if err != nil {
+				log.Printf("[Cache][ERROR] sweeping %v\n", err)
+			} else if result.Evicted > 0 {
+				log.Printf("[Cache] evicted %d (%d bytes), %d left (%d bytes)\n", result.Evicted, result.EvictedBytes, result.Entries, result.Bytes)
+			}
+
+			time.Sleep(disk.interval)
+		}
+	}()
+}
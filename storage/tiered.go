@@ -0,0 +1,281 @@
+package storage
+
+import (
+	"io"
+	"log"
+
+	"github.com/nerdyworm/sess/errs"
+	"github.com/nerdyworm/sess/metrics"
+)
+
+type WriteMode int
+
+const (
+	// WriteThrough returns from a put once every tier has the object.
+	WriteThrough WriteMode = iota
+	// WriteBack returns once the first tier without a size limit has the
+	// object and copies it to the slower tiers in the background. An
+	// object that was not copied yet is lost when the process exits, and
+	// other processes sharing the slower tiers do not see it until then.
+	WriteBack
+)
+
+// Tier is one level of a TieredStore, Name labels its metrics and logs.
+type Tier struct {
+	Name  string
+	Store Storage
+}
+
+// sizeLimited is implemented by tiers that only take small objects.
+type sizeLimited interface {
+	Accepts(size int64) bool
+}
+
+// TieredStore layers stores from fastest to slowest, e.g. memory, disk and
+// a shared S3 bucket. Reads go to the fastest tier that has the object and
+// fill it into the faster tiers that do not. Writes land in the first tier
+// without a size limit and are copied from there to the others according
+// to the write mode. The slowest tier is the one every object ends up in,
+// List reads from it.
+type TieredStore struct {
+	tiers []Tier
+	mode  WriteMode
+}
+
+func NewTieredStore(mode WriteMode, tiers ...Tier) TieredStore {
+	return TieredStore{tiers, mode}
+}
+
+func (s TieredStore) Get(key string) (io.ReadCloser, error) {
+	reader, _, err := s.Open(key)
+	return reader, err
+}
+
+// Open reads key from the fastest tier that has it, filling it into the
+// faster tiers that do not first.
+func (s TieredStore) Open(key string) (io.ReadCloser, Info, error) {
+	var last error
+
+	for i, tier := range s.tiers {
+		reader, info, err := Open(tier.Store, key)
+		if err == nil {
+			metrics.CacheTierReads.WithLabelValues(tier.Name).Inc()
+			if i == 0 {
+				return reader, info, nil
+			}
+
+			reader.Close()
+			return s.backfill(key, i)
+		}
+
+		if !errs.Is(err, errs.NotFound) {
+			log.Printf("[TieredStore][ERROR] %s get `%s` %v\n", tier.Name, key, err)
+			last = err
+		}
+	}
+
+	if last != nil {
+		return nil, Info{}, last
+	}
+
+	return nil, Info{}, notFound("TieredStore.Open", key)
+}
+
+// backfill copies key from tier found into each faster tier, then reads it
+// from the fastest tier that took it. A tier that fails to take it is
+// skipped, the read still succeeds from a slower one.
+func (s TieredStore) backfill(key string, found int) (io.ReadCloser, Info, error) {
+	for i := found - 1; i >= 0; i-- {
+		err := s.copyTier(key, i+1, i)
+		if err != nil {
+			log.Printf("[TieredStore][ERROR] filling %s with `%s` %v\n", s.tiers[i].Name, key, err)
+			break
+		}
+	}
+
+	for i := 0; i < found; i++ {
+		reader, info, err := Open(s.tiers[i].Store, key)
+		if err == nil {
+			return reader, info, nil
+		}
+	}
+
+	return Open(s.tiers[found].Store, key)
+}
+
+// Forget is passed on to the tiers that remember what they found.
+func (s TieredStore) Forget(key string) {
+	for _, tier := range s.tiers {
+		Forget(tier.Store, key)
+	}
+}
+
+// copyTier copies key from tier src to tier dst along with its content
+// type and metadata. Objects a size limited tier would refuse are skipped.
+func (s TieredStore) copyTier(key string, src, dst int) error {
+	from, to := s.tiers[src].Store, s.tiers[dst].Store
+
+	info, err := from.Stat(key)
+	if err != nil {
+		return err
+	}
+
+	if limited, ok := to.(sizeLimited); ok && !limited.Accepts(info.Size) {
+		return nil
+	}
+
+	reader, err := from.Get(key)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	return to.PutWithOptions(key, reader, PutOptions{
+		ContentType: info.ContentType,
+		Size:        info.Size,
+		Metadata:    info.Metadata,
+	})
+}
+
+func (s TieredStore) Put(key string, reader io.Reader) error {
+	return s.PutWithOptions(key, reader, PutOptions{})
+}
+
+func (s TieredStore) PutWithOptions(key string, reader io.Reader, options PutOptions) error {
+	landing := s.landing()
+
+	err := s.tiers[landing].Store.PutWithOptions(key, reader, options)
+	if err != nil {
+		return err
+	}
+
+	for i := landing - 1; i >= 0; i-- {
+		err := s.copyTier(key, i+1, i)
+		if err != nil {
+			log.Printf("[TieredStore][ERROR] filling %s with `%s` %v\n", s.tiers[i].Name, key, err)
+			break
+		}
+	}
+
+	if s.mode == WriteBack {
+		go func() {
+			err := s.writeOut(key, landing)
+			if err != nil {
+				log.Printf("[TieredStore][ERROR] writing back `%s` %v\n", key, err)
+			}
+		}()
+
+		return nil
+	}
+
+	return s.writeOut(key, landing)
+}
+
+// writeOut copies key from tier from to every slower tier.
+func (s TieredStore) writeOut(key string, from int) error {
+	for i := from + 1; i < len(s.tiers); i++ {
+		err := s.copyTier(key, from, i)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// landing is the first tier that takes objects of any size.
+func (s TieredStore) landing() int {
+	for i, tier := range s.tiers {
+		if _, ok := tier.Store.(sizeLimited); !ok {
+			return i
+		}
+	}
+
+	return 0
+}
+
+func (s TieredStore) Exists(key string) (bool, error) {
+	var last error
+
+	for _, tier := range s.tiers {
+		exists, err := tier.Store.Exists(key)
+		if err != nil {
+			last = err
+			continue
+		}
+
+		if exists {
+			return true, nil
+		}
+	}
+
+	return false, last
+}
+
+func (s TieredStore) Stat(key string) (Info, error) {
+	var last error
+
+	for _, tier := range s.tiers {
+		info, err := tier.Store.Stat(key)
+		if err == nil {
+			return info, nil
+		}
+
+		if !errs.Is(err, errs.NotFound) {
+			last = err
+		}
+	}
+
+	if last != nil {
+		return Info{}, last
+	}
+
+	return Info{}, notFound("TieredStore.Stat", key)
+}
+
+func (s TieredStore) List(prefix, marker string, limit int) (Listing, error) {
+	return s.tiers[len(s.tiers)-1].Store.List(prefix, marker, limit)
+}
+
+// Copy copies src within every tier that holds it.
+func (s TieredStore) Copy(src, dst string) error {
+	return s.each("TieredStore.Copy", src, func(store Storage) error {
+		return store.Copy(src, dst)
+	})
+}
+
+// Delete removes key from every tier, it is only NotFound when no tier
+// had it.
+func (s TieredStore) Delete(key string) error {
+	return s.each("TieredStore.Delete", key, func(store Storage) error {
+		return store.Delete(key)
+	})
+}
+
+// each runs fn on every tier. It returns the first error that is not
+// NotFound, or NotFound when every tier said so.
+func (s TieredStore) each(op, key string, fn func(Storage) error) error {
+	var failed error
+	found := false
+
+	for _, tier := range s.tiers {
+		err := fn(tier.Store)
+		switch {
+		case err == nil:
+			found = true
+		case errs.Is(err, errs.NotFound):
+		case failed == nil:
+			failed = err
+		}
+	}
+
+	if failed != nil {
+		return failed
+	}
+
+	if !found {
+		return notFound(op, key)
+	}
+
+	return nil
+}
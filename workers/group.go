@@ -0,0 +1,50 @@
+package workers
+
+import (
+	"sync"
+
+	"github.com/nerdyworm/sess/errs"
+)
+
+// Group coalesces calls by key: while a call for a key is in flight every
+// other caller for that key waits for it and gets its error instead of
+// making its own call.
+type Group struct {
+	mu    sync.Mutex
+	calls map[string]*call
+}
+
+type call struct {
+	done chan struct{}
+	err  error
+}
+
+func (g *Group) Do(key string, fn func() error) error {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*call)
+	}
+
+	if c, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		<-c.done
+		return c.err
+	}
+
+	c := &call{done: make(chan struct{})}
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	// waiters of a call that panics get this error instead of hanging, and
+	// the key is free for the next caller
+	c.err = errs.Errorf(errs.Unavailable, "Group.Do", "call for `%s` did not return", key)
+	defer func() {
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		close(c.done)
+	}()
+
+	c.err = fn()
+	return c.err
+}
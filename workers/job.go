@@ -2,22 +2,28 @@ package workers
 
 import (
 	"encoding/json"
-	"errors"
+	"fmt"
 	"log"
 	"time"
 
+	"github.com/nerdyworm/sess/errs"
+	"github.com/nerdyworm/sess/metrics"
+	"github.com/nerdyworm/sess/models"
 	"github.com/nerdyworm/sess/queue"
+	"github.com/nerdyworm/sess/repos"
 	"github.com/nerdyworm/sess/util"
 	"github.com/streadway/amqp"
 )
 
 type Job struct {
+	ID       string `json:"id,omitempty"`
 	Name     string `json:"name"`
 	Payload  []byte `json:"payload"`
 	Tries    int
 	Delivery amqp.Delivery `json:"-"`
 	errors   []error
 	tryAgain bool
+	deferred bool
 }
 
 func (job *Job) ReplyTimeoutOrDefault() time.Duration {
@@ -44,11 +50,80 @@ func (job *Job) AddError(err error) {
 	job.errors = append(job.errors, err)
 }
 
+func (job *Job) Failed() bool {
+	return len(job.errors) > 0
+}
+
+// Err returns the last error added to the job.
+func (job *Job) Err() error {
+	if !job.Failed() {
+		return nil
+	}
+
+	return job.errors[len(job.errors)-1]
+}
+
 func (job *Job) Ack() error {
 	return job.Delivery.Ack(false)
 }
 
-func (job *Job) PublishAndWait() error {
+// Defer acks the job without replying to it, whoever it was handed to as a
+// Waiter replies with Answer once its result is ready.
+func (job *Job) Defer() error {
+	job.deferred = true
+	return job.Ack()
+}
+
+func (job *Job) Deferred() bool {
+	return job.deferred
+}
+
+// Waiter describes who to answer for the job when it is deferred.
+func (job *Job) Waiter() models.Waiter {
+	return models.Waiter{
+		JobID:         job.ID,
+		ReplyTo:       job.Delivery.ReplyTo,
+		CorrelationID: job.Delivery.CorrelationId,
+	}
+}
+
+// Publish queues the job without waiting for a reply. Jobs published this
+// way should carry an ID so their progress can be looked up in
+// repos.Conversions.
+func (job *Job) Publish() error {
+	op := "Job.Publish(" + job.Name + ")"
+
+	body, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+
+	err = queue.Channel.Publish(
+		"",
+		TASK_QUEUE_NAME,
+		false,
+		false,
+		amqp.Publishing{
+			Body:         body,
+			ContentType:  "application/json",
+			DeliveryMode: amqp.Persistent,
+		},
+	)
+	if err != nil {
+		return errs.E(errs.Unavailable, op, err)
+	}
+
+	return nil
+}
+
+func (job *Job) PublishAndWait() (err error) {
+	op := "Job.PublishAndWait(" + job.Name + ")"
+
+	start := time.Now()
+	defer func() {
+		metrics.PublishWait.WithLabelValues(job.Name, metrics.Outcome(err)).Observe(time.Since(start).Seconds())
+	}()
+
 	body, err := json.Marshal(job)
 	if err != nil {
 		log.Printf("Error Marshaling Job: %s\n", err)
@@ -58,8 +133,9 @@ func (job *Job) PublishAndWait() error {
 	channel, err := queue.Connection.Channel()
 	if err != nil {
 		log.Printf("Error Connection.Channel(): %s\n", err)
-		return err
+		return errs.E(errs.Unavailable, op, err)
 	}
+	defer channel.Close()
 
 	q, err := channel.QueueDeclare(
 		"",    // name
@@ -72,7 +148,7 @@ func (job *Job) PublishAndWait() error {
 
 	if err != nil {
 		log.Printf("Error QueueDeclare: %s\n", err)
-		return err
+		return errs.E(errs.Unavailable, op, err)
 	}
 
 	msgs, err := channel.Consume(
@@ -86,7 +162,7 @@ func (job *Job) PublishAndWait() error {
 	)
 	if err != nil {
 		log.Printf("Error Consume: %s\n", err)
-		return err
+		return errs.E(errs.Unavailable, op, err)
 	}
 
 	corrId := util.RandomString(32)
@@ -107,33 +183,92 @@ func (job *Job) PublishAndWait() error {
 
 	if err != nil {
 		log.Println(err)
-		return err
+		return errs.E(errs.Unavailable, op, err)
 	}
 
+	timeout := time.After(job.ReplyTimeoutOrDefault())
+
 	for {
 		select {
-		case <-time.After(job.ReplyTimeoutOrDefault()):
-			log.Println("Timedout Waiting for %s\n", corrId)
-			return errors.New("Timeout")
+		case <-timeout:
+			log.Printf("Timedout Waiting for %s\n", corrId)
+			return errs.Errorf(errs.Timeout, op, "no reply after %v", job.ReplyTimeoutOrDefault())
+
+		case delivery, ok := <-msgs:
+			if !ok {
+				return errs.Errorf(errs.Unavailable, op, "reply channel closed")
+			}
 
-		case delivery := <-msgs:
 			if corrId == delivery.CorrelationId {
-				return nil
+				return replyError(op, delivery)
 			}
 		}
 	}
-
-	return nil
 }
 
+// SendReply tells the publisher that the job is done. When the job failed
+// the last error and its kind are sent along in the headers.
 func (j *Job) SendReply() error {
+	return reply(j.Delivery.ReplyTo, j.Delivery.CorrelationId, j.Err())
+}
+
+// Answer replies to deferred jobs with the outcome of the work they waited
+// for and records the status of those published with an ID.
+func Answer(waiters []models.Waiter, err error) {
+	status := models.ConversionDone
+	message := ""
+	if err != nil {
+		status = models.ConversionFailed
+		message = err.Error()
+	}
+
+	for _, waiter := range waiters {
+		if e := reply(waiter.ReplyTo, waiter.CorrelationID, err); e != nil {
+			log.Printf("[Answer:%s][ERROR] %v\n", waiter.CorrelationID, e)
+		}
+
+		if waiter.JobID == "" {
+			continue
+		}
+
+		if e := repos.Conversions.SetStatus(waiter.JobID, status, message); e != nil {
+			log.Printf("[Conversion:%s][ERROR] %v\n", waiter.JobID, e)
+		}
+	}
+}
+
+func reply(replyTo, correlationID string, err error) error {
+	if replyTo == "" {
+		return nil
+	}
+
+	headers := amqp.Table{}
+	if err != nil {
+		headers["error"] = err.Error()
+		headers["kind"] = errs.KindOf(err).String()
+	}
+
 	return queue.Channel.Publish(
-		"",                 // exchange
-		j.Delivery.ReplyTo, // routing key
-		false,              // mandatory
-		false,              // immediate
+		"",      // exchange
+		replyTo, // routing key
+		false,   // mandatory
+		false,   // immediate
 		amqp.Publishing{
-			CorrelationId: j.Delivery.CorrelationId,
+			CorrelationId: correlationID,
+			Headers:       headers,
 		})
+}
+
+func replyError(op string, delivery amqp.Delivery) error {
+	message, ok := delivery.Headers["error"].(string)
+	if !ok {
+		return nil
+	}
+
+	kind, _ := delivery.Headers["kind"].(string)
+	if errs.ParseKind(kind) == errs.Unknown {
+		kind = errs.ConversionFailed.String()
+	}
 
+	return errs.E(errs.ParseKind(kind), op, fmt.Errorf("%s", message))
 }
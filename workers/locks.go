@@ -0,0 +1,40 @@
+package workers
+
+import (
+	"log"
+	"time"
+
+	"github.com/nerdyworm/sess/errs"
+	"github.com/nerdyworm/sess/repos"
+)
+
+// lockReapInterval is how often expired locks are looked for. A lock only
+// expires when its holder stopped renewing it, the jobs deferred behind it
+// are never answered unless another job for its key takes it over.
+const lockReapInterval = 30 * time.Second
+
+func reapLocks() {
+	ticker := time.NewTicker(lockReapInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		err := reapExpiredLocks(time.Now())
+		if err != nil {
+			log.Printf("[Locks][ERROR] reaping %v\n", err)
+		}
+	}
+}
+
+// reapExpiredLocks fails the jobs deferred behind locks that expired before
+// before. Their publishers get an error they can retry on instead of
+// waiting out their timeout, and conversions published with an ID are
+// marked failed instead of staying running.
+func reapExpiredLocks(before time.Time) error {
+	waiters, err := repos.Locks.Reap(before)
+	if len(waiters) > 0 {
+		log.Printf("[Locks] answering %d jobs deferred behind expired locks\n", len(waiters))
+		Answer(waiters, errs.Errorf(errs.Unavailable, "reapExpiredLocks", "the conversion the job waited for was abandoned"))
+	}
+
+	return err
+}
@@ -0,0 +1,83 @@
+package workers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nerdyworm/sess/models"
+	"github.com/nerdyworm/sess/repos"
+)
+
+// expiredLocks holds waiters behind locks that expire at the given times.
+type expiredLocks struct {
+	repos.LocksRepo
+	expires map[string]time.Time
+	waiters map[string][]models.Waiter
+}
+
+func (f expiredLocks) Reap(before time.Time) ([]models.Waiter, error) {
+	waiters := []models.Waiter{}
+	for name, expires := range f.expires {
+		if expires.Before(before) {
+			waiters = append(waiters, f.waiters[name]...)
+			delete(f.expires, name)
+			delete(f.waiters, name)
+		}
+	}
+
+	return waiters, nil
+}
+
+type statuses struct {
+	repos.ConversionsRepo
+	set map[string]string
+}
+
+func (f statuses) SetStatus(id, status, message string) error {
+	f.set[id] = status
+	return nil
+}
+
+func TestReapExpiredLocks(t *testing.T) {
+	defer func(locks repos.LocksRepo, conversions repos.ConversionsRepo) {
+		repos.Locks, repos.Conversions = locks, conversions
+	}(repos.Locks, repos.Conversions)
+
+	now := time.Now()
+	locks := expiredLocks{
+		expires: map[string]time.Time{
+			"dead":  now.Add(-time.Second),
+			"alive": now.Add(time.Minute),
+		},
+		waiters: map[string][]models.Waiter{
+			"dead":  {{JobID: "a"}, {JobID: "b"}, {CorrelationID: "untracked"}},
+			"alive": {{JobID: "c"}},
+		},
+	}
+	conversions := statuses{set: map[string]string{}}
+	repos.Locks, repos.Conversions = locks, conversions
+
+	err := reapExpiredLocks(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{"a": models.ConversionFailed, "b": models.ConversionFailed}
+	if len(conversions.set) != len(want) {
+		t.Errorf("statuses %v, want %v", conversions.set, want)
+	}
+
+	for id, status := range want {
+		if conversions.set[id] != status {
+			t.Errorf("status of %s = %q, want %q", id, conversions.set[id], status)
+		}
+	}
+
+	if _, ok := locks.expires["alive"]; !ok {
+		t.Error("reaped a held lock")
+	}
+
+	if len(locks.waiters["alive"]) != 1 {
+		t.Errorf("waiters of a held lock %v", locks.waiters["alive"])
+	}
+}
@@ -4,10 +4,16 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"net/http"
 	"time"
 
+	"github.com/nerdyworm/sess/config"
 	"github.com/nerdyworm/sess/conversions"
+	"github.com/nerdyworm/sess/health"
+	"github.com/nerdyworm/sess/metrics"
+	"github.com/nerdyworm/sess/models"
 	"github.com/nerdyworm/sess/queue"
+	"github.com/nerdyworm/sess/repos"
 	"github.com/streadway/amqp"
 )
 
@@ -35,9 +41,30 @@ var (
 	EXCHANGE_NAME   = "sess.workers"
 )
 
-func Run() {
+func Run(cfg config.Workers) {
 	setupQueue()
-	runWorkers()
+	go serveHTTP(cfg.HTTPAddr)
+	go reapLocks()
+	runWorkers(cfg.Concurrency)
+}
+
+// serveHTTP serves health checks and metrics on a side port, the workers
+// have no other http listener.
+func serveHTTP(addr string) {
+	if addr == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", health.Liveness)
+	mux.HandleFunc("/readyz", health.Readiness)
+	mux.Handle("/metrics", metrics.Handler())
+
+	log.Printf(" [x] Serving health checks and metrics on %s", addr)
+	err := http.ListenAndServe(addr, mux)
+	if err != nil {
+		log.Printf("[ERROR] http listener %v\n", err)
+	}
 }
 
 func setupQueue() {
@@ -79,10 +106,10 @@ func setupQueue() {
 	failOnError(err, "Failed to set QoS")
 }
 
-func runWorkers() {
+func runWorkers(concurrency int) {
 	forever := make(chan bool)
 
-	for i := 0; i < 40; i++ {
+	for i := 0; i < concurrency; i++ {
 		go work(i)
 	}
 
@@ -113,18 +140,37 @@ func work(n int) {
 
 		log.Printf("[%d] Got %s %s", n, job.Name, job.Payload)
 		if fn, ok := workers[job.Name]; ok {
+			track(&job, models.ConversionRunning)
 			fn(&job, d)
+
+			if job.Deferred() {
+				log.Printf("[%d] Deferred %s %v", n, job.Name, time.Since(start))
+				continue
+			}
+
 			log.Printf("[%d] Finished %s %v", n, job.Name, time.Since(start))
+			metrics.JobDuration.WithLabelValues(job.Name, metrics.Outcome(job.Err())).Observe(time.Since(start).Seconds())
 
 			if job.ShouldRetry() {
+				metrics.JobRetries.WithLabelValues(job.Name).Inc()
 				err = retryJob(&job, d)
 				if err != nil {
 					log.Printf("Error retyring %s %v \n", job.Name, err)
 				}
+				d.Ack(false)
 			} else {
 				if job.Tries > 1 {
 					log.Printf("Max Retries %s %v\n", job.Name, string(job.Payload))
+				}
+
+				if job.Failed() {
+					log.Printf("[%d] Failed %s %v", n, job.Name, job.Err())
+					metrics.JobFailures.WithLabelValues(job.Name, metrics.Outcome(job.Err())).Inc()
+					track(&job, models.ConversionFailed)
+					job.SendReply()
 					d.Nack(false, false)
+				} else {
+					track(&job, models.ConversionDone)
 				}
 				continue
 			}
@@ -136,6 +182,23 @@ func work(n int) {
 	}
 }
 
+// track records the status of jobs published with an ID.
+func track(job *Job, status string) {
+	if job.ID == "" {
+		return
+	}
+
+	message := ""
+	if err := job.Err(); err != nil {
+		message = err.Error()
+	}
+
+	err := repos.Conversions.SetStatus(job.ID, status, message)
+	if err != nil {
+		log.Printf("[Conversion:%s][ERROR] %v\n", job.ID, err)
+	}
+}
+
 func retryJob(job *Job, d amqp.Delivery) error {
 	job.IncrementTries()
 